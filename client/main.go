@@ -3,6 +3,8 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,6 +13,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/hotp"
 	"github.com/pquerna/otp/totp"
 )
 
@@ -25,6 +29,11 @@ type RegisterResponse struct {
 		Secret    string    `json:"secret"`
 		CreatedAt time.Time `json:"created_at"`
 		IsActive  bool      `json:"is_active"`
+		Type      string    `json:"type"`
+		Counter   uint64    `json:"counter"`
+		Algorithm string    `json:"algorithm"`
+		Digits    int       `json:"digits"`
+		Period    int       `json:"period"`
 	} `json:"master_token"`
 	QRCodeURL string `json:"qr_code_url"`
 	Secret    string `json:"secret"`
@@ -39,6 +48,10 @@ type ValidateOTPResponse struct {
 	Valid bool `json:"valid"`
 }
 
+type ConfirmResponse struct {
+	Confirmed bool `json:"confirmed"`
+}
+
 type Client struct {
 	baseURL string
 	client  *http.Client
@@ -51,6 +64,41 @@ func NewClient(baseURL string) *Client {
 	}
 }
 
+// configureTLS sets up HTTPS from environment variables: OTP_CA_FILE to
+// trust a private CA, and OTP_CLIENT_CERT/OTP_CLIENT_KEY for mutual TLS.
+func (c *Client) configureTLS() error {
+	tlsConfig := &tls.Config{}
+	configured := false
+
+	if caFile := os.Getenv("OTP_CA_FILE"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+		configured = true
+	}
+
+	certFile, keyFile := os.Getenv("OTP_CLIENT_CERT"), os.Getenv("OTP_CLIENT_KEY")
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+		configured = true
+	}
+
+	if configured {
+		c.client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+	return nil
+}
+
 func (c *Client) Register(issuer, accountName string) (*RegisterResponse, error) {
 	req := RegisterRequest{
 		Issuer:      issuer,
@@ -103,12 +151,45 @@ func (c *Client) ValidateOTP(userID, otp string) (*ValidateOTPResponse, error) {
 	if err != nil {
 		return nil, err
 	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError {
+		return nil, fmt.Errorf("validation failed: %s", string(body))
+	}
 
 	var validateResp ValidateOTPResponse
 	err = json.Unmarshal(body, &validateResp)
 	return &validateResp, err
 }
 
+func (c *Client) Confirm(userID, otp string) (*ConfirmResponse, error) {
+	req := ValidateOTPRequest{
+		UserID: userID,
+		OTP:    otp,
+	}
+
+	jsonData, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Post(c.baseURL+"/register/confirm", "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError {
+		return nil, fmt.Errorf("confirmation failed: %s", string(body))
+	}
+
+	var confirmResp ConfirmResponse
+	err = json.Unmarshal(body, &confirmResp)
+	return &confirmResp, err
+}
+
 func (c *Client) GetProtectedData(userID, otp string) (string, error) {
 	req, err := http.NewRequest("GET", c.baseURL+"/api/protected-data", nil)
 	if err != nil {
@@ -155,8 +236,43 @@ func (c *Client) GetStatus(userID, otp string) (string, error) {
 	return string(body), nil
 }
 
+// otpOpts holds the parameters of the current token; the zero value yields
+// the pquerna defaults (SHA1, 6 digits, 30 seconds). For HOTP tokens
+// hotpCounter tracks the next counter value, like a hardware token would.
+var (
+	otpOpts     totp.ValidateOpts
+	useHOTP     bool
+	hotpCounter uint64
+)
+
 func generateOTP(secret string) (string, error) {
-	return totp.GenerateCode(secret, time.Now())
+	if useHOTP {
+		code, err := hotp.GenerateCodeCustom(secret, hotpCounter, hotp.ValidateOpts{
+			Digits:    otpOpts.Digits,
+			Algorithm: otpOpts.Algorithm,
+		})
+		if err == nil {
+			hotpCounter++
+		}
+		return code, err
+	}
+	return totp.GenerateCodeCustom(secret, time.Now(), otpOpts)
+}
+
+func tokenOpts(algorithm string, digits, period int) totp.ValidateOpts {
+	opts := totp.ValidateOpts{
+		Period: uint(period),
+		Digits: otp.Digits(digits),
+	}
+	switch algorithm {
+	case "SHA256":
+		opts.Algorithm = otp.AlgorithmSHA256
+	case "SHA512":
+		opts.Algorithm = otp.AlgorithmSHA512
+	default:
+		opts.Algorithm = otp.AlgorithmSHA1
+	}
+	return opts
 }
 
 func main() {
@@ -166,16 +282,21 @@ func main() {
 	}
 
 	client := NewClient(baseURL)
+	if err := client.configureTLS(); err != nil {
+		fmt.Printf("TLS setup failed: %v\n", err)
+		os.Exit(1)
+	}
 	scanner := bufio.NewScanner(os.Stdin)
 
 	fmt.Println("=== OTP Client ===")
 	fmt.Println("Commands:")
 	fmt.Println("1. register - Register a new master token")
-	fmt.Println("2. generate - Generate OTP for existing user")
-	fmt.Println("3. validate - Validate OTP")
-	fmt.Println("4. status - Get protected status")
-	fmt.Println("5. data - Get protected data")
-	fmt.Println("6. quit - Exit")
+	fmt.Println("2. confirm - Confirm the registered token with a generated OTP")
+	fmt.Println("3. generate - Generate OTP for existing user")
+	fmt.Println("4. validate - Validate OTP")
+	fmt.Println("5. status - Get protected status")
+	fmt.Println("6. data - Get protected data")
+	fmt.Println("7. quit - Exit")
 	fmt.Println()
 
 	var currentUserID, currentSecret string
@@ -208,12 +329,40 @@ func main() {
 
 			currentUserID = resp.MasterToken.ID
 			currentSecret = resp.Secret
+			otpOpts = tokenOpts(resp.MasterToken.Algorithm, resp.MasterToken.Digits, resp.MasterToken.Period)
+			useHOTP = resp.MasterToken.Type == "hotp"
+			hotpCounter = resp.MasterToken.Counter
 
 			fmt.Printf("Registration successful!\n")
 			fmt.Printf("User ID: %s\n", resp.MasterToken.ID)
 			fmt.Printf("Secret: %s\n", resp.Secret)
 			fmt.Printf("QR Code URL: %s\n", resp.QRCodeURL)
 			fmt.Println("Save the secret and scan the QR code with your authenticator app.")
+			fmt.Println("Then run 'confirm' to activate the token.")
+
+		case "confirm":
+			if currentUserID == "" {
+				fmt.Println("No user ID available. Please register first.")
+				continue
+			}
+
+			otp, err := generateOTP(currentSecret)
+			if err != nil {
+				fmt.Printf("Failed to generate OTP: %v\n", err)
+				continue
+			}
+
+			resp, err := client.Confirm(currentUserID, otp)
+			if err != nil {
+				fmt.Printf("Confirmation failed: %v\n", err)
+				continue
+			}
+
+			if resp.Confirmed {
+				fmt.Println("Token confirmed and active!")
+			} else {
+				fmt.Println("Token could not be confirmed!")
+			}
 
 		case "generate":
 			if currentSecret == "" {
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"otp-basic/internal/database"
+)
+
+var (
+	// ErrTokenNotFound is returned by the management calls for unknown IDs.
+	ErrTokenNotFound = errors.New("master token not found")
+	// ErrTokenPending is returned when activating a token that has never been
+	// confirmed; only its owner can do that via ConfirmMasterToken.
+	ErrTokenPending = errors.New("master token is pending confirmation")
+)
+
+// MasterTokenFilter is an alias for database.MasterTokenFilter
+type MasterTokenFilter = database.MasterTokenFilter
+
+// ListMasterTokens returns the tokens matching filter, newest first.
+func (am *AuthManager) ListMasterTokens(ctx context.Context, filter MasterTokenFilter) ([]*MasterToken, error) {
+	tokens, err := am.store.ListMasterTokens(ctx, filter)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	return tokens, nil
+}
+
+// SetMasterTokenActive deactivates or reactivates a confirmed token.
+func (am *AuthManager) SetMasterTokenActive(ctx context.Context, userID string, active bool) (*MasterToken, error) {
+	token, err := am.LookupMasterToken(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if token.IsPending() {
+		return nil, ErrTokenPending
+	}
+
+	// Only is_active is written, so a rotation or rewrap running at the
+	// same time can't be undone with the secret read above
+	found, err := am.store.SetMasterTokenActive(ctx, userID, active)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrTokenNotFound
+	}
+	return am.LookupMasterToken(ctx, userID)
+}
+
+// DeleteMasterToken removes a token together with its recovery codes and
+// used OTP records.
+func (am *AuthManager) DeleteMasterToken(ctx context.Context, userID string) error {
+	if _, err := am.LookupMasterToken(ctx, userID); err != nil {
+		return err
+	}
+	if err := am.store.DeleteMasterToken(ctx, userID); err != nil {
+		return err
+	}
+	am.ClearLockout(userID, "")
+	return nil
+}
+
+// RotateSecret replaces a token's secret. Codes from the old secret and all
+// open sessions stop working immediately; the returned token carries the new
+// secret so it can be enrolled again.
+func (am *AuthManager) RotateSecret(ctx context.Context, userID string) (*MasterToken, error) {
+	token, err := am.LookupMasterToken(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := am.generateSecret()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate secret: %w", err)
+	}
+	if err := am.store.RotateMasterTokenSecret(ctx, token.ID, secret); err != nil {
+		return nil, err
+	}
+	if err := am.store.RevokeSessionsForToken(ctx, token.ID, time.Now()); err != nil {
+		return nil, err
+	}
+
+	token.Secret = secret
+	token.Counter = 0
+	return token, nil
+}
+
+// LookupMasterToken returns the token of userID. Unlike GetMasterToken it
+// tells an unknown ID, ErrTokenNotFound, from a store failure, which wraps
+// ErrStorage.
+func (am *AuthManager) LookupMasterToken(ctx context.Context, userID string) (*MasterToken, error) {
+	token, err := am.store.GetMasterToken(ctx, userID)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	if token == nil {
+		return nil, ErrTokenNotFound
+	}
+	return token, nil
+}
+
+// ProvisioningURI returns the otpauth:// URI for a token using its stored
+// issuer and account name.
+func ProvisioningURI(token *MasterToken) string {
+	var issuer, accountName string
+	if token.Issuer != nil {
+		issuer = *token.Issuer
+	}
+	if token.AccountName != nil {
+		accountName = *token.AccountName
+	}
+	return keyURI(token, issuer, accountName)
+}
+
+// BindClientCert binds a token to a TLS client certificate subject, such as
+// "CN=alice,O=Example". From then on OTPs and sessions of the token are only
+// accepted over mTLS connections presenting that subject. An empty subject
+// removes the binding.
+func (am *AuthManager) BindClientCert(ctx context.Context, userID, subject string) (*MasterToken, error) {
+	var bound *string
+	if subject != "" {
+		bound = &subject
+	}
+
+	found, err := am.store.SetClientCertSubject(ctx, userID, bound)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrTokenNotFound
+	}
+	return am.LookupMasterToken(ctx, userID)
+}
@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"otp-basic/internal/database"
+)
+
+// AuthEvent is an alias for database.AuthEvent
+type AuthEvent = database.AuthEvent
+
+// Types of audit events.
+const (
+	EventRegistration      = "registration"
+	EventConfirmation      = "confirmation"
+	EventValidation        = "validation"
+	EventLockout           = "lockout"
+	EventDeactivation      = "deactivation"
+	EventReactivation      = "reactivation"
+	EventSecretRotation    = "secret_rotation"
+	EventDeletion          = "deletion"
+	EventClientCertBinding = "client_cert_binding"
+)
+
+// Outcomes of audited management operations. Validation and confirmation
+// events use the metrics outcomes instead, such as "valid" or "replay".
+const (
+	EventOutcomeSuccess = "success"
+	EventOutcomeFailure = "failure"
+)
+
+// EventSink receives audit events as they are recorded. Emit is called on the
+// request path, so it must not block.
+type EventSink interface {
+	Emit(event *AuthEvent)
+}
+
+// auditPageSize is how many events VerifyAuditLog reads at a time.
+const auditPageSize = 1000
+
+// auditQueue appends audit events from a background goroutine, so requests
+// don't wait for the audit log's row lock.
+type auditQueue struct {
+	events    chan *queuedEvent
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type queuedEvent struct {
+	ctx   context.Context
+	event *AuthEvent
+}
+
+// startAuditQueue starts appending queued events, up to size of which may
+// wait at a time.
+func (am *AuthManager) startAuditQueue(size int) {
+	q := &auditQueue{
+		events: make(chan *queuedEvent, size),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	am.auditQueue = q
+
+	go func() {
+		defer close(q.done)
+		for {
+			select {
+			case queued := <-q.events:
+				am.appendEvent(queued.ctx, queued.event)
+			case <-q.stop:
+				for {
+					select {
+					case queued := <-q.events:
+						am.appendEvent(queued.ctx, queued.event)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+// Close appends the audit events still queued, waiting at most timeout.
+// Events recorded afterwards are appended on the request path.
+func (am *AuthManager) Close(timeout time.Duration) error {
+	q := am.auditQueue
+	if q == nil {
+		return nil
+	}
+	q.closeOnce.Do(func() { close(q.stop) })
+
+	select {
+	case <-q.done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out recording %d queued audit events", len(q.events))
+	}
+}
+
+// RecordEvent appends an event to the audit log and hands it to the event
+// sink. A failed write is logged but doesn't fail the operation being
+// audited, and the event still reaches the sink. With AUDIT_QUEUE_SIZE set
+// the event is only queued, unless the queue is full.
+func (am *AuthManager) RecordEvent(ctx context.Context, eventType, tokenID string, client ClientInfo, outcome string) {
+	event := &AuthEvent{
+		OccurredAt: time.Now(),
+		Type:       eventType,
+		TokenID:    tokenID,
+		SourceIP:   client.IP,
+		UserAgent:  client.UserAgent,
+		Outcome:    outcome,
+	}
+
+	if q := am.auditQueue; q != nil {
+		// Checked on its own, since select picks at random among ready cases
+		select {
+		case <-q.stop:
+		default:
+			select {
+			case q.events <- &queuedEvent{ctx: context.WithoutCancel(ctx), event: event}:
+				return
+			default:
+				// Rather than drop an audit event, wait for the append
+			}
+		}
+	}
+	am.appendEvent(ctx, event)
+}
+
+func (am *AuthManager) appendEvent(ctx context.Context, event *AuthEvent) {
+	if err := am.store.AppendAuthEvent(ctx, event); err != nil {
+		log.Printf("Failed to record %s event for %s: %v", event.Type, event.TokenID, err)
+	}
+	if am.eventSink != nil {
+		am.eventSink.Emit(event)
+	}
+}
+
+// ListAuthEvents returns up to limit audit events with IDs above afterID,
+// oldest first.
+func (am *AuthManager) ListAuthEvents(ctx context.Context, afterID int64, limit int) ([]*AuthEvent, error) {
+	return am.store.ListAuthEvents(ctx, afterID, limit)
+}
+
+// AuditVerification is the result of VerifyAuditLog.
+type AuditVerification struct {
+	// Valid is false if an event was altered or removed.
+	Valid bool
+	// Events is the number of events checked.
+	Events int64
+	// HeadHash is the hash of the last intact event.
+	HeadHash string
+	// BrokenAt is the ID of the first event that fails verification, or 0
+	// if events were removed from the end of the log.
+	BrokenAt int64
+	// Reason explains why verification failed.
+	Reason string
+}
+
+// VerifyAuditLog walks the whole audit log and checks that every event
+// carries the hash of its predecessor and that its own hash matches its
+// contents. The log must also reach the head hash the store recorded with
+// the last append, or events were removed from its end. On failure Valid is
+// false, Reason says why and BrokenAt names the first bad event, if any.
+func (am *AuthManager) VerifyAuditLog(ctx context.Context) (*AuditVerification, error) {
+	result := &AuditVerification{Valid: true, HeadHash: database.GenesisHash}
+
+	// Read before the walk, so events appended meanwhile are walked past it
+	// rather than reported as missing
+	head, err := am.store.AuthEventHead(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reachedHead := head == database.GenesisHash
+
+	var afterID int64
+	for {
+		events, err := am.store.ListAuthEvents(ctx, afterID, auditPageSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(events) == 0 {
+			break
+		}
+
+		for _, event := range events {
+			switch {
+			case event.PrevHash != result.HeadHash:
+				result.Reason = "previous hash does not match, events before it were altered or removed"
+			case database.HashAuthEvent(event) != event.Hash:
+				result.Reason = "hash does not match the event's contents"
+			}
+			if result.Reason != "" {
+				result.Valid = false
+				result.BrokenAt = event.ID
+				return result, nil
+			}
+
+			result.Events++
+			result.HeadHash = event.Hash
+			reachedHead = reachedHead || event.Hash == head
+			afterID = event.ID
+		}
+	}
+
+	if !reachedHead {
+		result.Valid = false
+		result.Reason = "log ends before the recorded head, events were removed from its end"
+	}
+	return result, nil
+}
@@ -1,31 +1,151 @@
 package auth
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base32"
+	"errors"
 	"fmt"
+	"log"
+	"sync"
 	"time"
 
 	"otp-basic/internal/database"
+	"otp-basic/internal/metrics"
 
 	"github.com/google/uuid"
+	"github.com/pquerna/otp/hotp"
 	"github.com/pquerna/otp/totp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// tracerName identifies the spans of this package.
+const tracerName = "otp-basic/internal/auth"
+
+const (
+	// usedOTPRetention is how long accepted time steps are remembered. It only
+	// has to exceed the widest validation window; anything older can't be
+	// replayed.
+	usedOTPRetention = (2*maxSkew + 1) * maxPeriod * time.Second
+	pruneInterval    = time.Minute
+	pruneTimeout     = 30 * time.Second
+)
+
+var (
+	// ErrTokenInactive is returned for OTPs of deactivated tokens, and when
+	// confirming a token that isn't pending.
+	ErrTokenInactive = errors.New("master token is not active")
+	// ErrClientCertMismatch is returned when a token bound to a client
+	// certificate is used without it.
+	ErrClientCertMismatch = errors.New("client certificate does not match master token")
+	// ErrInvalidCode is returned for codes that don't match the token.
+	ErrInvalidCode = errors.New("invalid otp")
+	// ErrCodeReplayed is returned for codes that match but were already
+	// accepted once.
+	ErrCodeReplayed = errors.New("otp already used")
+	// ErrStorage is wrapped by errors caused by the token store rather than
+	// the caller, such as a database outage.
+	ErrStorage = errors.New("token storage unavailable")
+)
+
+// LockedError is returned while a user or client IP is locked out after
+// repeated failures.
+type LockedError struct {
+	// RetryAfter is how long until the next attempt will be checked.
+	RetryAfter time.Duration
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("too many failed attempts, retry after %s", e.RetryAfter)
+}
+
+func storageError(err error) error {
+	return fmt.Errorf("%w: %w", ErrStorage, err)
+}
+
 // MasterToken is an alias for database.MasterToken for backward compatibility
 type MasterToken = database.MasterToken
 
 type AuthManager struct {
-	db *database.DB
+	store       TokenStore
+	throttle    *throttle
+	sessions    SessionConfig
+	forwardAuth ForwardAuthConfig
+
+	// hotpLookAhead is how many counter values past the stored one are
+	// checked, to tolerate button presses that never reached the server.
+	hotpLookAhead int
+
+	// pendingTTL is how long a newly registered token may stay unconfirmed
+	// before it expires and is deleted.
+	pendingTTL time.Duration
+
+	// metrics is nil unless SetMetrics has been called.
+	metrics *metrics.Metrics
+
+	// eventSink is nil unless SetEventSink has been called.
+	eventSink EventSink
+
+	// auditQueue is nil unless AUDIT_QUEUE_SIZE is set, in which case audit
+	// events are appended in the background.
+	auditQueue *auditQueue
+
+	tracer trace.Tracer
+
+	mu        sync.Mutex
+	lastPrune time.Time
 }
 
-func NewAuthManager(db *database.DB) *AuthManager {
-	return &AuthManager{
-		db: db,
+// NewAuthManager creates an AuthManager on top of any TokenStore, such as
+// *database.DB or database.NewMemoryStore(). With AUDIT_QUEUE_SIZE set, Close
+// must be called before the store is closed.
+func NewAuthManager(store TokenStore) *AuthManager {
+	am := &AuthManager{
+		store:       store,
+		throttle:    newThrottle(loadLockoutConfig()),
+		sessions:    loadSessionConfig(),
+		forwardAuth: loadForwardAuthConfig(),
+
+		hotpLookAhead: getEnvInt("HOTP_LOOK_AHEAD", 10),
+		pendingTTL:    getEnvDuration("PENDING_TOKEN_TTL", 15*time.Minute),
+
+		tracer: otel.GetTracerProvider().Tracer(tracerName),
+	}
+	if size := getEnvInt("AUDIT_QUEUE_SIZE", 0); size > 0 {
+		am.startAuditQueue(size)
 	}
+	return am
+}
+
+// SetMetrics makes the manager record registrations and validation outcomes.
+// It must be called before the manager is used.
+func (am *AuthManager) SetMetrics(m *metrics.Metrics) {
+	am.metrics = m
+}
+
+// SetTracerProvider makes the manager create its spans with provider instead
+// of the global tracer provider. It must be called before the manager is
+// used.
+func (am *AuthManager) SetTracerProvider(provider trace.TracerProvider) {
+	am.tracer = provider.Tracer(tracerName)
 }
 
-func (am *AuthManager) RegisterMasterToken(issuer, accountName string) (*MasterToken, error) {
+// SetEventSink forwards every audit event to sink as well, such as a SIEM.
+// It must be called before the manager is used.
+func (am *AuthManager) SetEventSink(sink EventSink) {
+	am.eventSink = sink
+}
+
+// RegisterMasterToken creates a pending token. It can't be used until it has
+// been confirmed with ConfirmMasterToken.
+func (am *AuthManager) RegisterMasterToken(ctx context.Context, issuer, accountName string, opts TokenOptions) (*MasterToken, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
 	// Generate a random secret for TOTP
 	secret, err := am.generateSecret()
 	if err != nil {
@@ -36,31 +156,338 @@ func (am *AuthManager) RegisterMasterToken(issuer, accountName string) (*MasterT
 		ID:          uuid.New().String(),
 		Secret:      secret,
 		CreatedAt:   time.Now(),
-		IsActive:    true,
+		IsActive:    false,
 		Issuer:      &issuer,
 		AccountName: &accountName,
+		Algorithm:   opts.Algorithm,
+		Digits:      opts.Digits,
+		Period:      opts.Period,
+		Skew:        opts.Skew,
+		Type:        opts.Type,
 	}
 
 	// Save to database
-	if err := am.db.CreateMasterToken(token); err != nil {
+	if err := am.store.CreateMasterToken(ctx, token); err != nil {
 		return nil, fmt.Errorf("failed to save master token to database: %w", err)
 	}
 
+	am.metrics.RecordRegistration()
+	am.maybePrune(token.CreatedAt)
+
 	return token, nil
 }
 
-func (am *AuthManager) ValidateOTP(userID, otpCode string) bool {
+// ValidateOTP checks otpCode for userID on behalf of client and returns nil if
+// it is accepted. An unused recovery code is accepted in place of an OTP.
+// Failed attempts are throttled per user and per client IP; while either is
+// locked out the code is not checked at all and a *LockedError is returned.
+// Otherwise failures are ErrTokenNotFound, ErrTokenInactive,
+// ErrClientCertMismatch, ErrInvalidCode, ErrCodeReplayed or an error wrapping
+// ErrStorage.
+func (am *AuthManager) ValidateOTP(ctx context.Context, userID, otpCode string, client ClientInfo) error {
+	ctx, span := am.tracer.Start(ctx, "AuthManager.ValidateOTP")
+	defer span.End()
+
+	return am.checkOTP(ctx, userID, otpCode, client, false)
+}
+
+// ConfirmMasterToken activates a pending token once its owner proves they
+// have enrolled it by submitting a valid code. Attempts are throttled and
+// fail like ValidateOTP; a token that isn't pending is ErrTokenInactive.
+func (am *AuthManager) ConfirmMasterToken(ctx context.Context, userID, otpCode string, client ClientInfo) error {
+	ctx, span := am.tracer.Start(ctx, "AuthManager.ConfirmMasterToken")
+	defer span.End()
+
+	if err := am.checkOTP(ctx, userID, otpCode, client, true); err != nil {
+		return err
+	}
+
+	confirmed, err := am.store.ConfirmMasterToken(ctx, userID, time.Now())
+	if err != nil {
+		log.Printf("Failed to confirm master token %s: %v", userID, err)
+		return storageError(err)
+	}
+	if !confirmed {
+		// Confirmed by a concurrent request in the meantime
+		return ErrTokenInactive
+	}
+	return nil
+}
+
+func (am *AuthManager) isConfirmable(token *MasterToken) bool {
+	return token.IsPending() && time.Since(token.CreatedAt) < am.pendingTTL
+}
+
+// checkOTP verifies otpCode against userID's token and records the outcome
+// in the metrics, the audit log and on the current span.
+func (am *AuthManager) checkOTP(ctx context.Context, userID, otpCode string, client ClientInfo, confirming bool) error {
+	operation, eventType := metrics.OperationValidate, EventValidation
+	if confirming {
+		operation, eventType = metrics.OperationConfirm, EventConfirmation
+	}
+
+	err := am.checkOTPCode(ctx, userID, otpCode, client, confirming)
+	outcome := outcomeOf(err)
+	am.metrics.RecordValidation(operation, outcome)
+	am.RecordEvent(ctx, eventType, userID, client, outcome)
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("otp.user_id", userID),
+		attribute.String("otp.outcome", outcome),
+	)
+	return err
+}
+
+// checkOTPCode does the work of checkOTP. When confirming, the token must be
+// pending and only a real OTP proves enrollment; otherwise the token must be
+// active. Tokens bound to a client certificate also require the client to
+// present it.
+func (am *AuthManager) checkOTPCode(ctx context.Context, userID, otpCode string, client ClientInfo, confirming bool) error {
+	now := time.Now()
+
+	var clientKeys []string
+	if !client.SharedIP {
+		clientKeys = append(clientKeys, ipKey(client.IP))
+	}
+
+	// An IP lockout says nothing about the user, so it is checked before
+	// the token is loaded
+	if wait := am.throttle.retryAfter(now, clientKeys...); wait > 0 {
+		return &LockedError{RetryAfter: wait}
+	}
+
 	// Get master token from database
-	token, err := am.db.GetMasterToken(userID)
-	if err != nil || token == nil || !token.IsActive {
-		return false
+	token, err := am.store.GetMasterToken(ctx, userID)
+	if err != nil {
+		log.Printf("Failed to load master token %s: %v", userID, err)
+		return storageError(err)
 	}
 
-	return totp.Validate(otpCode, token.Secret)
+	// Unknown users are throttled like known ones, so a lockout doesn't
+	// reveal which IDs exist. They share a bounded set of counters so
+	// arbitrary IDs can't grow the counter table.
+	userThrottleKey := userKey(userID)
+	if token == nil {
+		userThrottleKey = am.throttle.unknownUserKey(userID)
+	}
+	keys := append([]string{userThrottleKey}, clientKeys...)
+
+	if wait := am.throttle.retryAfter(now, userThrottleKey); wait > 0 {
+		return &LockedError{RetryAfter: wait}
+	}
+	if token == nil {
+		am.recordFailure(ctx, now, userID, client, keys...)
+		return ErrTokenNotFound
+	}
+
+	usable := token.IsActive
+	if confirming {
+		usable = am.isConfirmable(token)
+	}
+	if !usable {
+		am.recordFailure(ctx, now, userID, client, keys...)
+		return ErrTokenInactive
+	}
+	if !clientCertAllowed(token, client) {
+		am.recordFailure(ctx, now, userID, client, keys...)
+		return ErrClientCertMismatch
+	}
+
+	if err := am.verifyCode(ctx, token, otpCode, now, !confirming); err != nil {
+		if errors.Is(err, ErrStorage) {
+			log.Printf("Failed to verify code for %s: %v", token.ID, err)
+			return err
+		}
+		am.recordFailure(ctx, now, userID, client, keys...)
+		return err
+	}
+
+	// The IP counter is deliberately left alone so one valid account can't
+	// be used to reset the budget for guessing others
+	am.throttle.clear(userKey(userID))
+	am.maybePrune(now)
+	return nil
+}
+
+// outcomeOf maps the result of checkOTPCode to a metrics outcome.
+func outcomeOf(err error) string {
+	var locked *LockedError
+	switch {
+	case err == nil:
+		return metrics.OutcomeValid
+	case errors.As(err, &locked):
+		return metrics.OutcomeLockedOut
+	case errors.Is(err, ErrStorage):
+		return metrics.OutcomeError
+	case errors.Is(err, ErrTokenNotFound):
+		return metrics.OutcomeUnknownUser
+	case errors.Is(err, ErrTokenInactive):
+		return metrics.OutcomeInactive
+	case errors.Is(err, ErrClientCertMismatch):
+		return metrics.OutcomeCertMismatch
+	case errors.Is(err, ErrCodeReplayed):
+		return metrics.OutcomeReplay
+	default:
+		return metrics.OutcomeInvalidCode
+	}
+}
+
+// ClearLockout resets the failed-attempt counters for a user and/or client
+// IP. Empty arguments are ignored.
+func (am *AuthManager) ClearLockout(userID, clientIP string) {
+	var keys []string
+	if userID != "" {
+		keys = append(keys, userKey(userID))
+	}
+	if clientIP != "" {
+		keys = append(keys, ipKey(clientIP))
+	}
+	am.throttle.clear(keys...)
+}
+
+// recordFailure counts a failed attempt by client against keys and audits
+// the lockout it may trigger.
+func (am *AuthManager) recordFailure(ctx context.Context, now time.Time, userID string, client ClientInfo, keys ...string) {
+	if am.throttle.fail(now, keys...) {
+		log.Printf("Locked out OTP attempts for %v after repeated failures", keys)
+		am.RecordEvent(ctx, EventLockout, userID, client, metrics.OutcomeLockedOut)
+	}
+	am.maybePrune(now)
+}
+
+// verifyCode checks otpCode against the token and burns it, so it can't be
+// accepted again: a TOTP time step is recorded, an HOTP counter advanced or a
+// recovery code marked used. It returns ErrInvalidCode, ErrCodeReplayed or,
+// if storage failed, an error wrapping ErrStorage.
+func (am *AuthManager) verifyCode(ctx context.Context, token *MasterToken, otpCode string, now time.Time, allowRecovery bool) error {
+	if code, ok := parseRecoveryCode(otpCode); ok {
+		if !allowRecovery {
+			return ErrInvalidCode
+		}
+		used, err := am.useRecoveryCode(ctx, token.ID, code, now)
+		return burnResult(used, err, ErrInvalidCode)
+	}
+
+	// Code computation gets its own span so its cost can be told apart from
+	// the storage round trips around it
+	_, span := am.tracer.Start(ctx, "AuthManager.matchCode", trace.WithAttributes(attribute.String("otp.type", token.Type)))
+	switch token.Type {
+	case TypeHOTP:
+		counter, ok := matchHOTPCounter(token, otpCode, am.hotpLookAhead)
+		span.End()
+		if !ok {
+			return ErrInvalidCode
+		}
+
+		// Moving the counter past the matched value burns this code and
+		// every earlier one
+		advanced, err := am.store.AdvanceHOTPCounter(ctx, token.ID, token.Counter, counter+1)
+		return burnResult(advanced, err, ErrCodeReplayed)
+	default:
+		step, ok := matchTOTPStep(token, otpCode, now)
+		span.End()
+		if !ok {
+			return ErrInvalidCode
+		}
+
+		// Each time step may only be accepted once per token
+		marked, err := am.store.MarkOTPUsed(ctx, token.ID, step, now)
+		return burnResult(marked, err, ErrCodeReplayed)
+	}
+}
+
+// burnResult maps the result of burning a matched code to an error.
+func burnResult(burned bool, err error, failure error) error {
+	if err != nil {
+		return storageError(err)
+	}
+	if !burned {
+		return failure
+	}
+	return nil
+}
+
+// matchTOTPStep returns the time step whose code matches otpCode within the
+// token's skew around t.
+func matchTOTPStep(token *MasterToken, otpCode string, t time.Time) (int64, bool) {
+	opts, err := validateOpts(token)
+	if err != nil {
+		return 0, false
+	}
+
+	period := int64(opts.Period)
+	counter := t.Unix() / period
+	for i := -int64(opts.Skew); i <= int64(opts.Skew); i++ {
+		step := counter + i
+		expected, err := totp.GenerateCodeCustom(token.Secret, time.Unix(step*period, 0), opts)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(otpCode)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// matchHOTPCounter returns the counter value whose code matches otpCode,
+// searching from the token's stored counter up to lookAhead values beyond it.
+func matchHOTPCounter(token *MasterToken, otpCode string, lookAhead int) (int64, bool) {
+	opts, err := hotpOpts(token)
+	if err != nil {
+		return 0, false
+	}
+
+	for counter := token.Counter; counter <= token.Counter+int64(lookAhead); counter++ {
+		expected, err := hotp.GenerateCodeCustom(token.Secret, uint64(counter), opts)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(otpCode)) == 1 {
+			return counter, true
+		}
+	}
+
+	return 0, false
+}
+
+// maybePrune removes expired used OTP records, unconfirmed tokens past their
+// TTL, expired sessions and stale throttle counters, at most once per pruneInterval.
+func (am *AuthManager) maybePrune(now time.Time) {
+	am.mu.Lock()
+	if now.Sub(am.lastPrune) < pruneInterval {
+		am.mu.Unlock()
+		return
+	}
+	am.lastPrune = now
+	am.mu.Unlock()
+
+	am.throttle.prune(now)
+
+	// Pruning runs in the background, detached from the request that
+	// happened to trigger it
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), pruneTimeout)
+		defer cancel()
+
+		if _, err := am.store.PruneUsedOTPs(ctx, now.Add(-usedOTPRetention)); err != nil {
+			log.Printf("Failed to prune used OTPs: %v", err)
+		}
+		deleted, err := am.store.DeletePendingMasterTokens(ctx, now.Add(-am.pendingTTL))
+		if err != nil {
+			log.Printf("Failed to delete expired pending tokens: %v", err)
+		}
+		if deleted > 0 {
+			log.Printf("Deleted %d unconfirmed master tokens", deleted)
+		}
+		if _, err := am.store.DeleteExpiredSessions(ctx, now); err != nil {
+			log.Printf("Failed to delete expired sessions: %v", err)
+		}
+	}()
 }
 
-func (am *AuthManager) GetMasterToken(userID string) (*MasterToken, bool) {
-	token, err := am.db.GetMasterToken(userID)
+func (am *AuthManager) GetMasterToken(ctx context.Context, userID string) (*MasterToken, bool) {
+	token, err := am.store.GetMasterToken(ctx, userID)
 	if err != nil || token == nil {
 		return nil, false
 	}
@@ -77,26 +504,35 @@ func (am *AuthManager) generateSecret() (string, error) {
 	return base32.StdEncoding.EncodeToString(bytes), nil
 }
 
-func (am *AuthManager) GenerateOTPCode(userID string) (string, error) {
+func (am *AuthManager) GenerateOTPCode(ctx context.Context, userID string) (string, error) {
 	// Get master token from database
-	token, err := am.db.GetMasterToken(userID)
-	if err != nil || token == nil || !token.IsActive {
+	token, err := am.store.GetMasterToken(ctx, userID)
+	if err != nil || token == nil || (!token.IsActive && !am.isConfirmable(token)) {
 		return "", fmt.Errorf("user not found or inactive")
 	}
 
-	return totp.GenerateCode(token.Secret, time.Now())
+	if token.Type == TypeHOTP {
+		opts, err := hotpOpts(token)
+		if err != nil {
+			return "", err
+		}
+		return hotp.GenerateCodeCustom(token.Secret, uint64(token.Counter), opts)
+	}
+
+	opts, err := validateOpts(token)
+	if err != nil {
+		return "", err
+	}
+
+	return totp.GenerateCodeCustom(token.Secret, time.Now(), opts)
 }
 
-func (am *AuthManager) GetQRCodeURL(userID, issuer, accountName string) (string, error) {
+func (am *AuthManager) GetQRCodeURL(ctx context.Context, userID, issuer, accountName string) (string, error) {
 	// Get master token from database
-	token, err := am.db.GetMasterToken(userID)
-	if err != nil || token == nil || !token.IsActive {
+	token, err := am.store.GetMasterToken(ctx, userID)
+	if err != nil || token == nil || (!token.IsActive && !am.isConfirmable(token)) {
 		return "", fmt.Errorf("user not found or inactive")
 	}
 
-	// Generate QR code URL manually
-	url := fmt.Sprintf("otpauth://totp/%s:%s?secret=%s&issuer=%s&algorithm=SHA1&digits=6&period=30",
-		issuer, accountName, token.Secret, issuer)
-
-	return url, nil
+	return keyURI(token, issuer, accountName), nil
 }
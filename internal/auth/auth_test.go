@@ -1,13 +1,68 @@
 package auth
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"otp-basic/internal/database"
+	"otp-basic/internal/metrics"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pquerna/otp/totp"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
+var ctx = context.Background()
+
+func newTestManager() *AuthManager {
+	return NewAuthManager(database.NewMemoryStore())
+}
+
+// registerActiveToken registers a token and confirms it. The confirmation
+// uses the code of the previous time step so the current one is still
+// available to the test.
+func registerActiveToken(t *testing.T, am *AuthManager) *MasterToken {
+	t.Helper()
+
+	token, err := am.RegisterMasterToken(ctx, "TestApp", "test@example.com", DefaultTokenOptions())
+	if err != nil {
+		t.Fatalf("Failed to register master token: %v", err)
+	}
+
+	opts, err := validateOpts(token)
+	if err != nil {
+		t.Fatalf("Failed to build validate options: %v", err)
+	}
+	previous := time.Now().Add(-time.Duration(token.Period) * time.Second)
+	code, err := totp.GenerateCodeCustom(token.Secret, previous, opts)
+	if err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+
+	if err := am.ConfirmMasterToken(ctx, token.ID, code, ClientInfo{IP: "192.0.2.1"}); err != nil {
+		t.Fatalf("Expected token to be confirmed: %v", err)
+	}
+
+	stored, _ := am.GetMasterToken(ctx, token.ID)
+	return stored
+}
+
 func TestAuthManager_RegisterMasterToken(t *testing.T) {
-	am := NewAuthManager()
+	am := newTestManager()
 
-	token, err := am.RegisterMasterToken()
+	token, err := am.RegisterMasterToken(ctx, "TestApp", "test@example.com", DefaultTokenOptions())
 	if err != nil {
 		t.Fatalf("Failed to register master token: %v", err)
 	}
@@ -20,12 +75,12 @@ func TestAuthManager_RegisterMasterToken(t *testing.T) {
 		t.Error("Expected non-empty secret")
 	}
 
-	if !token.IsActive {
-		t.Error("Expected token to be active")
+	if token.IsActive {
+		t.Error("Expected token to be pending until confirmed")
 	}
 
 	// Check if token is stored
-	storedToken, exists := am.GetMasterToken(token.ID)
+	storedToken, exists := am.GetMasterToken(ctx, token.ID)
 	if !exists {
 		t.Error("Expected token to be stored")
 	}
@@ -33,53 +88,546 @@ func TestAuthManager_RegisterMasterToken(t *testing.T) {
 	if storedToken.ID != token.ID {
 		t.Error("Stored token ID mismatch")
 	}
+
+	// Invalid options are rejected
+	opts := DefaultTokenOptions()
+	opts.Digits = 7
+	if _, err := am.RegisterMasterToken(ctx, "TestApp", "test@example.com", opts); err == nil {
+		t.Error("Expected invalid options to be rejected")
+	}
 }
 
-func TestAuthManager_ValidateOTP(t *testing.T) {
-	am := NewAuthManager()
+func TestAuthManager_ConfirmMasterToken(t *testing.T) {
+	am := newTestManager()
 
-	// Register a token
-	token, err := am.RegisterMasterToken()
+	token, err := am.RegisterMasterToken(ctx, "TestApp", "test@example.com", DefaultTokenOptions())
 	if err != nil {
 		t.Fatalf("Failed to register master token: %v", err)
 	}
 
+	otp, err := am.GenerateOTPCode(ctx, token.ID)
+	if err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+
+	// Pending tokens can't be used for authentication
+	if err := am.ValidateOTP(ctx, token.ID, otp, ClientInfo{IP: "192.0.2.1"}); !errors.Is(err, ErrTokenInactive) {
+		t.Errorf("Expected pending token to be rejected, got %v", err)
+	}
+	am.ClearLockout(token.ID, "")
+
+	if err := am.ConfirmMasterToken(ctx, token.ID, otp, ClientInfo{IP: "192.0.2.2"}); err != nil {
+		t.Fatalf("Expected token to be confirmed: %v", err)
+	}
+
+	stored, _ := am.GetMasterToken(ctx, token.ID)
+	if !stored.IsActive || stored.ConfirmedAt == nil {
+		t.Error("Expected confirmed token to be active")
+	}
+}
+
+func TestAuthManager_ValidateOTP(t *testing.T) {
+	am := newTestManager()
+	token := registerActiveToken(t, am)
+
 	// Generate OTP
-	otp, err := am.GenerateOTPCode(token.ID)
+	otp, err := am.GenerateOTPCode(ctx, token.ID)
 	if err != nil {
 		t.Fatalf("Failed to generate OTP: %v", err)
 	}
 
 	// Validate OTP
-	valid := am.ValidateOTP(token.ID, otp)
-	if !valid {
-		t.Error("Expected OTP to be valid")
+	if err := am.ValidateOTP(ctx, token.ID, otp, ClientInfo{IP: "192.0.2.10"}); err != nil {
+		t.Errorf("Expected OTP to be valid: %v", err)
 	}
 
-	// Test invalid OTP
-	invalid := am.ValidateOTP(token.ID, "000000")
-	if invalid {
-		t.Error("Expected invalid OTP to be rejected")
+	// Test replayed OTP
+	if err := am.ValidateOTP(ctx, token.ID, otp, ClientInfo{IP: "192.0.2.11"}); !errors.Is(err, ErrCodeReplayed) {
+		t.Errorf("Expected replayed OTP to be rejected, got %v", err)
 	}
 
 	// Test non-existent user
-	notFound := am.ValidateOTP("non-existent", otp)
-	if notFound {
-		t.Error("Expected non-existent user to be rejected")
+	if err := am.ValidateOTP(ctx, "non-existent", otp, ClientInfo{IP: "192.0.2.12"}); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("Expected non-existent user to be rejected, got %v", err)
 	}
 }
 
-func TestAuthManager_GenerateOTPCode(t *testing.T) {
-	am := NewAuthManager()
+func TestAuthManager_Lockout(t *testing.T) {
+	am := newTestManager()
+	am.throttle = newThrottle(LockoutConfig{
+		Threshold:   3,
+		Duration:    time.Minute,
+		BackoffBase: time.Nanosecond,
+	})
+	token := registerActiveToken(t, am)
 
-	// Register a token
-	token, err := am.RegisterMasterToken()
+	for i := 0; i < 3; i++ {
+		time.Sleep(time.Millisecond)
+		am.ValidateOTP(ctx, token.ID, "000000", ClientInfo{IP: "192.0.2.20"})
+	}
+
+	otp, err := am.GenerateOTPCode(ctx, token.ID)
+	if err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+
+	// Even the correct code is refused while locked out
+	var locked *LockedError
+	err = am.ValidateOTP(ctx, token.ID, otp, ClientInfo{IP: "192.0.2.21"})
+	if !errors.As(err, &locked) || locked.RetryAfter <= 0 {
+		t.Fatalf("Expected lockout, got %v", err)
+	}
+
+	am.ClearLockout(token.ID, "")
+	if err := am.ValidateOTP(ctx, token.ID, otp, ClientInfo{IP: "192.0.2.21"}); err != nil {
+		t.Errorf("Expected OTP to be valid after clearing the lockout: %v", err)
+	}
+}
+
+func TestAuthManager_LockoutUnknownUser(t *testing.T) {
+	am := newTestManager()
+	am.throttle = newThrottle(LockoutConfig{
+		Threshold:   3,
+		Duration:    time.Minute,
+		BackoffBase: time.Nanosecond,
+	})
+	token := registerActiveToken(t, am)
+
+	// Known and unknown IDs must lock out after the same number of
+	// failures, from any IP, or a 429 would tell which IDs exist
+	for _, userID := range []string{token.ID, "non-existent"} {
+		for i := 0; i < 3; i++ {
+			time.Sleep(time.Millisecond)
+			am.ValidateOTP(ctx, userID, "000000", ClientInfo{IP: fmt.Sprintf("192.0.2.%d", 110+i)})
+		}
+
+		var locked *LockedError
+		err := am.ValidateOTP(ctx, userID, "000000", ClientInfo{IP: "192.0.2.120"})
+		if !errors.As(err, &locked) {
+			t.Errorf("Expected lockout for %s, got %v", userID, err)
+		}
+	}
+
+	// Another unknown ID is not caught by the lockout, unless it happens to
+	// share a counter
+	other := "also-non-existent"
+	if am.throttle.unknownUserKey(other) == am.throttle.unknownUserKey("non-existent") {
+		t.Skip("unknown user IDs share a counter")
+	}
+	if err := am.ValidateOTP(ctx, other, "000000", ClientInfo{IP: "192.0.2.121"}); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("Expected ErrTokenNotFound, got %v", err)
+	}
+}
+
+func TestAuthManager_HOTP(t *testing.T) {
+	am := newTestManager()
+
+	opts := DefaultTokenOptions()
+	opts.Type = TypeHOTP
+	token, err := am.RegisterMasterToken(ctx, "TestApp", "test@example.com", opts)
 	if err != nil {
 		t.Fatalf("Failed to register master token: %v", err)
 	}
 
+	otp, err := am.GenerateOTPCode(ctx, token.ID)
+	if err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+	if err := am.ConfirmMasterToken(ctx, token.ID, otp, ClientInfo{IP: "192.0.2.30"}); err != nil {
+		t.Fatalf("Expected token to be confirmed: %v", err)
+	}
+
+	// The counter has moved on, so the next code differs
+	next, err := am.GenerateOTPCode(ctx, token.ID)
+	if err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+	if err := am.ValidateOTP(ctx, token.ID, next, ClientInfo{IP: "192.0.2.31"}); err != nil {
+		t.Errorf("Expected next HOTP code to be valid: %v", err)
+	}
+	// The counter has moved past a used code, so it no longer matches
+	if err := am.ValidateOTP(ctx, token.ID, next, ClientInfo{IP: "192.0.2.32"}); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("Expected reused HOTP code to be rejected, got %v", err)
+	}
+}
+
+func TestAuthManager_RecoveryCodes(t *testing.T) {
+	am := newTestManager()
+	token := registerActiveToken(t, am)
+
+	codes, err := am.GenerateRecoveryCodes(ctx, token.ID)
+	if err != nil {
+		t.Fatalf("Failed to generate recovery codes: %v", err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("Expected %d recovery codes, got %d", recoveryCodeCount, len(codes))
+	}
+
+	if err := am.ValidateOTP(ctx, token.ID, codes[0], ClientInfo{IP: "192.0.2.40"}); err != nil {
+		t.Errorf("Expected recovery code to be accepted: %v", err)
+	}
+	if err := am.ValidateOTP(ctx, token.ID, codes[0], ClientInfo{IP: "192.0.2.41"}); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("Expected used recovery code to be rejected, got %v", err)
+	}
+
+	remaining, err := am.RecoveryCodesRemaining(ctx, token.ID)
+	if err != nil {
+		t.Fatalf("Failed to count recovery codes: %v", err)
+	}
+	if remaining != recoveryCodeCount-1 {
+		t.Errorf("Expected %d remaining recovery codes, got %d", recoveryCodeCount-1, remaining)
+	}
+}
+
+func TestAuthManager_Sessions(t *testing.T) {
+	am := newTestManager()
+	token := registerActiveToken(t, am)
+
+	rawToken, _, err := am.IssueSession(ctx, token.ID)
+	if err != nil {
+		t.Fatalf("Failed to issue session: %v", err)
+	}
+
+	userID, err := am.ValidateSession(ctx, rawToken, ClientInfo{})
+	if err != nil || userID != token.ID {
+		t.Fatalf("Expected session for %s, got %q (%v)", token.ID, userID, err)
+	}
+
+	refreshed, _, err := am.RefreshSession(ctx, rawToken, ClientInfo{})
+	if err != nil {
+		t.Fatalf("Failed to refresh session: %v", err)
+	}
+	if _, err := am.ValidateSession(ctx, rawToken, ClientInfo{}); err != ErrInvalidSession {
+		t.Error("Expected refreshed-away session to be invalid")
+	}
+
+	if err := am.RevokeSession(ctx, refreshed); err != nil {
+		t.Fatalf("Failed to revoke session: %v", err)
+	}
+	if _, err := am.ValidateSession(ctx, refreshed, ClientInfo{}); err != ErrInvalidSession {
+		t.Error("Expected revoked session to be invalid")
+	}
+}
+
+func TestAuthManager_ClientCertBinding(t *testing.T) {
+	am := newTestManager()
+	token := registerActiveToken(t, am)
+
+	rawToken, _, err := am.IssueSession(ctx, token.ID)
+	if err != nil {
+		t.Fatalf("Failed to issue session: %v", err)
+	}
+
+	if _, err := am.BindClientCert(ctx, token.ID, "CN=alice,O=Example"); err != nil {
+		t.Fatalf("Failed to bind client certificate: %v", err)
+	}
+
+	otp, err := am.GenerateOTPCode(ctx, token.ID)
+	if err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+
+	// A valid OTP alone is not enough
+	if err := am.ValidateOTP(ctx, token.ID, otp, ClientInfo{IP: "192.0.2.50", CertSubject: "CN=mallory"}); !errors.Is(err, ErrClientCertMismatch) {
+		t.Errorf("Expected OTP with the wrong certificate to be rejected, got %v", err)
+	}
+	if _, err := am.ValidateSession(ctx, rawToken, ClientInfo{}); err != ErrInvalidSession {
+		t.Error("Expected session without a certificate to be rejected")
+	}
+
+	am.ClearLockout(token.ID, "")
+	alice := ClientInfo{IP: "192.0.2.51", CertSubject: "CN=alice,O=Example"}
+	if err := am.ValidateOTP(ctx, token.ID, otp, alice); err != nil {
+		t.Errorf("Expected OTP with the bound certificate to be valid: %v", err)
+	}
+	if _, err := am.ValidateSession(ctx, rawToken, alice); err != nil {
+		t.Errorf("Expected session with the bound certificate to be valid: %v", err)
+	}
+
+	if _, err := am.BindClientCert(ctx, "non-existent", "CN=alice"); err != ErrTokenNotFound {
+		t.Errorf("Expected ErrTokenNotFound, got %v", err)
+	}
+}
+
+// unavailableStore fails every token read, like a database that is down.
+type unavailableStore struct {
+	*database.MemoryStore
+}
+
+func (unavailableStore) GetMasterToken(context.Context, string) (*MasterToken, error) {
+	return nil, errors.New("connection refused")
+}
+
+func (unavailableStore) ListMasterTokens(context.Context, MasterTokenFilter) ([]*MasterToken, error) {
+	return nil, errors.New("connection refused")
+}
+
+func (unavailableStore) CountUnusedRecoveryCodes(context.Context, string) (int, error) {
+	return 0, errors.New("connection refused")
+}
+
+func TestAuthManager_StorageError(t *testing.T) {
+	am := NewAuthManager(unavailableStore{database.NewMemoryStore()})
+
+	err := am.ValidateOTP(ctx, "some-user", "123456", ClientInfo{IP: "192.0.2.55"})
+	if !errors.Is(err, ErrStorage) {
+		t.Fatalf("Expected a storage error, got %v", err)
+	}
+
+	// Storage failures are not the client's fault and don't count towards
+	// a lockout
+	for i := 0; i < 10; i++ {
+		am.ValidateOTP(ctx, "some-user", "123456", ClientInfo{IP: "192.0.2.55"})
+	}
+	var locked *LockedError
+	if err := am.ValidateOTP(ctx, "some-user", "123456", ClientInfo{IP: "192.0.2.55"}); errors.As(err, &locked) {
+		t.Error("Expected storage failures not to lock the client out")
+	}
+
+	// Admin lookups don't mistake an outage for an unknown token
+	if _, err := am.LookupMasterToken(ctx, "some-user"); !errors.Is(err, ErrStorage) || errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("Expected LookupMasterToken to return a storage error, got %v", err)
+	}
+	if _, err := am.ListMasterTokens(ctx, MasterTokenFilter{Limit: 10}); !errors.Is(err, ErrStorage) {
+		t.Errorf("Expected ListMasterTokens to return a storage error, got %v", err)
+	}
+	if _, err := am.RecoveryCodesRemaining(ctx, "some-user"); !errors.Is(err, ErrStorage) {
+		t.Errorf("Expected RecoveryCodesRemaining to return a storage error, got %v", err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/protected", am.OTPMiddleware(), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/protected", nil)
+	req.Header.Set("X-User-ID", "some-user")
+	req.Header.Set("X-OTP", "123456")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 while storage is down, got %d", w.Code)
+	}
+}
+
+// tamperedStore alters the audit log as it is read back.
+type tamperedStore struct {
+	*database.MemoryStore
+	tamper func([]*AuthEvent) []*AuthEvent
+}
+
+func (s tamperedStore) ListAuthEvents(ctx context.Context, afterID int64, limit int) ([]*AuthEvent, error) {
+	events, err := s.MemoryStore.ListAuthEvents(ctx, afterID, limit)
+	return s.tamper(events), err
+}
+
+func TestAuthManager_AuditLog(t *testing.T) {
+	store := &tamperedStore{MemoryStore: database.NewMemoryStore()}
+	store.tamper = func(events []*AuthEvent) []*AuthEvent { return events }
+	am := NewAuthManager(store)
+	token := registerActiveToken(t, am)
+
+	otp, err := am.GenerateOTPCode(ctx, token.ID)
+	if err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+	client := ClientInfo{IP: "192.0.2.65", UserAgent: "test-agent"}
+	am.ValidateOTP(ctx, token.ID, otp, client)
+	am.ValidateOTP(ctx, token.ID, otp, client)
+
+	events, err := am.ListAuthEvents(ctx, 0, 10)
+	if err != nil {
+		t.Fatalf("Failed to list audit events: %v", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 audit events, got %d", len(events))
+	}
+	last := events[2]
+	if last.Type != EventValidation || last.Outcome != "replay" || last.SourceIP != client.IP || last.UserAgent != client.UserAgent {
+		t.Errorf("Unexpected audit event %+v", last)
+	}
+
+	result, err := am.VerifyAuditLog(ctx)
+	if err != nil {
+		t.Fatalf("Failed to verify audit log: %v", err)
+	}
+	if !result.Valid || result.Events != 3 || result.HeadHash != last.Hash {
+		t.Errorf("Expected an intact log of 3 events, got %+v", result)
+	}
+
+	// An edited event no longer matches its hash
+	store.tamper = func(events []*AuthEvent) []*AuthEvent {
+		for _, event := range events {
+			if event.ID == 2 {
+				event.Outcome = "invalid_code"
+			}
+		}
+		return events
+	}
+	if result, _ := am.VerifyAuditLog(ctx); result.Valid || result.BrokenAt != 2 {
+		t.Errorf("Expected edited event 2 to be detected, got %+v", result)
+	}
+
+	// A removed event breaks the link from its successor
+	store.tamper = func(events []*AuthEvent) []*AuthEvent {
+		var kept []*AuthEvent
+		for _, event := range events {
+			if event.ID != 2 {
+				kept = append(kept, event)
+			}
+		}
+		return kept
+	}
+	if result, _ := am.VerifyAuditLog(ctx); result.Valid || result.BrokenAt != 3 {
+		t.Errorf("Expected removal of event 2 to be detected at event 3, got %+v", result)
+	}
+
+	// Removing the newest event leaves a consistent chain, but one that
+	// stops short of the recorded head
+	store.tamper = func(events []*AuthEvent) []*AuthEvent {
+		var kept []*AuthEvent
+		for _, event := range events {
+			if event.ID != 3 {
+				kept = append(kept, event)
+			}
+		}
+		return kept
+	}
+	if result, _ := am.VerifyAuditLog(ctx); result.Valid || result.Events != 2 || result.Reason == "" {
+		t.Errorf("Expected removal of event 3 to be detected, got %+v", result)
+	}
+}
+
+// slowAuditStore holds every audit append until release is closed, like a
+// database waiting for the audit log's row lock.
+type slowAuditStore struct {
+	*database.MemoryStore
+	release chan struct{}
+}
+
+func (s slowAuditStore) AppendAuthEvent(ctx context.Context, event *AuthEvent) error {
+	<-s.release
+	return s.MemoryStore.AppendAuthEvent(ctx, event)
+}
+
+func TestAuthManager_AuditQueue(t *testing.T) {
+	t.Setenv("AUDIT_QUEUE_SIZE", "4")
+	store := slowAuditStore{MemoryStore: database.NewMemoryStore(), release: make(chan struct{})}
+	am := NewAuthManager(store)
+	sink := &recordingSink{}
+	am.SetEventSink(sink)
+
+	recorded := make(chan struct{})
+	go func() {
+		for _, tokenID := range []string{"token-1", "token-2"} {
+			am.RecordEvent(ctx, EventDeletion, tokenID, ClientInfo{IP: "192.0.2.80"}, EventOutcomeSuccess)
+		}
+		close(recorded)
+	}()
+	select {
+	case <-recorded:
+	case <-time.After(time.Second):
+		t.Fatal("Expected RecordEvent not to wait for the audit log")
+	}
+
+	// Close appends what is still queued
+	close(store.release)
+	if err := am.Close(time.Second); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	events, err := am.ListAuthEvents(ctx, 0, 10)
+	if err != nil {
+		t.Fatalf("Failed to list audit events: %v", err)
+	}
+	if len(events) != 2 || events[0].TokenID != "token-1" || events[1].TokenID != "token-2" {
+		t.Fatalf("Expected both queued events in order, got %+v", events)
+	}
+	if len(sink.events) != 2 || sink.events[1].Hash != events[1].Hash {
+		t.Errorf("Expected the sink to get the appended events, got %+v", sink.events)
+	}
+
+	// Once closed, events are appended before RecordEvent returns
+	am.RecordEvent(ctx, EventDeletion, "token-3", ClientInfo{IP: "192.0.2.80"}, EventOutcomeSuccess)
+	if result, err := am.VerifyAuditLog(ctx); err != nil || !result.Valid || result.Events != 3 {
+		t.Errorf("Expected an intact log of 3 events, got %+v (%v)", result, err)
+	}
+}
+
+func TestAuthManager_Metrics(t *testing.T) {
+	am := newTestManager()
+	m := metrics.New()
+	am.SetMetrics(m)
+	token := registerActiveToken(t, am)
+
+	otp, err := am.GenerateOTPCode(ctx, token.ID)
+	if err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+	am.ValidateOTP(ctx, token.ID, otp, ClientInfo{IP: "192.0.2.60"})
+	am.ValidateOTP(ctx, token.ID, otp, ClientInfo{IP: "192.0.2.61"})
+	am.ValidateOTP(ctx, "non-existent", otp, ClientInfo{IP: "192.0.2.62"})
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := w.Body.String()
+
+	for _, want := range []string{
+		`otp_registrations_total 1`,
+		`otp_validations_total{operation="confirm",outcome="valid"} 1`,
+		`otp_validations_total{operation="validate",outcome="valid"} 1`,
+		`otp_validations_total{operation="validate",outcome="replay"} 1`,
+		`otp_validations_total{operation="validate",outcome="unknown_user"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected metrics to contain %q", want)
+		}
+	}
+}
+
+func TestAuthManager_Tracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer provider.Shutdown(ctx)
+
+	am := newTestManager()
+	am.SetTracerProvider(provider)
+	token := registerActiveToken(t, am)
+	otp, err := am.GenerateOTPCode(ctx, token.ID)
+	if err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+
+	parentCtx, parent := provider.Tracer("test").Start(ctx, "request")
+	am.ValidateOTP(parentCtx, token.ID, otp, ClientInfo{IP: "192.0.2.70"})
+	parent.End()
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+
+	validate, ok := spans["AuthManager.ValidateOTP"]
+	if !ok {
+		t.Fatal("Expected an AuthManager.ValidateOTP span")
+	}
+	if validate.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Error("Expected the validation span to be a child of the request span")
+	}
+	if !slices.Contains(validate.Attributes(), attribute.String("otp.outcome", "valid")) {
+		t.Errorf("Expected otp.outcome=valid, got %v", validate.Attributes())
+	}
+	if match, ok := spans["AuthManager.matchCode"]; !ok || match.Parent().SpanID() != validate.SpanContext().SpanID() {
+		t.Error("Expected an AuthManager.matchCode span under the validation span")
+	}
+}
+
+func TestAuthManager_GenerateOTPCode(t *testing.T) {
+	am := newTestManager()
+	token := registerActiveToken(t, am)
+
 	// Generate OTP
-	otp, err := am.GenerateOTPCode(token.ID)
+	otp, err := am.GenerateOTPCode(ctx, token.ID)
 	if err != nil {
 		t.Fatalf("Failed to generate OTP: %v", err)
 	}
@@ -89,23 +637,18 @@ func TestAuthManager_GenerateOTPCode(t *testing.T) {
 	}
 
 	// Test non-existent user
-	_, err = am.GenerateOTPCode("non-existent")
+	_, err = am.GenerateOTPCode(ctx, "non-existent")
 	if err == nil {
 		t.Error("Expected error for non-existent user")
 	}
 }
 
 func TestAuthManager_GetQRCodeURL(t *testing.T) {
-	am := NewAuthManager()
-
-	// Register a token
-	token, err := am.RegisterMasterToken()
-	if err != nil {
-		t.Fatalf("Failed to register master token: %v", err)
-	}
+	am := newTestManager()
+	token := registerActiveToken(t, am)
 
 	// Generate QR code URL
-	url, err := am.GetQRCodeURL(token.ID, "TestApp", "test@example.com")
+	url, err := am.GetQRCodeURL(ctx, token.ID, "TestApp", "test@example.com")
 	if err != nil {
 		t.Fatalf("Failed to generate QR code URL: %v", err)
 	}
@@ -115,37 +658,403 @@ func TestAuthManager_GetQRCodeURL(t *testing.T) {
 	}
 
 	// Test non-existent user
-	_, err = am.GetQRCodeURL("non-existent", "TestApp", "test@example.com")
+	_, err = am.GetQRCodeURL(ctx, "non-existent", "TestApp", "test@example.com")
 	if err == nil {
 		t.Error("Expected error for non-existent user")
 	}
 }
 
 func TestOTPTimeWindow(t *testing.T) {
-	am := NewAuthManager()
+	am := newTestManager()
 
-	// Register a token
-	token, err := am.RegisterMasterToken()
+	// Register a token with non-default parameters
+	tokenOpts := DefaultTokenOptions()
+	tokenOpts.Algorithm = "SHA256"
+	tokenOpts.Digits = 8
+	tokenOpts.Period = 60
+	token, err := am.RegisterMasterToken(ctx, "TestApp", "test@example.com", tokenOpts)
 	if err != nil {
 		t.Fatalf("Failed to register master token: %v", err)
 	}
+	opts, err := validateOpts(token)
+	if err != nil {
+		t.Fatalf("Failed to build validate options: %v", err)
+	}
+	codeAt := func(steps int) string {
+		t.Helper()
+		at := time.Now().Add(time.Duration(steps*token.Period) * time.Second)
+		code, err := totp.GenerateCodeCustom(token.Secret, at, opts)
+		if err != nil {
+			t.Fatalf("Failed to generate OTP: %v", err)
+		}
+		return code
+	}
+	if err := am.ConfirmMasterToken(ctx, token.ID, codeAt(-1), ClientInfo{IP: "192.0.2.1"}); err != nil {
+		t.Fatalf("Expected token to be confirmed: %v", err)
+	}
 
 	// Generate OTP
-	otp, err := am.GenerateOTPCode(token.ID)
+	otp, err := am.GenerateOTPCode(ctx, token.ID)
 	if err != nil {
 		t.Fatalf("Failed to generate OTP: %v", err)
 	}
+	if len(otp) != 8 {
+		t.Errorf("Expected OTP length 8, got %d", len(otp))
+	}
 
 	// OTP should be valid immediately
-	valid := am.ValidateOTP(token.ID, otp)
-	if !valid {
-		t.Error("Expected OTP to be valid immediately after generation")
+	if err := am.ValidateOTP(ctx, token.ID, otp, ClientInfo{IP: "192.0.2.60"}); err != nil {
+		t.Errorf("Expected OTP to be valid immediately after generation: %v", err)
+	}
+
+	// The code of the next period is within the skew of one period
+	if err := am.ValidateOTP(ctx, token.ID, codeAt(1), ClientInfo{IP: "192.0.2.60"}); err != nil {
+		t.Errorf("Expected OTP of the next period to be valid: %v", err)
+	}
+
+	// Two periods ahead is outside the window
+	if err := am.ValidateOTP(ctx, token.ID, codeAt(2), ClientInfo{IP: "192.0.2.60"}); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("Expected OTP outside the time window to be rejected, got %v", err)
 	}
 
 	// Test with a different OTP (should be invalid)
-	invalidOTP := "000000"
-	valid = am.ValidateOTP(token.ID, invalidOTP)
-	if valid {
+	if err := am.ValidateOTP(ctx, token.ID, "00000000", ClientInfo{IP: "192.0.2.61"}); err == nil {
 		t.Error("Expected invalid OTP to be rejected")
 	}
 }
+
+func TestOTPMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	am := newTestManager()
+	token := registerActiveToken(t, am)
+
+	router := gin.New()
+	router.GET("/protected", am.OTPMiddleware(), func(c *gin.Context) {
+		userID, _ := GetUserIDFromContext(c)
+		c.String(http.StatusOK, userID)
+	})
+
+	otp, err := am.GenerateOTPCode(ctx, token.ID)
+	if err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+
+	request := func(otpCode string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/protected", nil)
+		req.Header.Set("X-User-ID", token.ID)
+		req.Header.Set("X-OTP", otpCode)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := request(otp); w.Code != http.StatusOK || w.Body.String() != token.ID {
+		t.Errorf("Expected 200 with user ID, got %d %q", w.Code, w.Body.String())
+	}
+
+	if w := request(otp); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for replayed OTP, got %d", w.Code)
+	}
+
+	// The failed attempt above imposes a backoff on the client
+	if w := request(otp); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 429 with Retry-After, got %d", w.Code)
+	}
+}
+
+func TestOTPMiddleware_Concurrent(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	am := newTestManager()
+	router := gin.New()
+	if err := router.SetTrustedProxies([]string{"192.0.2.1"}); err != nil {
+		t.Fatalf("SetTrustedProxies() error = %v", err)
+	}
+	router.GET("/protected", am.OTPMiddleware(), func(c *gin.Context) {
+		userID, _ := GetUserIDFromContext(c)
+		c.String(http.StatusOK, userID+" "+c.ClientIP())
+	})
+
+	// One middleware serves every request, so none may see another's user
+	// or client
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		token := registerActiveToken(t, am)
+		otp, err := am.GenerateOTPCode(ctx, token.ID)
+		if err != nil {
+			t.Fatalf("Failed to generate OTP: %v", err)
+		}
+		clientIP := fmt.Sprintf("198.51.100.%d", i)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "/protected", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			req.Header.Set("X-Forwarded-For", clientIP)
+			req.Header.Set("X-User-ID", token.ID)
+			req.Header.Set("X-OTP", otp)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if want := token.ID + " " + clientIP; w.Code != http.StatusOK || w.Body.String() != want {
+				t.Errorf("Expected 200 with %q, got %d %q", want, w.Code, w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestHTTPMiddleware(t *testing.T) {
+	am := newTestManager()
+	token := registerActiveToken(t, am)
+
+	var rejected error
+	handler := am.HTTPMiddleware(HTTPMiddlewareConfig{
+		ErrorResponder: func(w http.ResponseWriter, _ *http.Request, err error) {
+			rejected = err
+			w.WriteHeader(http.StatusTeapot)
+		},
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := UserIDFromContext(r.Context())
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-OTP-Verified", fmt.Sprint(OTPVerifiedFromContext(r.Context())))
+		w.Write([]byte(userID + " " + string(body)))
+	}))
+
+	otp, err := am.GenerateOTPCode(ctx, token.ID)
+	if err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+
+	// The body stays readable for the handler
+	body := `{"user_id":"` + token.ID + `","otp":"` + otp + `"}`
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	if w.Code != http.StatusOK || w.Body.String() != token.ID+" "+body {
+		t.Errorf("Expected 200 with user ID and body, got %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("X-OTP-Verified") != "true" {
+		t.Error("Expected the request to be marked as authenticated with an OTP")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusTeapot || !errors.Is(rejected, ErrMissingCredentials) {
+		t.Errorf("Expected custom response for missing credentials, got %d (%v)", w.Code, rejected)
+	}
+
+	// An oversized body isn't read looking for credentials
+	oversized := `{"user_id":"` + token.ID + `","otp":"` + otp + `","padding":"` + strings.Repeat("x", maxOTPBodySize) + `"}`
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(oversized)))
+	if !errors.Is(rejected, ErrBodyTooLarge) {
+		t.Errorf("Expected an oversized body to be rejected, got %d (%v)", w.Code, rejected)
+	}
+	w = httptest.NewRecorder()
+	DefaultErrorResponder(w, httptest.NewRequest(http.MethodPost, "/", nil), ErrBodyTooLarge)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for an oversized body, got %d", w.Code)
+	}
+
+	rawToken, _, err := am.IssueSession(ctx, token.ID)
+	if err != nil {
+		t.Fatalf("Failed to issue session: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+rawToken)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != token.ID+" " {
+		t.Errorf("Expected 200 for session token, got %d %q", w.Code, w.Body.String())
+	}
+	// A session is not a fresh proof of the second factor
+	if w.Header().Get("X-OTP-Verified") != "false" {
+		t.Error("Expected a session request not to be marked as authenticated with an OTP")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer invalid")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	var credErr *CredentialError
+	if !errors.As(rejected, &credErr) || !credErr.Session || !errors.Is(rejected, ErrInvalidSession) {
+		t.Errorf("Expected a session CredentialError, got %v", rejected)
+	}
+
+	// The default responder answers like OTPMiddleware
+	w = httptest.NewRecorder()
+	DefaultErrorResponder(w, req, &CredentialError{Err: &LockedError{RetryAfter: 1500 * time.Millisecond}})
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("Expected 429 with Retry-After 2, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+type recordingSink struct {
+	events []*AuthEvent
+}
+
+func (s *recordingSink) Emit(event *AuthEvent) {
+	s.events = append(s.events, event)
+}
+
+func TestAuthManager_EventSink(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	am := newTestManager()
+	sink := &recordingSink{}
+	am.SetEventSink(sink)
+	token := registerActiveToken(t, am)
+
+	router := gin.New()
+	router.GET("/protected", am.OTPMiddleware(), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	otp, err := am.GenerateOTPCode(ctx, token.ID)
+	if err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/protected", nil)
+		req.RemoteAddr = "192.0.2.80:4711"
+		req.Header.Set("X-User-ID", token.ID)
+		req.Header.Set("X-OTP", otp)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	var outcomes []string
+	for _, event := range sink.events {
+		if event.Type == EventValidation {
+			if event.TokenID != token.ID || event.SourceIP != "192.0.2.80" || event.Hash == "" {
+				t.Errorf("Unexpected event %+v", event)
+			}
+			outcomes = append(outcomes, event.Outcome)
+		}
+	}
+	if !slices.Equal(outcomes, []string{metrics.OutcomeValid, metrics.OutcomeReplay}) {
+		t.Errorf("Expected valid and replay validation events, got %v", outcomes)
+	}
+}
+
+func TestForwardAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	am := newTestManager()
+	token := registerActiveToken(t, am)
+
+	router := gin.New()
+	router.Any("/forward-auth", am.ForwardAuth())
+
+	request := func(header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/forward-auth", nil)
+		req.Header = header
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := request(http.Header{}); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without credentials, got %d", w.Code)
+	}
+
+	otp, err := am.GenerateOTPCode(ctx, token.ID)
+	if err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+	w := request(http.Header{"X-User-Id": {token.ID}, "X-Otp": {otp}})
+	if w.Code != http.StatusOK || w.Header().Get(AuthenticatedUserHeader) != token.ID {
+		t.Errorf("Expected 200 with %s for OTP headers, got %d", AuthenticatedUserHeader, w.Code)
+	}
+
+	rawToken, _, err := am.IssueSession(ctx, token.ID)
+	if err != nil {
+		t.Fatalf("Failed to issue session: %v", err)
+	}
+	w = request(http.Header{"Cookie": {"otp_session=" + rawToken}})
+	if w.Code != http.StatusOK || w.Header().Get(AuthenticatedUserHeader) != token.ID {
+		t.Errorf("Expected 200 with %s for session cookie, got %d", AuthenticatedUserHeader, w.Code)
+	}
+
+	// With a login URL, browsers are sent there with the original URL
+	am.forwardAuth.LoginURL, _ = url.Parse("https://login.example.com/otp")
+	am.forwardAuth.AllowedHosts = []string{"example.com"}
+	w = request(http.Header{
+		"Cookie":            {"otp_session=expired"},
+		"X-Forwarded-Proto": {"https"},
+		"X-Forwarded-Host":  {"app.example.com"},
+		"X-Forwarded-Uri":   {"/reports?year=2024"},
+	})
+	want := "https://login.example.com/otp?rd=https%3A%2F%2Fapp.example.com%2Freports%3Fyear%3D2024"
+	if w.Code != http.StatusFound || w.Header().Get("Location") != want {
+		t.Errorf("Expected redirect to %s, got %d %s", want, w.Code, w.Header().Get("Location"))
+	}
+
+	// Original URLs outside the allowed hosts are left out
+	for _, header := range []http.Header{
+		{"X-Forwarded-Host": {"evil.example.net"}},
+		{"X-Forwarded-Host": {"app.example.com.evil.example.net"}},
+		{"X-Forwarded-Host": {"app.example.com"}, "X-Forwarded-Uri": {"@evil.example.net/"}},
+		{"X-Forwarded-Host": {"app.example.com"}, "X-Forwarded-Proto": {"javascript"}},
+	} {
+		w = request(header)
+		if want := "https://login.example.com/otp"; w.Code != http.StatusFound || w.Header().Get("Location") != want {
+			t.Errorf("Expected redirect to %s for %v, got %d %s", want, header, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestLoadForwardAuthConfig(t *testing.T) {
+	t.Setenv("FORWARD_AUTH_LOGIN_URL", "https://login.example.com/otp")
+	if cfg := loadForwardAuthConfig(); !slices.Equal(cfg.AllowedHosts, []string{"example.com"}) {
+		t.Errorf("AllowedHosts = %v, want the domain of the login URL", cfg.AllowedHosts)
+	}
+
+	t.Setenv("FORWARD_AUTH_ALLOWED_HOSTS", "App.example.org, .intranet.example")
+	if cfg := loadForwardAuthConfig(); !slices.Equal(cfg.AllowedHosts, []string{"app.example.org", "intranet.example"}) {
+		t.Errorf("AllowedHosts = %v, want the configured hosts", cfg.AllowedHosts)
+	}
+}
+
+func TestSessionCookie(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	am := newTestManager()
+	am.forwardAuth.CookieDomain = "example.com"
+	token := registerActiveToken(t, am)
+	rawToken, session, err := am.IssueSession(ctx, token.ID)
+	if err != nil {
+		t.Fatalf("Failed to issue session: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	am.SetSessionCookie(c, rawToken, session)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected one cookie, got %d", len(cookies))
+	}
+	cookie := cookies[0]
+	if cookie.Name != "otp_session" || cookie.Value != rawToken || cookie.Domain != "example.com" ||
+		!cookie.Secure || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("Unexpected session cookie %+v", cookie)
+	}
+
+	// The cookie is what ForwardAuth reads
+	router := gin.New()
+	router.Any("/forward-auth", am.ForwardAuth())
+	req := httptest.NewRequest(http.MethodGet, "/forward-auth", nil)
+	req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get(AuthenticatedUserHeader) != token.ID {
+		t.Errorf("Expected 200 for the issued cookie, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	am.ClearSessionCookie(c)
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Errorf("Expected the cookie to be removed, got %+v", cookies)
+	}
+}
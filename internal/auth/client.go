@@ -0,0 +1,25 @@
+package auth
+
+// ClientInfo describes where an authentication attempt comes from.
+type ClientInfo struct {
+	// IP is the client address used for per-IP throttling.
+	IP string
+	// CertSubject is the subject of the client's verified TLS certificate,
+	// or empty if none was presented.
+	CertSubject string
+	// UserAgent is recorded in the audit log.
+	UserAgent string
+	// SharedIP marks IP as standing for many users, such as the address of
+	// a RADIUS NAS. Failed attempts then only count against the user, so
+	// one user can't lock out the others.
+	SharedIP bool
+}
+
+// clientCertAllowed reports whether client may authenticate as token. Tokens
+// bound to a certificate subject only accept clients presenting it.
+func clientCertAllowed(token *MasterToken, client ClientInfo) bool {
+	if token.ClientCertSubject == nil {
+		return true
+	}
+	return client.CertSubject != "" && client.CertSubject == *token.ClientCertSubject
+}
@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/publicsuffix"
+)
+
+// AuthenticatedUserHeader carries the user ID of a request that passed
+// forward authentication back to the reverse proxy.
+const AuthenticatedUserHeader = "X-Authenticated-User"
+
+// ForwardAuthConfig controls the forward-auth endpoint used by reverse
+// proxies such as nginx auth_request and Traefik ForwardAuth.
+type ForwardAuthConfig struct {
+	// CookieName is the cookie holding a session token, as set by
+	// POST /session.
+	CookieName string
+	// CookieDomain is the Domain attribute of that cookie, so it reaches
+	// every host behind the proxy. Empty restricts it to the host that set
+	// it.
+	CookieDomain string
+	// LoginURL is where unauthenticated requests are redirected, with the
+	// original URL in the "rd" query parameter. If nil they get 401.
+	LoginURL *url.URL
+	// AllowedHosts are the hosts, and their subdomains, that "rd" may point
+	// to. Other original URLs are left out of the redirect.
+	AllowedHosts []string
+}
+
+func loadForwardAuthConfig() ForwardAuthConfig {
+	cfg := ForwardAuthConfig{
+		CookieName:   os.Getenv("FORWARD_AUTH_COOKIE"),
+		CookieDomain: strings.TrimPrefix(os.Getenv("FORWARD_AUTH_COOKIE_DOMAIN"), "."),
+	}
+	if cfg.CookieName == "" {
+		cfg.CookieName = "otp_session"
+	}
+
+	if value := os.Getenv("FORWARD_AUTH_LOGIN_URL"); value != "" {
+		loginURL, err := url.Parse(value)
+		if err != nil || !loginURL.IsAbs() {
+			log.Printf("Ignoring invalid FORWARD_AUTH_LOGIN_URL=%q, answering 401 instead", value)
+		} else {
+			cfg.LoginURL = loginURL
+		}
+	}
+
+	for _, host := range strings.Split(os.Getenv("FORWARD_AUTH_ALLOWED_HOSTS"), ",") {
+		if host = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(host), ".")); host != "" {
+			cfg.AllowedHosts = append(cfg.AllowedHosts, host)
+		}
+	}
+	if cfg.AllowedHosts == nil && cfg.LoginURL != nil {
+		// Default to the domain of the login page, such as example.com for
+		// login.example.com
+		host := strings.ToLower(cfg.LoginURL.Hostname())
+		if domain, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+			host = domain
+		}
+		cfg.AllowedHosts = []string{host}
+	}
+	return cfg
+}
+
+// SetSessionCookie stores a session token in the forward-auth cookie, so
+// browsers sent to the login page are let through once they are back. The
+// cookie expires with the session.
+func (am *AuthManager) SetSessionCookie(c *gin.Context, rawToken string, session *Session) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     am.forwardAuth.CookieName,
+		Value:    rawToken,
+		Path:     "/",
+		Domain:   am.forwardAuth.CookieDomain,
+		Expires:  session.ExpiresAt,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ClearSessionCookie removes the forward-auth cookie.
+func (am *AuthManager) ClearSessionCookie(c *gin.Context) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     am.forwardAuth.CookieName,
+		Path:     "/",
+		Domain:   am.forwardAuth.CookieDomain,
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ForwardAuth answers the authentication subrequests of a reverse proxy. It
+// accepts the same credentials as OTPMiddleware, taken from the headers of
+// the original request, and also a session token in a cookie. A request
+// body is never read, since proxies don't forward it.
+//
+// Authenticated requests get 200 with the user ID in X-Authenticated-User.
+// Others get 401, or a redirect to the login URL if one is configured.
+// Lockouts and storage failures get 429 and 503 as elsewhere.
+func (am *AuthManager) ForwardAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := am.forwardAuthUser(c)
+		if err == nil {
+			c.Header(AuthenticatedUserHeader, userID)
+			c.Status(http.StatusOK)
+			return
+		}
+
+		var locked *LockedError
+		if errors.As(err, &locked) || errors.Is(err, ErrStorage) {
+			WriteOTPError(c, err, nil)
+			return
+		}
+
+		if am.forwardAuth.LoginURL != nil {
+			c.Redirect(http.StatusFound, am.loginRedirect(c))
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Authentication required",
+		})
+	}
+}
+
+// forwardAuthUser checks the credentials of the original request: a bearer
+// session token, OTP headers, or a session cookie, in that order.
+func (am *AuthManager) forwardAuthUser(c *gin.Context) (string, error) {
+	ctx := c.Request.Context()
+	client := RequestClientInfo(c)
+
+	if rawToken, ok := BearerToken(c); ok {
+		return am.ValidateSession(ctx, rawToken, client)
+	}
+	if userID, otpCode, ok := otpHeaders(c.Request.Header); ok {
+		if err := am.ValidateOTP(ctx, userID, otpCode, client); err != nil {
+			return "", err
+		}
+		return userID, nil
+	}
+	if rawToken, err := c.Cookie(am.forwardAuth.CookieName); err == nil && rawToken != "" {
+		return am.ValidateSession(ctx, rawToken, client)
+	}
+	return "", ErrMissingCredentials
+}
+
+// loginRedirect returns the login URL with the URL the client originally
+// asked for, as reported by the proxy in X-Forwarded-Proto,
+// X-Forwarded-Host and X-Forwarded-Uri (or nginx's X-Original-URI). The
+// headers come from the client unless the proxy overwrites them, so the
+// original URL is only passed on if it is on an allowed host.
+func (am *AuthManager) loginRedirect(c *gin.Context) string {
+	loginURL := *am.forwardAuth.LoginURL
+
+	host := c.GetHeader("X-Forwarded-Host")
+	if host == "" {
+		return loginURL.String()
+	}
+	proto := c.GetHeader("X-Forwarded-Proto")
+	if proto == "" {
+		proto = "http"
+	}
+	uri := c.GetHeader("X-Forwarded-Uri")
+	if uri == "" {
+		uri = c.GetHeader("X-Original-URI")
+	}
+
+	// Parse the result rather than the parts, so a URI such as
+	// "@evil.example" can't move the host
+	original, err := url.Parse(proto + "://" + host + uri)
+	if err != nil || (original.Scheme != "http" && original.Scheme != "https") ||
+		original.User != nil || !am.redirectAllowed(original.Hostname()) {
+		return loginURL.String()
+	}
+
+	query := loginURL.Query()
+	query.Set("rd", original.String())
+	loginURL.RawQuery = query.Encode()
+	return loginURL.String()
+}
+
+// redirectAllowed reports whether host is one of the allowed hosts or a
+// subdomain of one.
+func (am *AuthManager) redirectAllowed(host string) bool {
+	host = strings.ToLower(host)
+	for _, allowed := range am.forwardAuth.AllowedHosts {
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
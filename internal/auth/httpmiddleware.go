@@ -0,0 +1,226 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// maxOTPBodySize limits how much of a request body is read looking for OTP
+// credentials, since it is read before the client is authenticated.
+const maxOTPBodySize = 1 << 20
+
+var (
+	// ErrMissingCredentials is reported for requests that carry neither a
+	// session token nor OTP credentials.
+	ErrMissingCredentials = errors.New("missing OTP credentials")
+	// ErrBodyTooLarge is reported for requests without credentials in
+	// headers whose body is too large to look for them in.
+	ErrBodyTooLarge = errors.New("request body too large")
+)
+
+// CredentialError is reported for requests whose credentials were rejected.
+// Err is the error from ValidateSession or ValidateOTP.
+type CredentialError struct {
+	// Session is true if the request carried a session token, false if it
+	// carried an OTP.
+	Session bool
+	Err     error
+}
+
+func (e *CredentialError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CredentialError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorResponder answers a request rejected by HTTPMiddleware. err is
+// ErrMissingCredentials, ErrBodyTooLarge or a *CredentialError.
+type ErrorResponder func(w http.ResponseWriter, r *http.Request, err error)
+
+// HTTPMiddlewareConfig customizes HTTPMiddleware. The zero value gives the
+// same responses as OTPMiddleware.
+type HTTPMiddlewareConfig struct {
+	// ErrorResponder answers rejected requests. Defaults to
+	// DefaultErrorResponder.
+	ErrorResponder ErrorResponder
+	// ClientInfo describes the client of a request for throttling and the
+	// audit log. Defaults to HTTPClientInfo.
+	ClientInfo func(r *http.Request) ClientInfo
+}
+
+type userIDKey struct{}
+
+type otpVerifiedKey struct{}
+
+// ContextWithUserID returns a copy of ctx carrying an authenticated user ID.
+func ContextWithUserID(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, userIDKey{}, userID)
+}
+
+// UserIDFromContext returns the user ID stored by HTTPMiddleware,
+// OTPMiddleware or ContextWithUserID.
+func UserIDFromContext(ctx context.Context) (string, bool) {
+	userID, ok := ctx.Value(userIDKey{}).(string)
+	return userID, ok
+}
+
+// OTPVerifiedFromContext reports whether HTTPMiddleware or OTPMiddleware
+// authenticated the request with an OTP or recovery code, as opposed to a
+// session token. Handlers for sensitive actions can demand a fresh code from
+// session holders.
+func OTPVerifiedFromContext(ctx context.Context) bool {
+	verified, _ := ctx.Value(otpVerifiedKey{}).(bool)
+	return verified
+}
+
+// HTTPMiddleware is OTPMiddleware for net/http and routers built on it. It
+// authenticates requests with either a session token in an
+// "Authorization: Bearer" header or an OTP in the X-User-ID and X-OTP headers
+// or the JSON body, and passes the user ID to the next handler in the request
+// context. A JSON body is left in place for the next handler to read; without
+// credentials in headers, bodies over 1 MiB are rejected unread.
+func (am *AuthManager) HTTPMiddleware(cfg HTTPMiddlewareConfig) func(http.Handler) http.Handler {
+	respond := cfg.ErrorResponder
+	if respond == nil {
+		respond = DefaultErrorResponder
+	}
+	clientInfo := cfg.ClientInfo
+	if clientInfo == nil {
+		clientInfo = HTTPClientInfo
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			client := clientInfo(r)
+
+			// A session token takes precedence over OTP credentials
+			if rawToken, ok := bearerToken(r.Header); ok {
+				userID, err := am.ValidateSession(ctx, rawToken, client)
+				if err != nil {
+					respond(w, r, &CredentialError{Session: true, Err: err})
+					return
+				}
+				next.ServeHTTP(w, r.WithContext(ContextWithUserID(ctx, userID)))
+				return
+			}
+
+			// Check for OTP in headers first, then in the body
+			userID, otpCode, ok := otpHeaders(r.Header)
+			if !ok {
+				var err error
+				if userID, otpCode, err = otpBody(w, r); err != nil {
+					respond(w, r, err)
+					return
+				}
+			}
+
+			if err := am.ValidateOTP(ctx, userID, otpCode, client); err != nil {
+				respond(w, r, &CredentialError{Err: err})
+				return
+			}
+			ctx = context.WithValue(ContextWithUserID(ctx, userID), otpVerifiedKey{}, true)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// DefaultErrorResponder answers rejected requests with the JSON errors of
+// OTPMiddleware: 400 for missing credentials, 413 for an oversized body, 401
+// for rejected credentials, 429 with Retry-After during a lockout and 503
+// when storage is unavailable.
+func DefaultErrorResponder(w http.ResponseWriter, _ *http.Request, err error) {
+	if errors.Is(err, ErrBodyTooLarge) {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+		return
+	}
+	var credErr *CredentialError
+	if !errors.As(err, &credErr) {
+		writeJSONError(w, http.StatusBadRequest, "Missing OTP credentials. Provide X-User-ID and X-OTP headers or JSON body with user_id and otp")
+		return
+	}
+	if credErr.Session {
+		status, message := sessionErrorResponse(credErr.Err)
+		writeJSONError(w, status, message)
+		return
+	}
+
+	status, message, retryAfter := otpErrorResponse(credErr.Err)
+	if status == http.StatusUnauthorized {
+		message = "Invalid OTP"
+	}
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", RetryAfterSeconds(retryAfter))
+	}
+	writeJSONError(w, status, message)
+}
+
+// otpErrorResponse maps an error from ValidateOTP or ConfirmMasterToken to a
+// status code, message and, for lockouts, the remaining wait. Rejected codes
+// get 401 without a message, since callers answer them differently.
+func otpErrorResponse(err error) (status int, message string, retryAfter time.Duration) {
+	var locked *LockedError
+	switch {
+	case errors.As(err, &locked):
+		return http.StatusTooManyRequests, "Too many failed attempts, try again later", locked.RetryAfter
+	case errors.Is(err, ErrStorage):
+		return http.StatusServiceUnavailable, "OTP validation is temporarily unavailable", 0
+	default:
+		return http.StatusUnauthorized, "", 0
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	body, _ := json.Marshal(map[string]string{"error": message})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// otpBody reads OTP credentials from a JSON body with user_id and otp. The
+// body is restored afterwards. It fails with ErrBodyTooLarge for bodies over
+// maxOTPBodySize and with ErrMissingCredentials if the body has none.
+func otpBody(w http.ResponseWriter, r *http.Request) (userID, otpCode string, err error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return "", "", ErrMissingCredentials
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxOTPBodySize))
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return "", "", ErrBodyTooLarge
+	}
+	if err != nil {
+		return "", "", ErrMissingCredentials
+	}
+
+	var otpReq OTPRequest
+	if err := json.Unmarshal(body, &otpReq); err != nil || otpReq.UserID == "" || otpReq.OTP == "" {
+		return "", "", ErrMissingCredentials
+	}
+	return otpReq.UserID, otpReq.OTP, nil
+}
+
+// HTTPClientInfo describes the client of a request: the IP it connected
+// from, its user agent and, on mTLS connections, the subject of its verified
+// certificate. Forwarded headers are ignored; behind a reverse proxy, set
+// HTTPMiddlewareConfig.ClientInfo to a function that knows which to trust.
+func HTTPClientInfo(r *http.Request) ClientInfo {
+	client := ClientInfo{IP: r.RemoteAddr, UserAgent: r.UserAgent()}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		client.IP = host
+	}
+	if state := r.TLS; state != nil && len(state.VerifiedChains) > 0 {
+		client.CertSubject = state.VerifiedChains[0][0].Subject.String()
+	}
+	return client
+}
@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"hash/maphash"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LockoutConfig controls how failed OTP attempts are throttled.
+type LockoutConfig struct {
+	// Threshold is the number of consecutive failures after which a key is
+	// locked out for Duration.
+	Threshold int
+	// Duration is the length of a full lockout. Failure counters that have
+	// been idle for this long are forgotten.
+	Duration time.Duration
+	// BackoffBase is the delay imposed after the first failure. It doubles
+	// with every further failure until Threshold is reached.
+	BackoffBase time.Duration
+}
+
+// loadLockoutConfig reads the lockout settings from environment variables.
+func loadLockoutConfig() LockoutConfig {
+	return LockoutConfig{
+		Threshold:   getEnvInt("LOCKOUT_THRESHOLD", 5),
+		Duration:    getEnvDuration("LOCKOUT_DURATION", 15*time.Minute),
+		BackoffBase: getEnvDuration("LOCKOUT_BACKOFF_BASE", time.Second),
+	}
+}
+
+type attemptState struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// unknownUserBuckets is the number of counters shared by user IDs without a
+// master token.
+const unknownUserBuckets = 1 << 16
+
+// throttle keeps failed-attempt counters per key, where a key identifies
+// either a master token or a client IP.
+type throttle struct {
+	cfg LockoutConfig
+	// seed keys the hash that spreads unknown user IDs over their
+	// counters, so IDs sharing a counter can't be found offline.
+	seed maphash.Seed
+
+	mu      sync.Mutex
+	entries map[string]*attemptState
+}
+
+func newThrottle(cfg LockoutConfig) *throttle {
+	return &throttle{
+		cfg:     cfg,
+		seed:    maphash.MakeSeed(),
+		entries: make(map[string]*attemptState),
+	}
+}
+
+func userKey(userID string) string { return "user:" + userID }
+func ipKey(clientIP string) string { return "ip:" + clientIP }
+
+// unknownUserKey returns the counter for a user ID without a master token.
+func (t *throttle) unknownUserKey(userID string) string {
+	return "unknown:" + strconv.FormatUint(maphash.String(t.seed, userID)%unknownUserBuckets, 10)
+}
+
+// retryAfter returns how long the caller must wait before any of the keys may
+// attempt again, or zero if none of them are blocked.
+func (t *throttle) retryAfter(now time.Time, keys ...string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var wait time.Duration
+	for _, key := range keys {
+		state, ok := t.entries[key]
+		if !ok {
+			continue
+		}
+		if remaining := state.lockedUntil.Sub(now); remaining > wait {
+			wait = remaining
+		}
+	}
+	return wait
+}
+
+// fail records a failed attempt for every key and applies exponential
+// backoff, escalating to a full lockout once the threshold is reached.
+// It returns true if any key has just been locked out.
+func (t *throttle) fail(now time.Time, keys ...string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lockedOut := false
+	for _, key := range keys {
+		state, ok := t.entries[key]
+		if !ok || now.Sub(state.lastFailure) > t.cfg.Duration {
+			state = &attemptState{}
+			t.entries[key] = state
+		}
+
+		state.failures++
+		state.lastFailure = now
+
+		if state.failures >= t.cfg.Threshold {
+			state.lockedUntil = now.Add(t.cfg.Duration)
+			lockedOut = true
+			continue
+		}
+
+		delay := t.cfg.BackoffBase << (state.failures - 1)
+		if delay <= 0 || delay > t.cfg.Duration {
+			delay = t.cfg.Duration
+		}
+		state.lockedUntil = now.Add(delay)
+	}
+	return lockedOut
+}
+
+// clear forgets the counters for the given keys.
+func (t *throttle) clear(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, key := range keys {
+		delete(t.entries, key)
+	}
+}
+
+// prune drops counters that are neither locked nor recent enough to matter.
+func (t *throttle) prune(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key, state := range t.entries {
+		if now.After(state.lockedUntil) && now.Sub(state.lastFailure) > t.cfg.Duration {
+			delete(t.entries, key)
+		}
+	}
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed <= 0 {
+		log.Printf("Ignoring invalid %s=%q, using %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		log.Printf("Ignoring invalid %s=%q, using %s", key, value, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
@@ -1,7 +1,15 @@
 package auth
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -11,43 +19,135 @@ type OTPRequest struct {
 	OTP    string `json:"otp" binding:"required"`
 }
 
+// OTPMiddleware is HTTPMiddleware for gin, with the client IP taken from
+// gin's trusted proxy settings. Handlers get the user ID with
+// GetUserIDFromContext, or UserIDFromContext on the request context.
 func (am *AuthManager) OTPMiddleware() gin.HandlerFunc {
+	// The adapter is built once; each request carries its gin context to it
+	middleware := am.HTTPMiddleware(HTTPMiddlewareConfig{
+		ClientInfo: func(r *http.Request) ClientInfo {
+			return RequestClientInfo(r.Context().Value(ginRequestKey{}).(*ginRequest).c)
+		},
+	})
+	handler := middleware(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		req := r.Context().Value(ginRequestKey{}).(*ginRequest)
+		req.authenticated = true
+		req.c.Request = r
+		userID, _ := UserIDFromContext(r.Context())
+		req.c.Set("user_id", userID)
+	}))
+
 	return func(c *gin.Context) {
-		// Check for OTP in header or body
-		var otpReq OTPRequest
-
-		// Try to get from header first
-		userID := c.GetHeader("X-User-ID")
-		otpCode := c.GetHeader("X-OTP")
-
-		if userID == "" || otpCode == "" {
-			// Try to get from body
-			if err := c.ShouldBindJSON(&otpReq); err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{
-					"error": "Missing OTP credentials. Provide X-User-ID and X-OTP headers or JSON body with user_id and otp",
-				})
-				c.Abort()
-				return
-			}
-			userID = otpReq.UserID
-			otpCode = otpReq.OTP
+		req := &ginRequest{c: c}
+		handler.ServeHTTP(c.Writer, c.Request.WithContext(context.WithValue(c.Request.Context(), ginRequestKey{}, req)))
+
+		if !req.authenticated {
+			c.Abort()
+			return
 		}
+		c.Next()
+	}
+}
+
+// ginRequest passes a request through the net/http middleware of
+// OTPMiddleware.
+type ginRequest struct {
+	c             *gin.Context
+	authenticated bool
+}
 
-		// Validate OTP
-		if !am.ValidateOTP(userID, otpCode) {
+type ginRequestKey struct{}
+
+// otpHeaders reads OTP credentials from the X-User-ID and X-OTP headers.
+func otpHeaders(header http.Header) (userID, otpCode string, ok bool) {
+	userID = header.Get("X-User-ID")
+	otpCode = header.Get("X-OTP")
+	return userID, otpCode, userID != "" && otpCode != ""
+}
+
+// sessionErrorResponse maps an error from ValidateSession to a status code
+// and message.
+func sessionErrorResponse(err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrInvalidSession):
+		return http.StatusUnauthorized, "Invalid or expired session"
+	case errors.Is(err, ErrStorage):
+		return http.StatusServiceUnavailable, "Session validation is temporarily unavailable"
+	default:
+		return http.StatusInternalServerError, "Failed to validate session"
+	}
+}
+
+// AdminMiddleware guards the admin API with a static credential passed in the
+// X-Admin-Token header. User OTPs are never accepted here.
+func AdminMiddleware(adminToken string) gin.HandlerFunc {
+	valid := AdminTokenChecker(adminToken)
+
+	return func(c *gin.Context) {
+		if !valid(c.GetHeader("X-Admin-Token")) {
 			c.JSON(http.StatusUnauthorized, gin.H{
-				"error": "Invalid OTP",
+				"error": "Invalid admin credentials",
 			})
 			c.Abort()
 			return
 		}
 
-		// Store user ID in context for use in handlers
-		c.Set("user_id", userID)
 		c.Next()
 	}
 }
 
+// AdminTokenChecker returns a function reporting whether a provided
+// credential equals adminToken.
+func AdminTokenChecker(adminToken string) func(provided string) bool {
+	expected := sha256.Sum256([]byte(adminToken))
+	return func(provided string) bool {
+		// Compare digests so the check doesn't leak the token length
+		digest := sha256.Sum256([]byte(provided))
+		return subtle.ConstantTimeCompare(digest[:], expected[:]) == 1
+	}
+}
+
+// BearerToken extracts the token from an "Authorization: Bearer" header.
+func BearerToken(c *gin.Context) (string, bool) {
+	return bearerToken(c.Request.Header)
+}
+
+func bearerToken(header http.Header) (string, bool) {
+	scheme, token, ok := strings.Cut(header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// WriteOTPError answers a request whose OTP was rejected with err, as
+// returned by ValidateOTP or ConfirmMasterToken. Lockouts get 429 with a
+// Retry-After header and storage failures 503. Every other failure gets 401
+// with the unauthorized body, so clients can't tell unknown users, inactive
+// tokens and wrong codes apart.
+func WriteOTPError(c *gin.Context, err error, unauthorized any) {
+	status, message, retryAfter := otpErrorResponse(err)
+	if status == http.StatusUnauthorized {
+		c.JSON(status, unauthorized)
+		return
+	}
+	if retryAfter > 0 {
+		c.Header("Retry-After", RetryAfterSeconds(retryAfter))
+	}
+	c.JSON(status, gin.H{
+		"error": message,
+	})
+}
+
+// RequestClientInfo describes the client of a request: its IP, user agent
+// and, on mTLS connections, the subject of its verified certificate.
+func RequestClientInfo(c *gin.Context) ClientInfo {
+	client := HTTPClientInfo(c.Request)
+	client.IP = c.ClientIP()
+	return client
+}
+
 // Helper function to extract user ID from context
 func GetUserIDFromContext(c *gin.Context) (string, bool) {
 	userID, exists := c.Get("user_id")
@@ -56,3 +156,9 @@ func GetUserIDFromContext(c *gin.Context) (string, bool) {
 	}
 	return userID.(string), true
 }
+
+// RetryAfterSeconds formats a wait as the whole number of seconds expected by
+// the Retry-After header, rounding up so clients never retry too early.
+func RetryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
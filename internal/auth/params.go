@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/hotp"
+	"github.com/pquerna/otp/totp"
+)
+
+// Token types stored in MasterToken.Type.
+const (
+	TypeTOTP = "totp"
+	TypeHOTP = "hotp"
+)
+
+const (
+	minPeriod = 15
+	maxPeriod = 300
+	maxSkew   = 2
+)
+
+// ErrInvalidTokenOptions is returned when registration asks for OTP
+// parameters that aren't supported.
+var ErrInvalidTokenOptions = errors.New("invalid token options")
+
+// TokenOptions are the OTP parameters stored with each master token. Period
+// and Skew only apply to TOTP tokens.
+type TokenOptions struct {
+	Type      string
+	Algorithm string
+	Digits    int
+	Period    int
+	Skew      int
+}
+
+// DefaultTokenOptions returns the parameters understood by every
+// authenticator app: TOTP with SHA1, 6 digits, a 30 second period and one
+// step of skew.
+func DefaultTokenOptions() TokenOptions {
+	return TokenOptions{
+		Type:      TypeTOTP,
+		Algorithm: "SHA1",
+		Digits:    6,
+		Period:    30,
+		Skew:      1,
+	}
+}
+
+// Validate reports whether the options can be used for a new token.
+func (o TokenOptions) Validate() error {
+	if o.Type != TypeTOTP && o.Type != TypeHOTP {
+		return fmt.Errorf("%w: type must be %q or %q", ErrInvalidTokenOptions, TypeTOTP, TypeHOTP)
+	}
+	if _, err := parseAlgorithm(o.Algorithm); err != nil {
+		return err
+	}
+	if o.Digits != 6 && o.Digits != 8 {
+		return fmt.Errorf("%w: digits must be 6 or 8", ErrInvalidTokenOptions)
+	}
+	if o.Period < minPeriod || o.Period > maxPeriod {
+		return fmt.Errorf("%w: period must be between %d and %d seconds", ErrInvalidTokenOptions, minPeriod, maxPeriod)
+	}
+	if o.Skew < 0 || o.Skew > maxSkew {
+		return fmt.Errorf("%w: skew must be between 0 and %d", ErrInvalidTokenOptions, maxSkew)
+	}
+	return nil
+}
+
+func parseAlgorithm(name string) (otp.Algorithm, error) {
+	switch name {
+	case "SHA1":
+		return otp.AlgorithmSHA1, nil
+	case "SHA256":
+		return otp.AlgorithmSHA256, nil
+	case "SHA512":
+		return otp.AlgorithmSHA512, nil
+	}
+	return 0, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidTokenOptions, name)
+}
+
+// validateOpts converts the stored token parameters for the pquerna library.
+func validateOpts(token *MasterToken) (totp.ValidateOpts, error) {
+	algorithm, err := parseAlgorithm(token.Algorithm)
+	if err != nil {
+		return totp.ValidateOpts{}, err
+	}
+	return totp.ValidateOpts{
+		Period:    uint(token.Period),
+		Skew:      uint(token.Skew),
+		Digits:    otp.Digits(token.Digits),
+		Algorithm: algorithm,
+	}, nil
+}
+
+// hotpOpts converts the stored token parameters for the pquerna library.
+func hotpOpts(token *MasterToken) (hotp.ValidateOpts, error) {
+	algorithm, err := parseAlgorithm(token.Algorithm)
+	if err != nil {
+		return hotp.ValidateOpts{}, err
+	}
+	return hotp.ValidateOpts{
+		Digits:    otp.Digits(token.Digits),
+		Algorithm: algorithm,
+	}, nil
+}
+
+// keyURI builds the otpauth:// URI understood by authenticator apps.
+func keyURI(token *MasterToken, issuer, accountName string) string {
+	params := url.Values{}
+	params.Set("secret", token.Secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", token.Algorithm)
+	params.Set("digits", strconv.Itoa(token.Digits))
+	if token.Type == TypeHOTP {
+		params.Set("counter", strconv.FormatInt(token.Counter, 10))
+	} else {
+		params.Set("period", strconv.Itoa(token.Period))
+	}
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     token.Type,
+		Path:     "/" + issuer + ":" + accountName,
+		RawQuery: params.Encode(),
+	}
+	return u.String()
+}
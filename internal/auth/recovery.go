@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10
+
+	// recoveryAlphabet leaves out characters that are easily confused when
+	// read off paper (0/O, 1/I/L, U/V).
+	recoveryAlphabet = "ABCDEFGHJKMNPQRSTWXYZ23456789"
+)
+
+// GenerateRecoveryCodes replaces all recovery codes of a token with a fresh
+// set and returns them. The plaintext codes are only available here; the
+// database keeps bcrypt hashes.
+func (am *AuthManager) GenerateRecoveryCodes(ctx context.Context, userID string) ([]string, error) {
+	token, err := am.store.GetMasterToken(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		return nil, fmt.Errorf("user not found")
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := randomRecoveryCode()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %w", err)
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash recovery code: %w", err)
+		}
+		codes[i] = formatRecoveryCode(code)
+		hashes[i] = string(hash)
+	}
+
+	if err := am.store.ReplaceRecoveryCodes(ctx, token.ID, hashes, time.Now()); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// RecoveryCodesRemaining returns how many unused recovery codes a token has.
+func (am *AuthManager) RecoveryCodesRemaining(ctx context.Context, userID string) (int, error) {
+	remaining, err := am.store.CountUnusedRecoveryCodes(ctx, userID)
+	if err != nil {
+		return 0, storageError(err)
+	}
+	return remaining, nil
+}
+
+// useRecoveryCode burns the recovery code of tokenID matching code, if any.
+func (am *AuthManager) useRecoveryCode(ctx context.Context, tokenID, code string, now time.Time) (bool, error) {
+	stored, err := am.store.ListUnusedRecoveryCodes(ctx, tokenID)
+	if err != nil {
+		return false, err
+	}
+
+	for _, candidate := range stored {
+		if bcrypt.CompareHashAndPassword([]byte(candidate.CodeHash), []byte(code)) != nil {
+			continue
+		}
+		return am.store.UseRecoveryCode(ctx, candidate.ID, now)
+	}
+
+	return false, nil
+}
+
+func randomRecoveryCode() (string, error) {
+	max := big.NewInt(int64(len(recoveryAlphabet)))
+
+	var sb strings.Builder
+	for i := 0; i < recoveryCodeLength; i++ {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteByte(recoveryAlphabet[n.Int64()])
+	}
+	return sb.String(), nil
+}
+
+// formatRecoveryCode splits a code in two halves for readability.
+func formatRecoveryCode(code string) string {
+	half := len(code) / 2
+	return code[:half] + "-" + code[half:]
+}
+
+// parseRecoveryCode normalises user input and reports whether it has the
+// shape of a recovery code rather than an OTP.
+func parseRecoveryCode(input string) (string, bool) {
+	code := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(input))
+	if len(code) != recoveryCodeLength {
+		return "", false
+	}
+	for _, r := range code {
+		if !strings.ContainsRune(recoveryAlphabet, r) {
+			return "", false
+		}
+	}
+	return code, true
+}
@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"otp-basic/internal/database"
+)
+
+// ErrInvalidSession is returned for unknown, expired or revoked session
+// tokens, and for sessions whose master token is no longer active.
+var ErrInvalidSession = errors.New("invalid or expired session")
+
+// Session is an alias for database.Session
+type Session = database.Session
+
+// SessionConfig controls the lifetime of session tokens.
+type SessionConfig struct {
+	// TTL is how long a session token is valid after it is issued or
+	// refreshed.
+	TTL time.Duration
+	// MaxLifetime caps how long a chain of refreshed sessions may live
+	// before a fresh OTP is required.
+	MaxLifetime time.Duration
+}
+
+func loadSessionConfig() SessionConfig {
+	return SessionConfig{
+		TTL:         getEnvDuration("SESSION_TTL", 15*time.Minute),
+		MaxLifetime: getEnvDuration("SESSION_MAX_LIFETIME", 12*time.Hour),
+	}
+}
+
+// IssueSession creates a session for a user who has just passed ValidateOTP
+// and returns the opaque bearer token. The token itself is never stored.
+func (am *AuthManager) IssueSession(ctx context.Context, userID string) (string, *Session, error) {
+	now := time.Now()
+	return am.issueSession(ctx, userID, now, now)
+}
+
+// RefreshSession exchanges a valid session token for a new one and revokes
+// the old token. The new session expires after the configured TTL but never
+// beyond the maximum lifetime of the original authentication.
+func (am *AuthManager) RefreshSession(ctx context.Context, rawToken string, client ClientInfo) (string, *Session, error) {
+	session, err := am.lookupSession(ctx, rawToken, &client)
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	revoked, err := am.store.RevokeSession(ctx, session.TokenHash, now)
+	if err != nil {
+		return "", nil, storageError(err)
+	}
+	if !revoked {
+		// Lost a race with another refresh or a logout
+		return "", nil, ErrInvalidSession
+	}
+
+	return am.issueSession(ctx, session.TokenID, session.AuthenticatedAt, now)
+}
+
+// RevokeSession invalidates a session token.
+func (am *AuthManager) RevokeSession(ctx context.Context, rawToken string) error {
+	session, err := am.lookupSession(ctx, rawToken, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := am.store.RevokeSession(ctx, session.TokenHash, time.Now()); err != nil {
+		return storageError(err)
+	}
+	return nil
+}
+
+// ValidateSession returns the user a session token presented by client
+// belongs to.
+func (am *AuthManager) ValidateSession(ctx context.Context, rawToken string, client ClientInfo) (string, error) {
+	session, err := am.lookupSession(ctx, rawToken, &client)
+	if err != nil {
+		return "", err
+	}
+	return session.TokenID, nil
+}
+
+func (am *AuthManager) issueSession(ctx context.Context, userID string, authenticatedAt, now time.Time) (string, *Session, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, fmt.Errorf("failed to generate session token: %w", err)
+	}
+	rawToken := base64.RawURLEncoding.EncodeToString(raw)
+
+	expiresAt := now.Add(am.sessions.TTL)
+	if limit := authenticatedAt.Add(am.sessions.MaxLifetime); expiresAt.After(limit) {
+		expiresAt = limit
+	}
+	if !expiresAt.After(now) {
+		return "", nil, ErrInvalidSession
+	}
+
+	session := &Session{
+		TokenHash:       hashSessionToken(rawToken),
+		TokenID:         userID,
+		AuthenticatedAt: authenticatedAt,
+		CreatedAt:       now,
+		ExpiresAt:       expiresAt,
+	}
+	if err := am.store.CreateSession(ctx, session); err != nil {
+		return "", nil, storageError(err)
+	}
+
+	return rawToken, session, nil
+}
+
+// lookupSession returns the live session for rawToken, checking expiry,
+// revocation and that the master token is still active. If client is not
+// nil, it must also satisfy the token's client certificate binding.
+func (am *AuthManager) lookupSession(ctx context.Context, rawToken string, client *ClientInfo) (*Session, error) {
+	if rawToken == "" {
+		return nil, ErrInvalidSession
+	}
+
+	session, err := am.store.GetSession(ctx, hashSessionToken(rawToken))
+	if err != nil {
+		return nil, storageError(err)
+	}
+	if session == nil || session.RevokedAt != nil || !time.Now().Before(session.ExpiresAt) {
+		return nil, ErrInvalidSession
+	}
+
+	token, err := am.store.GetMasterToken(ctx, session.TokenID)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	if token == nil || !token.IsActive {
+		return nil, ErrInvalidSession
+	}
+	if client != nil && !clientCertAllowed(token, *client) {
+		return nil, ErrInvalidSession
+	}
+
+	return session, nil
+}
+
+func hashSessionToken(rawToken string) string {
+	sum := sha256.Sum256([]byte(rawToken))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	"otp-basic/internal/database"
+)
+
+// MasterTokenStore persists master tokens.
+type MasterTokenStore interface {
+	CreateMasterToken(ctx context.Context, token *MasterToken) error
+	// GetMasterToken returns nil and no error for unknown IDs.
+	GetMasterToken(ctx context.Context, id string) (*MasterToken, error)
+	UpdateMasterToken(ctx context.Context, token *MasterToken) error
+	DeleteMasterToken(ctx context.Context, id string) error
+	ListMasterTokens(ctx context.Context, filter MasterTokenFilter) ([]*MasterToken, error)
+	ConfirmMasterToken(ctx context.Context, id string, confirmedAt time.Time) (bool, error)
+	DeletePendingMasterTokens(ctx context.Context, createdBefore time.Time) (int64, error)
+	RotateMasterTokenSecret(ctx context.Context, id, secret string) error
+	AdvanceHOTPCounter(ctx context.Context, id string, expected, next int64) (bool, error)
+	SetClientCertSubject(ctx context.Context, id string, subject *string) (bool, error)
+	SetMasterTokenActive(ctx context.Context, id string, active bool) (bool, error)
+}
+
+// UsedOTPStore remembers accepted TOTP time steps for replay protection.
+type UsedOTPStore interface {
+	MarkOTPUsed(ctx context.Context, tokenID string, timeStep int64, usedAt time.Time) (bool, error)
+	PruneUsedOTPs(ctx context.Context, before time.Time) (int64, error)
+}
+
+// RecoveryCodeStore persists hashed recovery codes.
+type RecoveryCodeStore interface {
+	ReplaceRecoveryCodes(ctx context.Context, tokenID string, hashes []string, createdAt time.Time) error
+	ListUnusedRecoveryCodes(ctx context.Context, tokenID string) ([]*database.RecoveryCode, error)
+	UseRecoveryCode(ctx context.Context, id int64, usedAt time.Time) (bool, error)
+	CountUnusedRecoveryCodes(ctx context.Context, tokenID string) (int, error)
+}
+
+// SessionStore persists session tokens.
+type SessionStore interface {
+	CreateSession(ctx context.Context, session *Session) error
+	// GetSession returns nil and no error for unknown hashes.
+	GetSession(ctx context.Context, tokenHash string) (*Session, error)
+	RevokeSession(ctx context.Context, tokenHash string, revokedAt time.Time) (bool, error)
+	RevokeSessionsForToken(ctx context.Context, tokenID string, revokedAt time.Time) error
+	DeleteExpiredSessions(ctx context.Context, before time.Time) (int64, error)
+}
+
+// AuditStore persists the hash-chained audit log.
+type AuditStore interface {
+	AppendAuthEvent(ctx context.Context, event *database.AuthEvent) error
+	ListAuthEvents(ctx context.Context, afterID int64, limit int) ([]*database.AuthEvent, error)
+	// AuthEventHead returns the hash of the last event appended.
+	AuthEventHead(ctx context.Context) (string, error)
+}
+
+// TokenStore is everything AuthManager needs from storage. It is implemented
+// by *database.DB for Postgres and by *database.MemoryStore for running
+// without a database.
+type TokenStore interface {
+	MasterTokenStore
+	UsedOTPStore
+	RecoveryCodeStore
+	SessionStore
+	AuditStore
+}
+
+var (
+	_ TokenStore = (*database.DB)(nil)
+	_ TokenStore = (*database.MemoryStore)(nil)
+)
@@ -0,0 +1,149 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// GenesisHash is the previous hash of the first audit event.
+var GenesisHash = strings.Repeat("0", sha256.Size*2)
+
+// AuthEvent is an entry of the append-only audit log. Every event carries the
+// hash of the one before it, so altering or removing an event breaks the
+// chain from that point on.
+type AuthEvent struct {
+	ID         int64
+	OccurredAt time.Time
+	Type       string
+	// TokenID is the master token the event concerns. For failed validations
+	// it is the ID the client claimed, which may not exist.
+	TokenID   string
+	SourceIP  string
+	UserAgent string
+	Outcome   string
+	PrevHash  string
+	Hash      string
+}
+
+// HashAuthEvent returns the hash an event should carry: SHA-256 over its
+// previous hash and its fields, each prefixed with its length so no two
+// different events encode alike. The ID is not covered; the chain itself
+// fixes the order.
+func HashAuthEvent(event *AuthEvent) string {
+	h := sha256.New()
+	for _, field := range []string{
+		event.PrevHash,
+		event.OccurredAt.UTC().Format(time.RFC3339Nano),
+		event.Type,
+		event.TokenID,
+		event.SourceIP,
+		event.UserAgent,
+		event.Outcome,
+	} {
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(field)))
+		h.Write(length[:])
+		h.Write([]byte(field))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sealAuthEvent links event to the previous hash and computes its own.
+// Timestamps are cut to microseconds, the precision PostgreSQL stores, so the
+// hash still matches once the event is read back.
+func sealAuthEvent(event *AuthEvent, prevHash string) {
+	event.OccurredAt = event.OccurredAt.UTC().Truncate(time.Microsecond)
+	event.PrevHash = prevHash
+	event.Hash = HashAuthEvent(event)
+}
+
+// Audit log operations
+
+// AppendAuthEvent adds an event to the end of the audit log and fills in its
+// ID and hashes. Appends are serialised on the auth_event_head row, which
+// holds the hash of the last event, so every event chains to the one written
+// just before it while readers and the rest of the database are unaffected.
+func (db *DB) AppendAuthEvent(ctx context.Context, event *AuthEvent) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to append auth event: %w", err)
+	}
+	defer tx.Rollback()
+
+	// SQLite runs on a single connection, so transactions are serial anyway
+	headQuery := `SELECT hash FROM auth_event_head WHERE id = 1`
+	if db.driver == DriverPostgres {
+		headQuery += ` FOR UPDATE`
+	}
+
+	var prevHash string
+	if err := db.txQueryRow(ctx, tx, headQuery).Scan(&prevHash); err != nil {
+		return fmt.Errorf("failed to read last auth event: %w", err)
+	}
+	sealAuthEvent(event, prevHash)
+
+	query := `
+		INSERT INTO auth_events (occurred_at, event_type, token_id, source_ip, user_agent, outcome, prev_hash, hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id`
+
+	err = db.txQueryRow(ctx, tx, query, event.OccurredAt, event.Type, event.TokenID, event.SourceIP,
+		event.UserAgent, event.Outcome, event.PrevHash, event.Hash).Scan(&event.ID)
+	if err != nil {
+		return fmt.Errorf("failed to append auth event: %w", err)
+	}
+
+	if _, err := db.txExec(ctx, tx, `UPDATE auth_event_head SET hash = $1 WHERE id = 1`, event.Hash); err != nil {
+		return fmt.Errorf("failed to update last auth event: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to append auth event: %w", err)
+	}
+
+	return nil
+}
+
+// AuthEventHead returns the hash of the last event appended to the audit log,
+// or GenesisHash if it is empty.
+func (db *DB) AuthEventHead(ctx context.Context) (string, error) {
+	var head string
+	if err := db.queryRow(ctx, `SELECT hash FROM auth_event_head WHERE id = 1`).Scan(&head); err != nil {
+		return "", fmt.Errorf("failed to read last auth event: %w", err)
+	}
+	return head, nil
+}
+
+// ListAuthEvents returns up to limit events with IDs above afterID, oldest
+// first.
+func (db *DB) ListAuthEvents(ctx context.Context, afterID int64, limit int) ([]*AuthEvent, error) {
+	query := `
+		SELECT id, occurred_at, event_type, token_id, source_ip, user_agent, outcome, prev_hash, hash
+		FROM auth_events
+		WHERE id > $1
+		ORDER BY id
+		LIMIT $2`
+
+	rows, err := db.query(ctx, query, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list auth events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []*AuthEvent
+	for rows.Next() {
+		event := &AuthEvent{}
+		if err := rows.Scan(&event.ID, &event.OccurredAt, &event.Type, &event.TokenID, &event.SourceIP,
+			&event.UserAgent, &event.Outcome, &event.PrevHash, &event.Hash); err != nil {
+			return nil, fmt.Errorf("failed to scan auth event: %w", err)
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
@@ -0,0 +1,202 @@
+package database
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// appendTestEvents appends n validation events and returns them as stored.
+func appendTestEvents(t *testing.T, db *DB, n int) []*AuthEvent {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		event := &AuthEvent{
+			OccurredAt: time.Now(),
+			Type:       "validation",
+			TokenID:    fmt.Sprintf("token-%d", i),
+			SourceIP:   "192.0.2.1",
+			UserAgent:  "test",
+			Outcome:    "invalid_code",
+		}
+		if err := db.AppendAuthEvent(ctx, event); err != nil {
+			t.Fatalf("AppendAuthEvent() error = %v", err)
+		}
+	}
+	return listAllEvents(t, db)
+}
+
+func listAllEvents(t *testing.T, db *DB) []*AuthEvent {
+	t.Helper()
+	events, err := db.ListAuthEvents(ctx, 0, 1000)
+	if err != nil {
+		t.Fatalf("ListAuthEvents() error = %v", err)
+	}
+	return events
+}
+
+// chainBreak returns the ID of the first event that doesn't chain to its
+// predecessor or whose hash doesn't match its contents, or 0 if the chain is
+// intact.
+func chainBreak(events []*AuthEvent) int64 {
+	prevHash := GenesisHash
+	for _, event := range events {
+		if event.PrevHash != prevHash || HashAuthEvent(event) != event.Hash {
+			return event.ID
+		}
+		prevHash = event.Hash
+	}
+	return 0
+}
+
+func TestAppendAuthEvent_Chain(t *testing.T) {
+	db := newTestDB(t)
+	events := appendTestEvents(t, db, 3)
+
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(events))
+	}
+	if id := chainBreak(events); id != 0 {
+		t.Errorf("Expected an intact chain, broken at event %d", id)
+	}
+
+	head, err := db.AuthEventHead(ctx)
+	if err != nil {
+		t.Fatalf("AuthEventHead() error = %v", err)
+	}
+	if head != events[2].Hash {
+		t.Errorf("auth_event_head = %s, want the hash of the last event %s", head, events[2].Hash)
+	}
+}
+
+func TestAppendAuthEvent_Concurrent(t *testing.T) {
+	db := newTestDB(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			event := &AuthEvent{OccurredAt: time.Now(), Type: "validation", TokenID: fmt.Sprint(i), Outcome: "valid"}
+			if err := db.AppendAuthEvent(ctx, event); err != nil {
+				t.Errorf("AppendAuthEvent() error = %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	events := listAllEvents(t, db)
+	if len(events) != 20 {
+		t.Fatalf("Expected 20 events, got %d", len(events))
+	}
+	if id := chainBreak(events); id != 0 {
+		t.Errorf("Expected an intact chain, broken at event %d", id)
+	}
+}
+
+func TestAuthEvents_Tampering(t *testing.T) {
+	tests := []struct {
+		name string
+		// tamper changes the log behind the application's back
+		tamper    string
+		wantBreak int64
+	}{
+		{
+			name:      "altered outcome",
+			tamper:    `UPDATE auth_events SET outcome = 'valid' WHERE id = 2`,
+			wantBreak: 2,
+		},
+		{
+			name:      "altered source IP",
+			tamper:    `UPDATE auth_events SET source_ip = '198.51.100.7' WHERE id = 3`,
+			wantBreak: 3,
+		},
+		{
+			name:      "removed event",
+			tamper:    `DELETE FROM auth_events WHERE id = 2`,
+			wantBreak: 3,
+		},
+		{
+			name:      "removed first event",
+			tamper:    `DELETE FROM auth_events WHERE id = 1`,
+			wantBreak: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			appendTestEvents(t, db, 4)
+
+			// The triggers refuse changes, so an attacker with write access
+			// to the database has to drop them first
+			for _, trigger := range []string{"auth_events_no_update", "auth_events_no_delete"} {
+				if _, err := db.conn.Exec(`DROP TRIGGER ` + trigger); err != nil {
+					t.Fatalf("Failed to drop trigger %s: %v", trigger, err)
+				}
+			}
+			if _, err := db.conn.Exec(tt.tamper); err != nil {
+				t.Fatalf("Failed to tamper with the log: %v", err)
+			}
+
+			if id := chainBreak(listAllEvents(t, db)); id != tt.wantBreak {
+				t.Errorf("Chain broken at event %d, want %d", id, tt.wantBreak)
+			}
+		})
+	}
+}
+
+func TestAuthEventHead_OutlivesRemovedEvents(t *testing.T) {
+	db := newTestDB(t)
+	events := appendTestEvents(t, db, 3)
+
+	if _, err := db.conn.Exec(`DROP TRIGGER auth_events_no_delete`); err != nil {
+		t.Fatalf("Failed to drop trigger: %v", err)
+	}
+	if _, err := db.conn.Exec(`DELETE FROM auth_events WHERE id = $1`, events[2].ID); err != nil {
+		t.Fatalf("Failed to delete the newest event: %v", err)
+	}
+
+	// The rest of the chain is intact, only the head gives the removal away
+	remaining := listAllEvents(t, db)
+	if id := chainBreak(remaining); id != 0 {
+		t.Fatalf("Expected an intact chain, broken at event %d", id)
+	}
+	head, err := db.AuthEventHead(ctx)
+	if err != nil {
+		t.Fatalf("AuthEventHead() error = %v", err)
+	}
+	if head != events[2].Hash || head == remaining[len(remaining)-1].Hash {
+		t.Errorf("AuthEventHead() = %s, want the hash of the removed event %s", head, events[2].Hash)
+	}
+}
+
+func TestAuthEvents_AppendOnly(t *testing.T) {
+	db := newTestDB(t)
+	appendTestEvents(t, db, 1)
+
+	if _, err := db.conn.Exec(`UPDATE auth_events SET outcome = 'valid'`); err == nil {
+		t.Error("Expected updating an event to fail")
+	}
+	if _, err := db.conn.Exec(`DELETE FROM auth_events`); err == nil {
+		t.Error("Expected deleting an event to fail")
+	}
+}
+
+func TestAuthEventHeadMigration_ContinuesExistingChain(t *testing.T) {
+	db := newTestDB(t)
+	appendTestEvents(t, db, 2)
+
+	// Recreate the head table as on an upgrade from a log without it
+	if err := db.MigrateDown(1); err != nil {
+		t.Fatalf("MigrateDown() error = %v", err)
+	}
+	if err := db.MigrateUp(); err != nil {
+		t.Fatalf("MigrateUp() error = %v", err)
+	}
+
+	events := appendTestEvents(t, db, 1)
+	if id := chainBreak(events); id != 0 {
+		t.Errorf("Expected the chain to continue after the migration, broken at event %d", id)
+	}
+}
@@ -1,103 +1,193 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
 	"os"
 	"time"
 
-	"github.com/golang-migrate/migrate/v4"
-	"github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
 	_ "github.com/lib/pq"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+	_ "modernc.org/sqlite"
 )
 
 type DB struct {
-	conn *sql.DB
+	conn     *sql.DB
+	driver   string
+	keys     *KeyRing
+	observer QueryObserver
+	tracer   trace.Tracer
 }
 
 type MasterToken struct {
-	ID          string    `json:"id"`
-	Secret      string    `json:"secret"`
-	CreatedAt   time.Time `json:"created_at"`
-	IsActive    bool      `json:"is_active"`
-	Issuer      *string   `json:"issuer,omitempty"`
-	AccountName *string   `json:"account_name,omitempty"`
+	ID          string     `json:"id"`
+	Secret      string     `json:"secret"`
+	CreatedAt   time.Time  `json:"created_at"`
+	IsActive    bool       `json:"is_active"`
+	Issuer      *string    `json:"issuer,omitempty"`
+	AccountName *string    `json:"account_name,omitempty"`
+	Algorithm   string     `json:"algorithm"`
+	Digits      int        `json:"digits"`
+	Period      int        `json:"period"`
+	Skew        int        `json:"skew"`
+	Type        string     `json:"type"`
+	Counter     int64      `json:"counter"`
+	ConfirmedAt *time.Time `json:"confirmed_at,omitempty"`
+	// ClientCertSubject, if set, is the TLS client certificate subject that
+	// must accompany every OTP for this token.
+	ClientCertSubject *string `json:"client_cert_subject,omitempty"`
 }
 
-func NewDB() (*DB, error) {
-	// Get database configuration from environment variables
-	host := getEnv("DB_HOST", "localhost")
-	port := getEnv("DB_PORT", "5432")
-	user := getEnv("DB_USER", "postgres")
-	password := getEnv("DB_PASSWORD", "postgres")
-	dbname := getEnv("DB_NAME", "otp_basic")
-	sslmode := getEnv("DB_SSLMODE", "disable")
-
-	// Build connection string
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
-		host, port, user, password, dbname, sslmode)
+// IsPending reports whether the token is still waiting for its owner to
+// confirm enrollment with a first code.
+func (t *MasterToken) IsPending() bool {
+	return t.ConfirmedAt == nil
+}
 
-	// Open database connection
-	conn, err := sql.Open("postgres", connStr)
+// RecoveryCode is a single-use backup code. Only a slow hash of the code is
+// stored.
+type RecoveryCode struct {
+	ID        int64
+	TokenID   string
+	CodeHash  string
+	CreatedAt time.Time
+	UsedAt    *time.Time
+}
+
+// Session is a short-lived credential issued after a successful OTP. Only a
+// SHA-256 hash of the bearer token is stored.
+type Session struct {
+	TokenHash string
+	TokenID   string
+	// AuthenticatedAt is when the OTP that started the session chain was
+	// checked; it is carried over when a session is refreshed.
+	AuthenticatedAt time.Time
+	CreatedAt       time.Time
+	ExpiresAt       time.Time
+	RevokedAt       *time.Time
+}
+
+// masterTokenColumns lists the master_tokens columns in the order scanned by
+// scanMasterToken.
+const masterTokenColumns = `id, secret, created_at, is_active, issuer, account_name, algorithm, digits, period, skew, type, counter, confirmed_at, client_cert_subject, data_key, key_id`
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanMasterToken scans a master_tokens row and decrypts its secret.
+func (db *DB) scanMasterToken(row rowScanner) (*MasterToken, error) {
+	token := &MasterToken{}
+	var stored encryptedSecret
+	err := row.Scan(&token.ID, &stored.Secret, &token.CreatedAt, &token.IsActive, &token.Issuer, &token.AccountName,
+		&token.Algorithm, &token.Digits, &token.Period, &token.Skew, &token.Type, &token.Counter, &token.ConfirmedAt, &token.ClientCertSubject, &stored.DataKey, &stored.KeyID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database connection: %w", err)
+		return nil, err
 	}
 
-	// Test connection
-	if err := conn.Ping(); err != nil {
-		return nil, fmt.Errorf("failed to ping database: %w", err)
+	token.Secret, err = db.keys.decrypt(token.ID, stored)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secret of master token %s: %w", token.ID, err)
 	}
+	return token, nil
+}
 
-	// Set connection pool settings
-	conn.SetMaxOpenConns(25)
-	conn.SetMaxIdleConns(5)
-	conn.SetConnMaxLifetime(5 * time.Minute)
+// sealSecret returns the stored form of a token secret: encrypted if master
+// keys are configured, plaintext otherwise.
+func (db *DB) sealSecret(tokenID, secret string) (encryptedSecret, error) {
+	if db.keys == nil {
+		return encryptedSecret{Secret: secret}, nil
+	}
+	return db.keys.encrypt(tokenID, secret)
+}
 
-	db := &DB{conn: conn}
+// NewDB connects to the configured database, loads the master keys and, unless
+// DB_AUTO_MIGRATE is false, applies pending migrations.
+func NewDB() (*DB, error) {
+	db, err := Connect()
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := LoadKeyRing()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if keys == nil {
+		log.Println("Warning: no master keys configured, token secrets are stored in plaintext")
+	}
+	db.keys = keys
+
+	if getEnv("DB_AUTO_MIGRATE", "true") == "false" {
+		log.Println("Skipping database migrations, DB_AUTO_MIGRATE is false")
+		return db, nil
+	}
 
 	// Run migrations
-	if err := db.runMigrations(); err != nil {
+	if err := db.MigrateUp(); err != nil {
+		db.Close()
 		return nil, fmt.Errorf("failed to run migrations: %w", err)
 	}
 
 	return db, nil
 }
 
-func (db *DB) Close() error {
-	return db.conn.Close()
-}
-
-func (db *DB) runMigrations() error {
-	driver, err := postgres.WithInstance(db.conn, &postgres.Config{})
+// Connect opens the configured database without loading master keys or
+// touching the schema. It is enough for managing migrations.
+func Connect() (*DB, error) {
+	driver, dsn, err := loadDriverConfig()
 	if err != nil {
-		return fmt.Errorf("failed to create migration driver: %w", err)
+		return nil, err
 	}
 
-	m, err := migrate.NewWithDatabaseInstance(
-		"file://migrations",
-		"postgres", driver)
+	// Open database connection
+	conn, err := sql.Open(driver, dsn)
 	if err != nil {
-		return fmt.Errorf("failed to create migration instance: %w", err)
+		return nil, fmt.Errorf("failed to open database connection: %w", err)
 	}
 
-	if err := m.Up(); err != nil && err != migrate.ErrNoChange {
-		return fmt.Errorf("failed to run migrations: %w", err)
+	// Test connection
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	log.Println("Database migrations completed successfully")
-	return nil
+	// Set connection pool settings
+	configurePool(driver, conn)
+
+	return &DB{conn: conn, driver: driver, tracer: otel.GetTracerProvider().Tracer(tracerName)}, nil
+}
+
+func (db *DB) Close() error {
+	return db.conn.Close()
+}
+
+// Driver returns the name of the backend in use, DriverPostgres or
+// DriverSQLite.
+func (db *DB) Driver() string {
+	return db.driver
 }
 
 // MasterToken CRUD operations
 
-func (db *DB) CreateMasterToken(token *MasterToken) error {
+func (db *DB) CreateMasterToken(ctx context.Context, token *MasterToken) error {
+	stored, err := db.sealSecret(token.ID, token.Secret)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt master token secret: %w", err)
+	}
+
 	query := `
-		INSERT INTO master_tokens (id, secret, created_at, is_active, issuer, account_name)
-		VALUES ($1, $2, $3, $4, $5, $6)`
+		INSERT INTO master_tokens (` + masterTokenColumns + `)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)`
 
-	_, err := db.conn.Exec(query, token.ID, token.Secret, token.CreatedAt, token.IsActive, token.Issuer, token.AccountName)
+	_, err = db.exec(ctx, query, token.ID, stored.Secret, token.CreatedAt, token.IsActive, token.Issuer, token.AccountName,
+		token.Algorithm, token.Digits, token.Period, token.Skew, token.Type, token.Counter, token.ConfirmedAt,
+		token.ClientCertSubject, stored.DataKey, stored.KeyID)
 	if err != nil {
 		return fmt.Errorf("failed to create master token: %w", err)
 	}
@@ -105,16 +195,15 @@ func (db *DB) CreateMasterToken(token *MasterToken) error {
 	return nil
 }
 
-func (db *DB) GetMasterToken(id string) (*MasterToken, error) {
+func (db *DB) GetMasterToken(ctx context.Context, id string) (*MasterToken, error) {
 	query := `
-		SELECT id, secret, created_at, is_active, issuer, account_name
+		SELECT ` + masterTokenColumns + `
 		FROM master_tokens
 		WHERE id = $1`
 
-	row := db.conn.QueryRow(query, id)
+	row := db.queryRow(ctx, query, id)
 
-	token := &MasterToken{}
-	err := row.Scan(&token.ID, &token.Secret, &token.CreatedAt, &token.IsActive, &token.Issuer, &token.AccountName)
+	token, err := db.scanMasterToken(row)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil // Token not found
@@ -125,13 +214,21 @@ func (db *DB) GetMasterToken(id string) (*MasterToken, error) {
 	return token, nil
 }
 
-func (db *DB) UpdateMasterToken(token *MasterToken) error {
+func (db *DB) UpdateMasterToken(ctx context.Context, token *MasterToken) error {
+	stored, err := db.sealSecret(token.ID, token.Secret)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt master token secret: %w", err)
+	}
+
 	query := `
 		UPDATE master_tokens
-		SET secret = $2, is_active = $3, issuer = $4, account_name = $5
+		SET secret = $2, is_active = $3, issuer = $4, account_name = $5,
+			algorithm = $6, digits = $7, period = $8, skew = $9,
+			data_key = $10, key_id = $11
 		WHERE id = $1`
 
-	_, err := db.conn.Exec(query, token.ID, token.Secret, token.IsActive, token.Issuer, token.AccountName)
+	_, err = db.exec(ctx, query, token.ID, stored.Secret, token.IsActive, token.Issuer, token.AccountName,
+		token.Algorithm, token.Digits, token.Period, token.Skew, stored.DataKey, stored.KeyID)
 	if err != nil {
 		return fmt.Errorf("failed to update master token: %w", err)
 	}
@@ -139,10 +236,137 @@ func (db *DB) UpdateMasterToken(token *MasterToken) error {
 	return nil
 }
 
-func (db *DB) DeleteMasterToken(id string) error {
+// RotateMasterTokenSecret replaces a token's secret, resets its HOTP counter
+// and forgets the TOTP time steps used with the old secret.
+func (db *DB) RotateMasterTokenSecret(ctx context.Context, id, secret string) error {
+	stored, err := db.sealSecret(id, secret)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt master token secret: %w", err)
+	}
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to rotate master token secret: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE master_tokens
+		SET secret = $2, data_key = $3, key_id = $4, counter = 0
+		WHERE id = $1`
+
+	if _, err := db.txExec(ctx, tx, query, id, stored.Secret, stored.DataKey, stored.KeyID); err != nil {
+		return fmt.Errorf("failed to rotate master token secret: %w", err)
+	}
+	if _, err := db.txExec(ctx, tx, `DELETE FROM used_otps WHERE token_id = $1`, id); err != nil {
+		return fmt.Errorf("failed to clear used otps: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to rotate master token secret: %w", err)
+	}
+
+	return nil
+}
+
+// ConfirmMasterToken activates a pending token. It returns false if the token
+// doesn't exist or has already been confirmed.
+func (db *DB) ConfirmMasterToken(ctx context.Context, id string, confirmedAt time.Time) (bool, error) {
+	query := `
+		UPDATE master_tokens
+		SET is_active = TRUE, confirmed_at = $2
+		WHERE id = $1 AND confirmed_at IS NULL`
+
+	result, err := db.exec(ctx, query, id, confirmedAt)
+	if err != nil {
+		return false, fmt.Errorf("failed to confirm master token: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to confirm master token: %w", err)
+	}
+
+	return rows == 1, nil
+}
+
+// DeletePendingMasterTokens deletes tokens created before the given time that
+// were never confirmed and returns the number of rows removed.
+func (db *DB) DeletePendingMasterTokens(ctx context.Context, createdBefore time.Time) (int64, error) {
+	query := `DELETE FROM master_tokens WHERE confirmed_at IS NULL AND created_at < $1`
+
+	result, err := db.exec(ctx, query, createdBefore)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete pending master tokens: %w", err)
+	}
+
+	return result.RowsAffected()
+}
+
+// AdvanceHOTPCounter moves an HOTP token's counter from expected to next. The
+// update only applies if the counter still holds expected, so of two
+// concurrent validations of the same code only one can succeed. It returns
+// false if the counter had already moved.
+func (db *DB) AdvanceHOTPCounter(ctx context.Context, id string, expected, next int64) (bool, error) {
+	query := `
+		UPDATE master_tokens
+		SET counter = $3
+		WHERE id = $1 AND counter = $2`
+
+	result, err := db.exec(ctx, query, id, expected, next)
+	if err != nil {
+		return false, fmt.Errorf("failed to advance hotp counter: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to advance hotp counter: %w", err)
+	}
+
+	return rows == 1, nil
+}
+
+// SetClientCertSubject binds a token to a TLS client certificate subject, or
+// removes the binding if subject is nil. It returns false if the token
+// doesn't exist.
+func (db *DB) SetClientCertSubject(ctx context.Context, id string, subject *string) (bool, error) {
+	query := `UPDATE master_tokens SET client_cert_subject = $2 WHERE id = $1`
+
+	result, err := db.exec(ctx, query, id, subject)
+	if err != nil {
+		return false, fmt.Errorf("failed to set client certificate subject: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to set client certificate subject: %w", err)
+	}
+
+	return rows == 1, nil
+}
+
+// SetMasterTokenActive deactivates or reactivates a token without touching
+// its secret or parameters. It returns false if the token doesn't exist.
+func (db *DB) SetMasterTokenActive(ctx context.Context, id string, active bool) (bool, error) {
+	query := `UPDATE master_tokens SET is_active = $2 WHERE id = $1`
+
+	result, err := db.exec(ctx, query, id, active)
+	if err != nil {
+		return false, fmt.Errorf("failed to set master token active: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to set master token active: %w", err)
+	}
+
+	return rows == 1, nil
+}
+
+func (db *DB) DeleteMasterToken(ctx context.Context, id string) error {
 	query := `DELETE FROM master_tokens WHERE id = $1`
 
-	_, err := db.conn.Exec(query, id)
+	_, err := db.exec(ctx, query, id)
 	if err != nil {
 		return fmt.Errorf("failed to delete master token: %w", err)
 	}
@@ -150,14 +374,24 @@ func (db *DB) DeleteMasterToken(id string) error {
 	return nil
 }
 
-func (db *DB) ListMasterTokens(limit, offset int) ([]*MasterToken, error) {
+// MasterTokenFilter narrows ListMasterTokens. Empty Issuer and AccountName
+// match every token.
+type MasterTokenFilter struct {
+	Issuer      string
+	AccountName string
+	Limit       int
+	Offset      int
+}
+
+func (db *DB) ListMasterTokens(ctx context.Context, filter MasterTokenFilter) ([]*MasterToken, error) {
 	query := `
-		SELECT id, secret, created_at, is_active, issuer, account_name
+		SELECT ` + masterTokenColumns + `
 		FROM master_tokens
+		WHERE ($1 = '' OR issuer = $1) AND ($2 = '' OR account_name = $2)
 		ORDER BY created_at DESC
-		LIMIT $1 OFFSET $2`
+		LIMIT $3 OFFSET $4`
 
-	rows, err := db.conn.Query(query, limit, offset)
+	rows, err := db.query(ctx, query, filter.Issuer, filter.AccountName, filter.Limit, filter.Offset)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list master tokens: %w", err)
 	}
@@ -165,17 +399,310 @@ func (db *DB) ListMasterTokens(limit, offset int) ([]*MasterToken, error) {
 
 	var tokens []*MasterToken
 	for rows.Next() {
-		token := &MasterToken{}
-		err := rows.Scan(&token.ID, &token.Secret, &token.CreatedAt, &token.IsActive, &token.Issuer, &token.AccountName)
+		token, err := db.scanMasterToken(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan master token: %w", err)
 		}
 		tokens = append(tokens, token)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list master tokens: %w", err)
+	}
 
 	return tokens, nil
 }
 
+// RewrapSecrets moves every secret that isn't wrapped under the active master
+// key onto it, batchSize rows at a time. Encrypted rows only have their data
+// key rewrapped; plaintext rows are encrypted. Each row is updated on its own
+// and only if it hasn't changed since it was read, so this can run while the
+// server is serving requests. It returns the number of rows rewrapped.
+func (db *DB) RewrapSecrets(ctx context.Context, batchSize int) (int, error) {
+	if db.keys == nil {
+		return 0, nil
+	}
+
+	query := `
+		SELECT id, secret, data_key, key_id
+		FROM master_tokens
+		WHERE (key_id IS NULL OR key_id <> $1) AND id > $2
+		ORDER BY id
+		LIMIT $3`
+
+	update := `
+		UPDATE master_tokens
+		SET secret = $2, data_key = $3, key_id = $4
+		WHERE id = $1 AND secret = $5`
+
+	rewrapped := 0
+	lastID := ""
+	for {
+		type pending struct {
+			id     string
+			stored encryptedSecret
+		}
+
+		rows, err := db.query(ctx, query, db.keys.ActiveKeyID(), lastID, batchSize)
+		if err != nil {
+			return rewrapped, fmt.Errorf("failed to list secrets to rewrap: %w", err)
+		}
+		var batch []pending
+		for rows.Next() {
+			var p pending
+			if err := rows.Scan(&p.id, &p.stored.Secret, &p.stored.DataKey, &p.stored.KeyID); err != nil {
+				rows.Close()
+				return rewrapped, fmt.Errorf("failed to scan secret to rewrap: %w", err)
+			}
+			batch = append(batch, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return rewrapped, fmt.Errorf("failed to list secrets to rewrap: %w", err)
+		}
+		if len(batch) == 0 {
+			return rewrapped, nil
+		}
+
+		for _, p := range batch {
+			lastID = p.id
+
+			var next encryptedSecret
+			if p.stored.KeyID == nil {
+				next, err = db.keys.encrypt(p.id, p.stored.Secret)
+			} else {
+				var dataKey []byte
+				dataKey, err = db.keys.unwrap(p.stored)
+				if err == nil {
+					next, err = db.keys.wrap(p.stored.Secret, dataKey)
+				}
+			}
+			if err != nil {
+				log.Printf("Skipping rewrap of master token %s: %v", p.id, err)
+				continue
+			}
+
+			result, err := db.exec(ctx, update, p.id, next.Secret, next.DataKey, next.KeyID, p.stored.Secret)
+			if err != nil {
+				return rewrapped, fmt.Errorf("failed to rewrap master token %s: %w", p.id, err)
+			}
+			if n, _ := result.RowsAffected(); n == 1 {
+				rewrapped++
+			}
+		}
+	}
+}
+
+// Used OTP operations
+
+// MarkOTPUsed records that the code for the given TOTP time step has been
+// accepted for a token. It returns false if the pair was already recorded,
+// which means the code is being replayed.
+func (db *DB) MarkOTPUsed(ctx context.Context, tokenID string, timeStep int64, usedAt time.Time) (bool, error) {
+	query := `
+		INSERT INTO used_otps (token_id, time_step, used_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (token_id, time_step) DO NOTHING`
+
+	result, err := db.exec(ctx, query, tokenID, timeStep, usedAt)
+	if err != nil {
+		return false, fmt.Errorf("failed to mark otp as used: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to mark otp as used: %w", err)
+	}
+
+	return rows == 1, nil
+}
+
+// PruneUsedOTPs deletes used OTP records accepted before the given time and
+// returns the number of rows removed.
+func (db *DB) PruneUsedOTPs(ctx context.Context, before time.Time) (int64, error) {
+	query := `DELETE FROM used_otps WHERE used_at < $1`
+
+	result, err := db.exec(ctx, query, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune used otps: %w", err)
+	}
+
+	return result.RowsAffected()
+}
+
+// Recovery code operations
+
+// ReplaceRecoveryCodes deletes every recovery code of a token, used or not,
+// and stores the given hashes in their place.
+func (db *DB) ReplaceRecoveryCodes(ctx context.Context, tokenID string, hashes []string, createdAt time.Time) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to replace recovery codes: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := db.txExec(ctx, tx, `DELETE FROM recovery_codes WHERE token_id = $1`, tokenID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+
+	query := `
+		INSERT INTO recovery_codes (token_id, code_hash, created_at)
+		VALUES ($1, $2, $3)`
+
+	for _, hash := range hashes {
+		if _, err := db.txExec(ctx, tx, query, tokenID, hash, createdAt); err != nil {
+			return fmt.Errorf("failed to create recovery code: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to replace recovery codes: %w", err)
+	}
+
+	return nil
+}
+
+// ListUnusedRecoveryCodes returns the recovery codes of a token that haven't
+// been used yet.
+func (db *DB) ListUnusedRecoveryCodes(ctx context.Context, tokenID string) ([]*RecoveryCode, error) {
+	query := `
+		SELECT id, token_id, code_hash, created_at, used_at
+		FROM recovery_codes
+		WHERE token_id = $1 AND used_at IS NULL
+		ORDER BY id`
+
+	rows, err := db.query(ctx, query, tokenID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list recovery codes: %w", err)
+	}
+	defer rows.Close()
+
+	var codes []*RecoveryCode
+	for rows.Next() {
+		code := &RecoveryCode{}
+		if err := rows.Scan(&code.ID, &code.TokenID, &code.CodeHash, &code.CreatedAt, &code.UsedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan recovery code: %w", err)
+		}
+		codes = append(codes, code)
+	}
+
+	return codes, rows.Err()
+}
+
+// UseRecoveryCode burns a recovery code. It returns false if the code had
+// already been used, so a code can't be redeemed twice even concurrently.
+func (db *DB) UseRecoveryCode(ctx context.Context, id int64, usedAt time.Time) (bool, error) {
+	query := `
+		UPDATE recovery_codes
+		SET used_at = $2
+		WHERE id = $1 AND used_at IS NULL`
+
+	result, err := db.exec(ctx, query, id, usedAt)
+	if err != nil {
+		return false, fmt.Errorf("failed to use recovery code: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to use recovery code: %w", err)
+	}
+
+	return rows == 1, nil
+}
+
+// CountUnusedRecoveryCodes returns how many recovery codes a token has left.
+func (db *DB) CountUnusedRecoveryCodes(ctx context.Context, tokenID string) (int, error) {
+	query := `SELECT COUNT(*) FROM recovery_codes WHERE token_id = $1 AND used_at IS NULL`
+
+	var count int
+	if err := db.queryRow(ctx, query, tokenID).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count recovery codes: %w", err)
+	}
+
+	return count, nil
+}
+
+// Session operations
+
+func (db *DB) CreateSession(ctx context.Context, session *Session) error {
+	query := `
+		INSERT INTO sessions (token_hash, token_id, authenticated_at, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5)`
+
+	_, err := db.exec(ctx, query, session.TokenHash, session.TokenID, session.AuthenticatedAt, session.CreatedAt, session.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+
+	return nil
+}
+
+func (db *DB) GetSession(ctx context.Context, tokenHash string) (*Session, error) {
+	query := `
+		SELECT token_hash, token_id, authenticated_at, created_at, expires_at, revoked_at
+		FROM sessions
+		WHERE token_hash = $1`
+
+	session := &Session{}
+	err := db.queryRow(ctx, query, tokenHash).Scan(&session.TokenHash, &session.TokenID, &session.AuthenticatedAt,
+		&session.CreatedAt, &session.ExpiresAt, &session.RevokedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Session not found
+		}
+		return nil, fmt.Errorf("failed to get session: %w", err)
+	}
+
+	return session, nil
+}
+
+// RevokeSession revokes a single session. It returns false if the session
+// doesn't exist or was already revoked.
+func (db *DB) RevokeSession(ctx context.Context, tokenHash string, revokedAt time.Time) (bool, error) {
+	query := `
+		UPDATE sessions
+		SET revoked_at = $2
+		WHERE token_hash = $1 AND revoked_at IS NULL`
+
+	result, err := db.exec(ctx, query, tokenHash, revokedAt)
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke session: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke session: %w", err)
+	}
+
+	return rows == 1, nil
+}
+
+// RevokeSessionsForToken revokes every open session of a master token.
+func (db *DB) RevokeSessionsForToken(ctx context.Context, tokenID string, revokedAt time.Time) error {
+	query := `
+		UPDATE sessions
+		SET revoked_at = $2
+		WHERE token_id = $1 AND revoked_at IS NULL`
+
+	if _, err := db.exec(ctx, query, tokenID, revokedAt); err != nil {
+		return fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteExpiredSessions deletes sessions that expired before the given time
+// and returns the number of rows removed.
+func (db *DB) DeleteExpiredSessions(ctx context.Context, before time.Time) (int64, error) {
+	query := `DELETE FROM sessions WHERE expires_at < $1`
+
+	result, err := db.exec(ctx, query, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired sessions: %w", err)
+	}
+
+	return result.RowsAffected()
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -0,0 +1,176 @@
+package database
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var ctx = context.Background()
+
+// connectTest connects to a fresh SQLite database in a temporary directory,
+// or to the PostgreSQL database in TEST_POSTGRES_DSN if postgres is true.
+// Migrations are not applied.
+func connectTest(t *testing.T, postgres bool) *DB {
+	t.Helper()
+	if postgres {
+		dsn := os.Getenv("TEST_POSTGRES_DSN")
+		if dsn == "" {
+			t.Skip("TEST_POSTGRES_DSN is not set")
+		}
+		t.Setenv("DB_DRIVER", DriverPostgres)
+		t.Setenv("DB_DSN", dsn)
+	} else {
+		t.Setenv("DB_DRIVER", DriverSQLite)
+		t.Setenv("DB_DSN", filepath.Join(t.TempDir(), "otp-basic.db"))
+	}
+
+	db, err := Connect()
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newTestDB returns a migrated SQLite database in a temporary directory.
+func newTestDB(t *testing.T) *DB {
+	t.Helper()
+	db := connectTest(t, false)
+	if err := db.MigrateUp(); err != nil {
+		t.Fatalf("MigrateUp() error = %v", err)
+	}
+	return db
+}
+
+func newTestToken() *MasterToken {
+	return &MasterToken{
+		ID:        uuid.New().String(),
+		Secret:    "JBSWY3DPEHPK3PXP",
+		CreatedAt: time.Now(),
+		IsActive:  true,
+		Algorithm: "SHA1",
+		Digits:    6,
+		Period:    30,
+		Skew:      1,
+		Type:      "totp",
+	}
+}
+
+func TestMigrateUp_KeepsConnectionOpen(t *testing.T) {
+	for _, backend := range []struct {
+		name     string
+		postgres bool
+	}{
+		{"sqlite", false},
+		{"postgres", true},
+	} {
+		t.Run(backend.name, func(t *testing.T) {
+			db := connectTest(t, backend.postgres)
+
+			if err := db.MigrateUp(); err != nil {
+				t.Fatalf("MigrateUp() error = %v", err)
+			}
+			// Running again takes the no-change path, which closes the
+			// migrator as well
+			if err := db.MigrateUp(); err != nil {
+				t.Fatalf("second MigrateUp() error = %v", err)
+			}
+			if _, _, err := db.MigrationVersion(); err != nil {
+				t.Fatalf("MigrationVersion() error = %v", err)
+			}
+
+			token := newTestToken()
+			if err := db.CreateMasterToken(ctx, token); err != nil {
+				t.Fatalf("CreateMasterToken() after migrating error = %v", err)
+			}
+			t.Cleanup(func() { db.DeleteMasterToken(ctx, token.ID) })
+
+			got, err := db.GetMasterToken(ctx, token.ID)
+			if err != nil {
+				t.Fatalf("GetMasterToken() after migrating error = %v", err)
+			}
+			if got == nil || got.Secret != token.Secret {
+				t.Errorf("GetMasterToken() = %+v, want the created token", got)
+			}
+		})
+	}
+}
+
+func TestSetMasterTokenActive_KeepsSecret(t *testing.T) {
+	db := newTestDB(t)
+	token := newTestToken()
+	if err := db.CreateMasterToken(ctx, token); err != nil {
+		t.Fatalf("CreateMasterToken() error = %v", err)
+	}
+
+	// A rotation that lands between an admin's read and the deactivation
+	// must survive it
+	if err := db.RotateMasterTokenSecret(ctx, token.ID, "KRSXG5CTMVRXEZLU"); err != nil {
+		t.Fatalf("RotateMasterTokenSecret() error = %v", err)
+	}
+	found, err := db.SetMasterTokenActive(ctx, token.ID, false)
+	if err != nil || !found {
+		t.Fatalf("SetMasterTokenActive() = %v, %v, want true", found, err)
+	}
+
+	got, err := db.GetMasterToken(ctx, token.ID)
+	if err != nil {
+		t.Fatalf("GetMasterToken() error = %v", err)
+	}
+	if got.IsActive {
+		t.Error("Expected token to be inactive")
+	}
+	if got.Secret != "KRSXG5CTMVRXEZLU" {
+		t.Errorf("Secret = %q, want the rotated secret", got.Secret)
+	}
+
+	if found, err := db.SetMasterTokenActive(ctx, "unknown", true); err != nil || found {
+		t.Errorf("SetMasterTokenActive() for unknown token = %v, %v, want false", found, err)
+	}
+}
+
+func TestDB_Tracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer provider.Shutdown(ctx)
+
+	db := newTestDB(t)
+	db.SetTracerProvider(provider)
+	if err := db.CreateMasterToken(ctx, newTestToken()); err != nil {
+		t.Fatalf("CreateMasterToken() error = %v", err)
+	}
+
+	rows, err := db.query(ctx, `SELECT id FROM master_tokens`)
+	if err != nil {
+		t.Fatalf("query() error = %v", err)
+	}
+	ended := func(name string) bool {
+		for _, span := range recorder.Ended() {
+			if span.Name() == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Reading the rows is part of the query
+	for rows.Next() {
+	}
+	if ended("select master_tokens") {
+		t.Error("Expected the query span to last until the rows are closed")
+	}
+	rows.Close()
+	if !ended("select master_tokens") {
+		t.Error("Expected the query span to end when the rows are closed")
+	}
+	if !ended("insert master_tokens") {
+		t.Error("Expected statements to be traced with the configured provider")
+	}
+}
@@ -0,0 +1,294 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/database/sqlite"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies the spans of this package.
+const tracerName = "otp-basic/internal/database"
+
+// Supported values of DB_DRIVER.
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+)
+
+// sqlitePragmas are applied to every SQLite connection. Foreign keys must be
+// switched on for ON DELETE CASCADE to work, and times are written in a
+// fixed format so they compare correctly as text.
+var sqlitePragmas = url.Values{
+	"_pragma": {
+		"foreign_keys(1)",
+		"busy_timeout(5000)",
+		"journal_mode(WAL)",
+	},
+	"_time_format": {"sqlite"},
+}
+
+// loadDriverConfig returns the driver and data source name to connect with.
+// DB_DRIVER picks the backend explicitly; otherwise it is derived from the
+// scheme of DB_DSN, falling back to PostgreSQL built from the DB_* settings.
+func loadDriverConfig() (string, string, error) {
+	driver := strings.ToLower(getEnv("DB_DRIVER", ""))
+	dsn := getEnv("DB_DSN", "")
+
+	if driver == "" {
+		switch {
+		case strings.HasPrefix(dsn, "sqlite://"):
+			driver = DriverSQLite
+			dsn = strings.TrimPrefix(dsn, "sqlite://")
+		case strings.HasPrefix(dsn, "file:"):
+			driver = DriverSQLite
+		default:
+			driver = DriverPostgres
+		}
+	}
+
+	switch driver {
+	case DriverPostgres:
+		if dsn == "" {
+			dsn = fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+				getEnv("DB_HOST", "localhost"),
+				getEnv("DB_PORT", "5432"),
+				getEnv("DB_USER", "postgres"),
+				getEnv("DB_PASSWORD", "postgres"),
+				getEnv("DB_NAME", "otp_basic"),
+				getEnv("DB_SSLMODE", "disable"))
+		}
+		return driver, dsn, nil
+	case DriverSQLite:
+		if dsn == "" {
+			dsn = "otp-basic.db"
+		}
+		return driver, sqliteDSN(strings.TrimPrefix(dsn, "sqlite://")), nil
+	default:
+		return "", "", fmt.Errorf("unsupported DB_DRIVER %q, expected %q or %q", driver, DriverPostgres, DriverSQLite)
+	}
+}
+
+// sqliteDSN adds sqlitePragmas to a file name or file: URI, keeping any
+// parameters that are already present.
+func sqliteDSN(dsn string) string {
+	params := url.Values{}
+	if i := strings.IndexByte(dsn, '?'); i >= 0 {
+		params, _ = url.ParseQuery(dsn[i+1:])
+		dsn = dsn[:i]
+	}
+	for key, values := range sqlitePragmas {
+		if key == "_pragma" {
+			params[key] = append(params[key], values...)
+		} else if params.Get(key) == "" {
+			params[key] = values
+		}
+	}
+	return dsn + "?" + params.Encode()
+}
+
+// configurePool sets connection pool limits suited to the driver.
+func configurePool(driver string, conn *sql.DB) {
+	if driver == DriverSQLite {
+		// SQLite allows a single writer; one connection avoids SQLITE_BUSY
+		// and keeps in-memory databases shared.
+		conn.SetMaxOpenConns(1)
+		return
+	}
+
+	conn.SetMaxOpenConns(25)
+	conn.SetMaxIdleConns(5)
+	conn.SetConnMaxLifetime(5 * time.Minute)
+}
+
+// migrationDriver wraps conn in the golang-migrate driver for the backend.
+// The PostgreSQL driver is given a single connection taken from the pool
+// rather than the pool itself: closing a driver built with WithInstance
+// closes the *sql.DB, while closing one built with WithConnection only
+// returns its connection to the pool.
+func migrationDriver(driver string, conn *sql.DB) (database.Driver, error) {
+	switch driver {
+	case DriverSQLite:
+		return sqlite.WithInstance(conn, &sqlite.Config{})
+	default:
+		ctx := context.Background()
+		pgConn, err := conn.Conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		pgDriver, err := postgres.WithConnection(ctx, pgConn, &postgres.Config{})
+		if err != nil {
+			pgConn.Close()
+			return nil, err
+		}
+		return pgDriver, nil
+	}
+}
+
+// bind adapts query arguments to the driver. SQLite stores times as text, so
+// they are converted to UTC to keep comparisons in SQL consistent.
+func (db *DB) bind(args ...any) []any {
+	if db.driver != DriverSQLite {
+		return args
+	}
+
+	bound := make([]any, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case time.Time:
+			bound[i] = v.UTC()
+		case *time.Time:
+			if v != nil {
+				bound[i] = v.UTC()
+			} else {
+				bound[i] = nil
+			}
+		default:
+			bound[i] = arg
+		}
+	}
+	return bound
+}
+
+func (db *DB) exec(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	ctx, done := db.startQuery(ctx, query)
+	result, err := db.conn.ExecContext(ctx, query, db.bind(args...)...)
+	done(err)
+	return result, err
+}
+
+// query runs a statement returning rows. Its span lasts until the rows are
+// closed, so it covers reading them too.
+func (db *DB) query(ctx context.Context, query string, args ...any) (*tracedRows, error) {
+	ctx, done := db.startQuery(ctx, query)
+	rows, err := db.conn.QueryContext(ctx, query, db.bind(args...)...)
+	if err != nil {
+		done(err)
+		return nil, err
+	}
+	return &tracedRows{Rows: rows, done: done}, nil
+}
+
+// tracedRows ends the span of its query when closed.
+type tracedRows struct {
+	*sql.Rows
+	done func(error)
+}
+
+func (r *tracedRows) Close() error {
+	err := r.Rows.Close()
+	if r.done != nil {
+		r.done(r.Rows.Err())
+		r.done = nil
+	}
+	return err
+}
+
+func (db *DB) queryRow(ctx context.Context, query string, args ...any) *sql.Row {
+	ctx, done := db.startQuery(ctx, query)
+	row := db.conn.QueryRowContext(ctx, query, db.bind(args...)...)
+	done(row.Err())
+	return row
+}
+
+func (db *DB) txExec(ctx context.Context, tx *sql.Tx, query string, args ...any) (sql.Result, error) {
+	ctx, done := db.startQuery(ctx, query)
+	result, err := tx.ExecContext(ctx, query, db.bind(args...)...)
+	done(err)
+	return result, err
+}
+
+func (db *DB) txQueryRow(ctx context.Context, tx *sql.Tx, query string, args ...any) *sql.Row {
+	ctx, done := db.startQuery(ctx, query)
+	row := tx.QueryRowContext(ctx, query, db.bind(args...)...)
+	done(row.Err())
+	return row
+}
+
+// startQuery opens a span for a statement. The returned function ends it and
+// reports the latency to the observer.
+func (db *DB) startQuery(ctx context.Context, query string) (context.Context, func(error)) {
+	start := time.Now()
+	statement := statementName(query)
+
+	system := semconv.DBSystemPostgreSQL
+	if db.driver == DriverSQLite {
+		system = semconv.DBSystemSqlite
+	}
+	ctx, span := db.tracer.Start(ctx, statement,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(system, semconv.DBStatement(strings.TrimSpace(query))))
+
+	return ctx, func(err error) {
+		if db.observer != nil {
+			db.observer.ObserveQuery(statement, time.Since(start))
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// SetTracerProvider makes the database create its spans with provider
+// instead of the global tracer provider. It must be called before the
+// database is used concurrently.
+func (db *DB) SetTracerProvider(provider trace.TracerProvider) {
+	db.tracer = provider.Tracer(tracerName)
+}
+
+// QueryObserver receives the latency of every database statement, including
+// reading its rows.
+type QueryObserver interface {
+	ObserveQuery(statement string, d time.Duration)
+}
+
+// SetQueryObserver installs an observer for statement latencies. It must be
+// called before the database is used concurrently.
+func (db *DB) SetQueryObserver(observer QueryObserver) {
+	db.observer = observer
+}
+
+// Stats returns the connection pool statistics.
+func (db *DB) Stats() sql.DBStats {
+	return db.conn.Stats()
+}
+
+// statementName summarises a query as its verb and table, e.g.
+// "select master_tokens", which keeps metric labels low-cardinality.
+func statementName(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "unknown"
+	}
+
+	verb := strings.ToLower(fields[0])
+	after := ""
+	switch verb {
+	case "select", "delete":
+		after = "from"
+	case "insert":
+		after = "into"
+	case "update":
+		if len(fields) > 1 {
+			return verb + " " + fields[1]
+		}
+	}
+	for i := 1; i < len(fields)-1 && after != ""; i++ {
+		if strings.EqualFold(fields[i], after) {
+			return verb + " " + fields[i+1]
+		}
+	}
+	return verb
+}
@@ -0,0 +1,428 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a thread-safe in-memory implementation of the same storage
+// operations as DB. It is meant for tests and for running without
+// PostgreSQL; nothing survives a restart.
+type MemoryStore struct {
+	mu sync.Mutex
+
+	tokens        map[string]*MasterToken
+	usedOTPs      map[usedOTPKey]time.Time
+	recoveryCodes []*RecoveryCode
+	nextCodeID    int64
+	sessions      map[string]*Session
+	authEvents    []*AuthEvent
+}
+
+type usedOTPKey struct {
+	tokenID  string
+	timeStep int64
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		tokens:   make(map[string]*MasterToken),
+		usedOTPs: make(map[usedOTPKey]time.Time),
+		sessions: make(map[string]*Session),
+	}
+}
+
+// copyToken returns a copy so callers can't mutate stored state.
+func copyToken(token *MasterToken) *MasterToken {
+	c := *token
+	return &c
+}
+
+// MasterToken operations
+
+func (m *MemoryStore) CreateMasterToken(_ context.Context, token *MasterToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.tokens[token.ID]; exists {
+		return fmt.Errorf("failed to create master token: duplicate id %s", token.ID)
+	}
+	m.tokens[token.ID] = copyToken(token)
+	return nil
+}
+
+func (m *MemoryStore) GetMasterToken(_ context.Context, id string) (*MasterToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.tokens[id]
+	if !ok {
+		return nil, nil // Token not found
+	}
+	return copyToken(token), nil
+}
+
+func (m *MemoryStore) UpdateMasterToken(_ context.Context, token *MasterToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.tokens[token.ID]
+	if !ok {
+		return nil
+	}
+	stored.Secret = token.Secret
+	stored.IsActive = token.IsActive
+	stored.Issuer = token.Issuer
+	stored.AccountName = token.AccountName
+	stored.Algorithm = token.Algorithm
+	stored.Digits = token.Digits
+	stored.Period = token.Period
+	stored.Skew = token.Skew
+	return nil
+}
+
+func (m *MemoryStore) RotateMasterTokenSecret(_ context.Context, id, secret string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.tokens[id]
+	if !ok {
+		return nil
+	}
+	token.Secret = secret
+	token.Counter = 0
+	for key := range m.usedOTPs {
+		if key.tokenID == id {
+			delete(m.usedOTPs, key)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) ConfirmMasterToken(_ context.Context, id string, confirmedAt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.tokens[id]
+	if !ok || token.ConfirmedAt != nil {
+		return false, nil
+	}
+	token.IsActive = true
+	token.ConfirmedAt = &confirmedAt
+	return true, nil
+}
+
+func (m *MemoryStore) DeletePendingMasterTokens(_ context.Context, createdBefore time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var deleted int64
+	for id, token := range m.tokens {
+		if token.ConfirmedAt == nil && token.CreatedAt.Before(createdBefore) {
+			m.deleteLocked(id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (m *MemoryStore) AdvanceHOTPCounter(_ context.Context, id string, expected, next int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.tokens[id]
+	if !ok || token.Counter != expected {
+		return false, nil
+	}
+	token.Counter = next
+	return true, nil
+}
+
+func (m *MemoryStore) SetClientCertSubject(_ context.Context, id string, subject *string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.tokens[id]
+	if !ok {
+		return false, nil
+	}
+	if subject != nil {
+		s := *subject
+		subject = &s
+	}
+	token.ClientCertSubject = subject
+	return true, nil
+}
+
+func (m *MemoryStore) SetMasterTokenActive(_ context.Context, id string, active bool) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.tokens[id]
+	if !ok {
+		return false, nil
+	}
+	token.IsActive = active
+	return true, nil
+}
+
+func (m *MemoryStore) DeleteMasterToken(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deleteLocked(id)
+	return nil
+}
+
+// deleteLocked removes a token and everything referencing it, like the
+// ON DELETE CASCADE foreign keys do in PostgreSQL.
+func (m *MemoryStore) deleteLocked(id string) {
+	delete(m.tokens, id)
+	for key := range m.usedOTPs {
+		if key.tokenID == id {
+			delete(m.usedOTPs, key)
+		}
+	}
+	codes := m.recoveryCodes[:0]
+	for _, code := range m.recoveryCodes {
+		if code.TokenID != id {
+			codes = append(codes, code)
+		}
+	}
+	m.recoveryCodes = codes
+	for hash, session := range m.sessions {
+		if session.TokenID == id {
+			delete(m.sessions, hash)
+		}
+	}
+}
+
+func (m *MemoryStore) ListMasterTokens(_ context.Context, filter MasterTokenFilter) ([]*MasterToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var tokens []*MasterToken
+	for _, token := range m.tokens {
+		if filter.Issuer != "" && (token.Issuer == nil || *token.Issuer != filter.Issuer) {
+			continue
+		}
+		if filter.AccountName != "" && (token.AccountName == nil || *token.AccountName != filter.AccountName) {
+			continue
+		}
+		tokens = append(tokens, copyToken(token))
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.After(tokens[j].CreatedAt)
+	})
+
+	if filter.Offset >= len(tokens) {
+		return nil, nil
+	}
+	tokens = tokens[filter.Offset:]
+	if filter.Limit < len(tokens) {
+		tokens = tokens[:filter.Limit]
+	}
+	return tokens, nil
+}
+
+// Used OTP operations
+
+func (m *MemoryStore) MarkOTPUsed(_ context.Context, tokenID string, timeStep int64, usedAt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := usedOTPKey{tokenID: tokenID, timeStep: timeStep}
+	if _, used := m.usedOTPs[key]; used {
+		return false, nil
+	}
+	m.usedOTPs[key] = usedAt
+	return true, nil
+}
+
+func (m *MemoryStore) PruneUsedOTPs(_ context.Context, before time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var pruned int64
+	for key, usedAt := range m.usedOTPs {
+		if usedAt.Before(before) {
+			delete(m.usedOTPs, key)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// Recovery code operations
+
+func (m *MemoryStore) ReplaceRecoveryCodes(_ context.Context, tokenID string, hashes []string, createdAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	codes := m.recoveryCodes[:0]
+	for _, code := range m.recoveryCodes {
+		if code.TokenID != tokenID {
+			codes = append(codes, code)
+		}
+	}
+	for _, hash := range hashes {
+		m.nextCodeID++
+		codes = append(codes, &RecoveryCode{
+			ID:        m.nextCodeID,
+			TokenID:   tokenID,
+			CodeHash:  hash,
+			CreatedAt: createdAt,
+		})
+	}
+	m.recoveryCodes = codes
+	return nil
+}
+
+func (m *MemoryStore) ListUnusedRecoveryCodes(_ context.Context, tokenID string) ([]*RecoveryCode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var codes []*RecoveryCode
+	for _, code := range m.recoveryCodes {
+		if code.TokenID == tokenID && code.UsedAt == nil {
+			c := *code
+			codes = append(codes, &c)
+		}
+	}
+	return codes, nil
+}
+
+func (m *MemoryStore) UseRecoveryCode(_ context.Context, id int64, usedAt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, code := range m.recoveryCodes {
+		if code.ID == id {
+			if code.UsedAt != nil {
+				return false, nil
+			}
+			code.UsedAt = &usedAt
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MemoryStore) CountUnusedRecoveryCodes(_ context.Context, tokenID string) (int, error) {
+	codes, err := m.ListUnusedRecoveryCodes(context.Background(), tokenID)
+	return len(codes), err
+}
+
+// Session operations
+
+func (m *MemoryStore) CreateSession(_ context.Context, session *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.sessions[session.TokenHash]; exists {
+		return fmt.Errorf("failed to create session: duplicate token hash")
+	}
+	s := *session
+	m.sessions[session.TokenHash] = &s
+	return nil
+}
+
+func (m *MemoryStore) GetSession(_ context.Context, tokenHash string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[tokenHash]
+	if !ok {
+		return nil, nil // Session not found
+	}
+	s := *session
+	return &s, nil
+}
+
+func (m *MemoryStore) RevokeSession(_ context.Context, tokenHash string, revokedAt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[tokenHash]
+	if !ok || session.RevokedAt != nil {
+		return false, nil
+	}
+	session.RevokedAt = &revokedAt
+	return true, nil
+}
+
+func (m *MemoryStore) RevokeSessionsForToken(_ context.Context, tokenID string, revokedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, session := range m.sessions {
+		if session.TokenID == tokenID && session.RevokedAt == nil {
+			session.RevokedAt = &revokedAt
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteExpiredSessions(_ context.Context, before time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var deleted int64
+	for hash, session := range m.sessions {
+		if session.ExpiresAt.Before(before) {
+			delete(m.sessions, hash)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// Audit log operations
+
+func (m *MemoryStore) AppendAuthEvent(_ context.Context, event *AuthEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prevHash := GenesisHash
+	if n := len(m.authEvents); n > 0 {
+		prevHash = m.authEvents[n-1].Hash
+	}
+	sealAuthEvent(event, prevHash)
+	event.ID = int64(len(m.authEvents) + 1)
+
+	stored := *event
+	m.authEvents = append(m.authEvents, &stored)
+	return nil
+}
+
+func (m *MemoryStore) AuthEventHead(context.Context) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if n := len(m.authEvents); n > 0 {
+		return m.authEvents[n-1].Hash, nil
+	}
+	return GenesisHash, nil
+}
+
+func (m *MemoryStore) ListAuthEvents(_ context.Context, afterID int64, limit int) ([]*AuthEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var events []*AuthEvent
+	for _, event := range m.authEvents {
+		if event.ID <= afterID {
+			continue
+		}
+		if len(events) == limit {
+			break
+		}
+		c := *event
+		events = append(events, &c)
+	}
+	return events, nil
+}
@@ -0,0 +1,113 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"otp-basic/migrations"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+// migrator returns a migrate instance reading the embedded migrations for
+// the database's driver.
+func (db *DB) migrator() (*migrate.Migrate, error) {
+	source, err := iofs.New(migrations.FS, db.driver)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open embedded migrations: %w", err)
+	}
+
+	driver, err := migrationDriver(db.driver, db.conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create migration driver: %w", err)
+	}
+
+	m, err := migrate.NewWithInstance("iofs", source, db.driver, driver)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create migration instance: %w", err)
+	}
+	return m, nil
+}
+
+// closeMigrator returns the connection held by the PostgreSQL migration
+// driver to the pool. The SQLite driver works on db.conn itself, and closing
+// it would close the database.
+func (db *DB) closeMigrator(m *migrate.Migrate) {
+	if db.driver == DriverSQLite {
+		return
+	}
+	m.Close()
+}
+
+// MigrateUp applies all pending migrations.
+func (db *DB) MigrateUp() error {
+	m, err := db.migrator()
+	if err != nil {
+		return err
+	}
+	defer db.closeMigrator(m)
+
+	if err := m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("failed to run migrations: %w", err)
+	}
+
+	log.Println("Database migrations completed successfully")
+	return nil
+}
+
+// MigrateDown rolls back the given number of migrations.
+func (db *DB) MigrateDown(steps int) error {
+	if steps <= 0 {
+		return fmt.Errorf("steps must be positive, got %d", steps)
+	}
+
+	m, err := db.migrator()
+	if err != nil {
+		return err
+	}
+	defer db.closeMigrator(m)
+
+	if err := m.Steps(-steps); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("failed to roll back migrations: %w", err)
+	}
+	return nil
+}
+
+// MigrationVersion returns the current schema version and whether the last
+// migration failed halfway, leaving the schema dirty. The version is 0 if no
+// migration has been applied.
+func (db *DB) MigrationVersion() (uint, bool, error) {
+	m, err := db.migrator()
+	if err != nil {
+		return 0, false, err
+	}
+	defer db.closeMigrator(m)
+
+	version, dirty, err := m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read migration version: %w", err)
+	}
+	return version, dirty, nil
+}
+
+// ForceMigrationVersion records version as the current schema version and
+// clears the dirty flag without running any migration. It is meant for
+// recovering after a failed migration has been fixed by hand; -1 means no
+// version.
+func (db *DB) ForceMigrationVersion(version int) error {
+	m, err := db.migrator()
+	if err != nil {
+		return err
+	}
+	defer db.closeMigrator(m)
+
+	if err := m.Force(version); err != nil {
+		return fmt.Errorf("failed to force migration version: %w", err)
+	}
+	return nil
+}
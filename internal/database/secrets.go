@@ -0,0 +1,195 @@
+package database
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const keySize = 32 // AES-256
+
+// KeyRing holds the master keys used to wrap the per-row data keys that
+// encrypt token secrets. The active key wraps all new data keys; the others
+// are only kept so rows wrapped under them can still be read until
+// RewrapSecrets has moved them to the active key.
+type KeyRing struct {
+	activeID string
+	keys     map[string][]byte
+}
+
+// LoadKeyRing reads master keys from the file named by OTP_MASTER_KEY_FILE,
+// or from OTP_MASTER_KEYS if no file is set. Keys are listed one per line or
+// comma separated as "<key-id>:<base64 32-byte key>"; the first entry is the
+// active key. It returns nil if no keys are configured.
+func LoadKeyRing() (*KeyRing, error) {
+	spec := os.Getenv("OTP_MASTER_KEYS")
+	if path := os.Getenv("OTP_MASTER_KEY_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read master key file: %w", err)
+		}
+		spec = string(data)
+	}
+
+	return ParseKeyRing(spec)
+}
+
+// ParseKeyRing parses a key list in the format described by LoadKeyRing.
+func ParseKeyRing(spec string) (*KeyRing, error) {
+	entries := strings.FieldsFunc(spec, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r'
+	})
+
+	var ring *KeyRing
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("invalid master key entry: expected <key-id>:<base64 key>")
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid master key %q: %w", id, err)
+		}
+		if len(key) != keySize {
+			return nil, fmt.Errorf("invalid master key %q: must be %d bytes, got %d", id, keySize, len(key))
+		}
+
+		if ring == nil {
+			ring = &KeyRing{activeID: id, keys: make(map[string][]byte)}
+		}
+		if _, exists := ring.keys[id]; exists {
+			return nil, fmt.Errorf("duplicate master key %q", id)
+		}
+		ring.keys[id] = key
+	}
+
+	return ring, nil
+}
+
+// ActiveKeyID returns the ID of the key used to wrap new data keys.
+func (k *KeyRing) ActiveKeyID() string {
+	return k.activeID
+}
+
+// encryptedSecret is the stored form of a token secret. A nil KeyID means
+// the secret is stored in plaintext.
+type encryptedSecret struct {
+	Secret  string
+	DataKey *string
+	KeyID   *string
+}
+
+// encrypt seals secret under a fresh data key and wraps that key with the
+// active master key. The token ID is bound as additional data so ciphertexts
+// can't be swapped between rows.
+func (k *KeyRing) encrypt(tokenID, secret string) (encryptedSecret, error) {
+	dataKey := make([]byte, keySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return encryptedSecret{}, fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	sealed, err := seal(dataKey, []byte(secret), []byte(tokenID))
+	if err != nil {
+		return encryptedSecret{}, err
+	}
+
+	return k.wrap(sealed, dataKey)
+}
+
+// wrap encrypts dataKey under the active master key.
+func (k *KeyRing) wrap(sealedSecret string, dataKey []byte) (encryptedSecret, error) {
+	wrapped, err := seal(k.keys[k.activeID], dataKey, []byte(k.activeID))
+	if err != nil {
+		return encryptedSecret{}, err
+	}
+
+	keyID := k.activeID
+	return encryptedSecret{Secret: sealedSecret, DataKey: &wrapped, KeyID: &keyID}, nil
+}
+
+// unwrap recovers the data key of a stored secret.
+func (k *KeyRing) unwrap(stored encryptedSecret) ([]byte, error) {
+	if stored.DataKey == nil {
+		return nil, errors.New("encrypted secret has no data key")
+	}
+	masterKey, ok := k.keys[*stored.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown master key %q", *stored.KeyID)
+	}
+	return open(masterKey, *stored.DataKey, []byte(*stored.KeyID))
+}
+
+// decrypt returns the plaintext secret of a stored row.
+func (k *KeyRing) decrypt(tokenID string, stored encryptedSecret) (string, error) {
+	if stored.KeyID == nil {
+		return stored.Secret, nil
+	}
+	if k == nil {
+		return "", fmt.Errorf("secret is encrypted with master key %q but no master keys are configured", *stored.KeyID)
+	}
+
+	dataKey, err := k.unwrap(stored)
+	if err != nil {
+		return "", err
+	}
+	secret, err := open(dataKey, stored.Secret, []byte(tokenID))
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+func seal(key, plaintext, additionalData []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	sealed := gcm.Seal(nonce, nonce, plaintext, additionalData)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func open(key []byte, encoded string, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode ciphertext: %w", err)
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
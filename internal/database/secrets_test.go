@@ -0,0 +1,251 @@
+package database
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testKey returns a key list entry for id with a key made of b.
+func testKey(id string, b byte) string {
+	return id + ":" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, keySize))
+}
+
+func mustParseKeyRing(t *testing.T, spec string) *KeyRing {
+	t.Helper()
+	ring, err := ParseKeyRing(spec)
+	if err != nil {
+		t.Fatalf("ParseKeyRing() error = %v", err)
+	}
+	return ring
+}
+
+// storedSecret reads the stored form of a token's secret.
+func storedSecret(t *testing.T, db *DB, id string) encryptedSecret {
+	t.Helper()
+	var stored encryptedSecret
+	err := db.conn.QueryRow(`SELECT secret, data_key, key_id FROM master_tokens WHERE id = ?`, id).
+		Scan(&stored.Secret, &stored.DataKey, &stored.KeyID)
+	if err != nil {
+		t.Fatalf("Failed to read stored secret: %v", err)
+	}
+	return stored
+}
+
+func TestParseKeyRing(t *testing.T) {
+	ring := mustParseKeyRing(t, testKey("new", 1)+",\n# retired\n"+testKey("old", 2))
+	if ring.ActiveKeyID() != "new" || len(ring.keys) != 2 {
+		t.Errorf("ParseKeyRing() = active %q with %d keys, want new with 2", ring.ActiveKeyID(), len(ring.keys))
+	}
+
+	if ring, err := ParseKeyRing(""); err != nil || ring != nil {
+		t.Errorf("ParseKeyRing(\"\") = %v, %v, want nil", ring, err)
+	}
+
+	for _, spec := range []string{
+		"no-separator",
+		"short:" + base64.StdEncoding.EncodeToString([]byte("too short")),
+		"bad:not base64!",
+		testKey("dup", 1) + "," + testKey("dup", 2),
+	} {
+		if _, err := ParseKeyRing(spec); err == nil {
+			t.Errorf("ParseKeyRing(%q) expected an error", spec)
+		}
+	}
+}
+
+func TestKeyRing_EncryptDecrypt(t *testing.T) {
+	ring := mustParseKeyRing(t, testKey("k1", 1))
+
+	stored, err := ring.encrypt("token-a", "JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatalf("encrypt() error = %v", err)
+	}
+	if strings.Contains(stored.Secret, "JBSWY3DPEHPK3PXP") || stored.DataKey == nil || *stored.KeyID != "k1" {
+		t.Errorf("encrypt() = %+v, want a sealed secret wrapped under k1", stored)
+	}
+
+	secret, err := ring.decrypt("token-a", stored)
+	if err != nil || secret != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("decrypt() = %q, %v, want the original secret", secret, err)
+	}
+
+	// Every encryption uses a fresh data key and nonce
+	again, _ := ring.encrypt("token-a", "JBSWY3DPEHPK3PXP")
+	if again.Secret == stored.Secret || *again.DataKey == *stored.DataKey {
+		t.Error("Expected two encryptions of the same secret to differ")
+	}
+
+	// Plaintext rows from before encryption was enabled are read as they are
+	if secret, err := ring.decrypt("token-a", encryptedSecret{Secret: "PLAIN"}); err != nil || secret != "PLAIN" {
+		t.Errorf("decrypt() of a plaintext row = %q, %v", secret, err)
+	}
+}
+
+func TestKeyRing_TokenIDMismatch(t *testing.T) {
+	ring := mustParseKeyRing(t, testKey("k1", 1))
+
+	stored, err := ring.encrypt("token-a", "JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatalf("encrypt() error = %v", err)
+	}
+
+	// A ciphertext copied to another row doesn't decrypt there
+	if _, err := ring.decrypt("token-b", stored); err == nil {
+		t.Error("Expected decrypting under another token ID to fail")
+	}
+
+	// Nor does a data key relabelled with another master key
+	other := mustParseKeyRing(t, testKey("k2", 1))
+	relabelled := stored
+	keyID := "k2"
+	relabelled.KeyID = &keyID
+	if _, err := other.decrypt("token-a", relabelled); err == nil {
+		t.Error("Expected unwrapping under another key ID to fail")
+	}
+
+	var noKeys *KeyRing
+	if _, err := noKeys.decrypt("token-a", stored); err == nil {
+		t.Error("Expected decrypting without master keys to fail")
+	}
+}
+
+func TestDB_SecretsAtRest(t *testing.T) {
+	db := newTestDB(t)
+	db.keys = mustParseKeyRing(t, testKey("k1", 1))
+
+	a, b := newTestToken(), newTestToken()
+	b.Secret = "KRSXG5CTMVRXEZLU"
+	for _, token := range []*MasterToken{a, b} {
+		if err := db.CreateMasterToken(ctx, token); err != nil {
+			t.Fatalf("CreateMasterToken() error = %v", err)
+		}
+	}
+
+	stored := storedSecret(t, db, a.ID)
+	if stored.Secret == a.Secret || stored.KeyID == nil || *stored.KeyID != "k1" {
+		t.Errorf("Stored secret = %+v, want it encrypted under k1", stored)
+	}
+	if got, err := db.GetMasterToken(ctx, a.ID); err != nil || got.Secret != a.Secret {
+		t.Errorf("GetMasterToken() = %v, %v, want the plaintext secret", got, err)
+	}
+
+	// Copying a's ciphertext over b's is detected rather than giving b a's
+	// secret
+	_, err := db.conn.Exec(`UPDATE master_tokens SET secret = ?, data_key = ? WHERE id = ?`,
+		stored.Secret, *stored.DataKey, b.ID)
+	if err != nil {
+		t.Fatalf("Failed to swap ciphertexts: %v", err)
+	}
+	if _, err := db.GetMasterToken(ctx, b.ID); err == nil {
+		t.Error("Expected reading a ciphertext copied from another token to fail")
+	}
+}
+
+func TestDB_RewrapSecrets(t *testing.T) {
+	db := newTestDB(t)
+
+	// One token from before encryption, one under the old key
+	plain := newTestToken()
+	if err := db.CreateMasterToken(ctx, plain); err != nil {
+		t.Fatalf("CreateMasterToken() error = %v", err)
+	}
+	db.keys = mustParseKeyRing(t, testKey("old", 1))
+	wrapped := newTestToken()
+	wrapped.Secret = "KRSXG5CTMVRXEZLU"
+	if err := db.CreateMasterToken(ctx, wrapped); err != nil {
+		t.Fatalf("CreateMasterToken() error = %v", err)
+	}
+	sealedBefore := storedSecret(t, db, wrapped.ID).Secret
+
+	// Change the KEK, keeping the old one to read existing rows
+	db.keys = mustParseKeyRing(t, testKey("new", 2)+","+testKey("old", 1))
+	rewrapped, err := db.RewrapSecrets(ctx, 1)
+	if err != nil || rewrapped != 2 {
+		t.Fatalf("RewrapSecrets() = %d, %v, want 2", rewrapped, err)
+	}
+
+	for _, token := range []*MasterToken{plain, wrapped} {
+		if stored := storedSecret(t, db, token.ID); stored.KeyID == nil || *stored.KeyID != "new" {
+			t.Errorf("Token %s key ID = %v, want new", token.ID, stored.KeyID)
+		}
+	}
+	// Rewrapping only replaces the wrapped data key, not the sealed secret
+	if got := storedSecret(t, db, wrapped.ID).Secret; got != sealedBefore {
+		t.Error("Expected the sealed secret to be kept when rewrapping")
+	}
+
+	// The old key can now be retired
+	db.keys = mustParseKeyRing(t, testKey("new", 2))
+	for _, token := range []*MasterToken{plain, wrapped} {
+		if got, err := db.GetMasterToken(ctx, token.ID); err != nil || got.Secret != token.Secret {
+			t.Errorf("GetMasterToken() with only the new key = %v, %v", got, err)
+		}
+	}
+
+	if rewrapped, err := db.RewrapSecrets(ctx, 10); err != nil || rewrapped != 0 {
+		t.Errorf("Second RewrapSecrets() = %d, %v, want 0", rewrapped, err)
+	}
+}
+
+// rotateOnSelect rotates a token's secret through another connection right
+// after the first master_tokens select, between RewrapSecrets reading a row
+// and writing it back.
+type rotateOnSelect struct {
+	t       *testing.T
+	other   *DB
+	tokenID string
+	secret  string
+	once    sync.Once
+}
+
+func (r *rotateOnSelect) ObserveQuery(statement string, _ time.Duration) {
+	if statement != "select master_tokens" {
+		return
+	}
+	r.once.Do(func() {
+		if err := r.other.RotateMasterTokenSecret(ctx, r.tokenID, r.secret); err != nil {
+			r.t.Errorf("RotateMasterTokenSecret() error = %v", err)
+		}
+	})
+}
+
+func TestDB_RewrapSecrets_KeepsConcurrentRotation(t *testing.T) {
+	db := newTestDB(t)
+	db.keys = mustParseKeyRing(t, testKey("old", 1))
+	token := newTestToken()
+	if err := db.CreateMasterToken(ctx, token); err != nil {
+		t.Fatalf("CreateMasterToken() error = %v", err)
+	}
+
+	// A second pool on the same file stands in for another server instance
+	other, err := Connect()
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer other.Close()
+	other.keys = db.keys
+
+	db.keys = mustParseKeyRing(t, testKey("new", 2)+","+testKey("old", 1))
+	db.SetQueryObserver(&rotateOnSelect{t: t, other: other, tokenID: token.ID, secret: "KRSXG5CTMVRXEZLU"})
+
+	rewrapped, err := db.RewrapSecrets(ctx, 10)
+	if err != nil {
+		t.Fatalf("RewrapSecrets() error = %v", err)
+	}
+	if rewrapped != 0 {
+		t.Errorf("RewrapSecrets() = %d, want 0 since the row changed after it was read", rewrapped)
+	}
+
+	// Writing back the stale row would have restored the old secret
+	got, err := db.GetMasterToken(ctx, token.ID)
+	if err != nil {
+		t.Fatalf("GetMasterToken() error = %v", err)
+	}
+	if got.Secret != "KRSXG5CTMVRXEZLU" {
+		t.Errorf("Secret = %q, want the rotated secret", got.Secret)
+	}
+}
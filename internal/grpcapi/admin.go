@@ -0,0 +1,251 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"otp-basic/internal/auth"
+	"otp-basic/internal/grpcapi/otpv1"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+// adminServicePrefix starts the full method names of AdminService.
+var adminServicePrefix = "/" + otpv1.AdminService_ServiceDesc.ServiceName + "/"
+
+// adminService implements AdminService with an AuthManager.
+type adminService struct {
+	otpv1.UnimplementedAdminServiceServer
+	auth *auth.AuthManager
+}
+
+// ListTokens lists master tokens, optionally filtered by issuer and account name
+func (s *adminService) ListTokens(ctx context.Context, req *otpv1.ListTokensRequest) (*otpv1.ListTokensResponse, error) {
+	limit, err := listLimit(req.GetLimit())
+	if err != nil {
+		return nil, err
+	}
+	if req.GetOffset() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "offset must be a non-negative integer")
+	}
+
+	tokens, err := s.auth.ListMasterTokens(ctx, auth.MasterTokenFilter{
+		Issuer:      req.GetIssuer(),
+		AccountName: req.GetAccountName(),
+		Limit:       limit,
+		Offset:      int(req.GetOffset()),
+	})
+	if err != nil {
+		return nil, adminStatus(err, "Failed to list master tokens")
+	}
+
+	response := &otpv1.ListTokensResponse{
+		Tokens: make([]*otpv1.Token, 0, len(tokens)),
+		Limit:  int32(limit),
+		Offset: req.GetOffset(),
+	}
+	for _, token := range tokens {
+		response.Tokens = append(response.Tokens, tokenMessage(token))
+	}
+	return response, nil
+}
+
+// GetToken shows a single master token
+func (s *adminService) GetToken(ctx context.Context, req *otpv1.GetTokenRequest) (*otpv1.GetTokenResponse, error) {
+	token, err := s.auth.LookupMasterToken(ctx, req.GetId())
+	if err != nil {
+		return nil, adminStatus(err, "Failed to load master token")
+	}
+
+	remaining, err := s.auth.RecoveryCodesRemaining(ctx, token.ID)
+	if err != nil {
+		return nil, adminStatus(err, "Failed to count recovery codes")
+	}
+
+	return &otpv1.GetTokenResponse{
+		Token:                  tokenMessage(token),
+		RecoveryCodesRemaining: int32(remaining),
+	}, nil
+}
+
+// DeactivateToken disables a master token
+func (s *adminService) DeactivateToken(ctx context.Context, req *otpv1.DeactivateTokenRequest) (*otpv1.DeactivateTokenResponse, error) {
+	token, err := s.setTokenActive(ctx, req.GetId(), false)
+	if err != nil {
+		return nil, err
+	}
+	return &otpv1.DeactivateTokenResponse{Token: token}, nil
+}
+
+// ReactivateToken re-enables a previously deactivated master token
+func (s *adminService) ReactivateToken(ctx context.Context, req *otpv1.ReactivateTokenRequest) (*otpv1.ReactivateTokenResponse, error) {
+	token, err := s.setTokenActive(ctx, req.GetId(), true)
+	if err != nil {
+		return nil, err
+	}
+	return &otpv1.ReactivateTokenResponse{Token: token}, nil
+}
+
+func (s *adminService) setTokenActive(ctx context.Context, id string, active bool) (*otpv1.Token, error) {
+	token, err := s.auth.SetMasterTokenActive(ctx, id, active)
+	eventType := auth.EventDeactivation
+	if active {
+		eventType = auth.EventReactivation
+	}
+	audit(ctx, s.auth, eventType, id, err)
+	if err != nil {
+		return nil, adminStatus(err, "Failed to update master token")
+	}
+	return tokenMessage(token), nil
+}
+
+// RotateToken replaces the secret of a master token
+func (s *adminService) RotateToken(ctx context.Context, req *otpv1.RotateTokenRequest) (*otpv1.RotateTokenResponse, error) {
+	token, err := s.auth.RotateSecret(ctx, req.GetId())
+	audit(ctx, s.auth, auth.EventSecretRotation, req.GetId(), err)
+	if err != nil {
+		return nil, adminStatus(err, "Failed to rotate master token")
+	}
+
+	return &otpv1.RotateTokenResponse{
+		Token:     tokenMessage(token),
+		QrCodeUrl: auth.ProvisioningURI(token),
+		Secret:    token.Secret,
+	}, nil
+}
+
+// BindClientCert binds a master token to a TLS client certificate subject
+func (s *adminService) BindClientCert(ctx context.Context, req *otpv1.BindClientCertRequest) (*otpv1.BindClientCertResponse, error) {
+	if req.GetSubject() == "" {
+		return nil, status.Error(codes.InvalidArgument, "subject is required")
+	}
+	token, err := s.bindClientCert(ctx, req.GetId(), req.GetSubject())
+	if err != nil {
+		return nil, err
+	}
+	return &otpv1.BindClientCertResponse{Token: token}, nil
+}
+
+// UnbindClientCert removes the client certificate binding of a master token
+func (s *adminService) UnbindClientCert(ctx context.Context, req *otpv1.UnbindClientCertRequest) (*otpv1.UnbindClientCertResponse, error) {
+	token, err := s.bindClientCert(ctx, req.GetId(), "")
+	if err != nil {
+		return nil, err
+	}
+	return &otpv1.UnbindClientCertResponse{Token: token}, nil
+}
+
+func (s *adminService) bindClientCert(ctx context.Context, id, subject string) (*otpv1.Token, error) {
+	token, err := s.auth.BindClientCert(ctx, id, subject)
+	audit(ctx, s.auth, auth.EventClientCertBinding, id, err)
+	if err != nil {
+		return nil, adminStatus(err, "Failed to update client certificate binding")
+	}
+	return tokenMessage(token), nil
+}
+
+// DeleteToken removes a master token
+func (s *adminService) DeleteToken(ctx context.Context, req *otpv1.DeleteTokenRequest) (*otpv1.DeleteTokenResponse, error) {
+	err := s.auth.DeleteMasterToken(ctx, req.GetId())
+	audit(ctx, s.auth, auth.EventDeletion, req.GetId(), err)
+	if err != nil {
+		return nil, adminStatus(err, "Failed to delete master token")
+	}
+	return &otpv1.DeleteTokenResponse{}, nil
+}
+
+// ClearTokenLockout resets the failed-attempt counter of a master token
+func (s *adminService) ClearTokenLockout(_ context.Context, req *otpv1.ClearTokenLockoutRequest) (*otpv1.ClearTokenLockoutResponse, error) {
+	s.auth.ClearLockout(req.GetId(), "")
+	return &otpv1.ClearTokenLockoutResponse{}, nil
+}
+
+// ClearIPLockout resets the failed-attempt counter of a client IP
+func (s *adminService) ClearIPLockout(_ context.Context, req *otpv1.ClearIPLockoutRequest) (*otpv1.ClearIPLockoutResponse, error) {
+	s.auth.ClearLockout("", req.GetIp())
+	return &otpv1.ClearIPLockoutResponse{}, nil
+}
+
+// ListAuditEvents pages through the audit log, oldest first
+func (s *adminService) ListAuditEvents(ctx context.Context, req *otpv1.ListAuditEventsRequest) (*otpv1.ListAuditEventsResponse, error) {
+	limit, err := listLimit(req.GetLimit())
+	if err != nil {
+		return nil, err
+	}
+	if req.GetAfterId() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "after_id must be a non-negative integer")
+	}
+
+	events, err := s.auth.ListAuthEvents(ctx, req.GetAfterId(), limit)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to list audit events")
+	}
+
+	response := &otpv1.ListAuditEventsResponse{Events: make([]*otpv1.AuditEvent, 0, len(events))}
+	for _, event := range events {
+		response.Events = append(response.Events, &otpv1.AuditEvent{
+			Id:         event.ID,
+			OccurredAt: timestamppb.New(event.OccurredAt),
+			Type:       event.Type,
+			TokenId:    event.TokenID,
+			SourceIp:   event.SourceIP,
+			UserAgent:  event.UserAgent,
+			Outcome:    event.Outcome,
+			PrevHash:   event.PrevHash,
+			Hash:       event.Hash,
+		})
+	}
+	if len(events) == limit {
+		response.NextAfterId = events[len(events)-1].ID
+	}
+	return response, nil
+}
+
+// VerifyAuditLog checks the hash chain of the whole audit log
+func (s *adminService) VerifyAuditLog(ctx context.Context, _ *otpv1.VerifyAuditLogRequest) (*otpv1.VerifyAuditLogResponse, error) {
+	result, err := s.auth.VerifyAuditLog(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to verify audit log")
+	}
+
+	return &otpv1.VerifyAuditLogResponse{
+		Valid:    result.Valid,
+		Events:   result.Events,
+		HeadHash: result.HeadHash,
+		BrokenAt: result.BrokenAt,
+		Reason:   result.Reason,
+	}, nil
+}
+
+// adminStatus converts an error of a management call into a status.
+func adminStatus(err error, message string) error {
+	switch {
+	case errors.Is(err, auth.ErrTokenNotFound):
+		return status.Error(codes.NotFound, "Master token not found")
+	case errors.Is(err, auth.ErrTokenPending):
+		return status.Error(codes.FailedPrecondition, "Master token is pending confirmation")
+	case errors.Is(err, auth.ErrStorage):
+		return status.Error(codes.Unavailable, "Master token storage is temporarily unavailable")
+	default:
+		return status.Error(codes.Internal, message)
+	}
+}
+
+// listLimit applies the default page size to an unset limit.
+func listLimit(limit int32) (int, error) {
+	if limit == 0 {
+		return defaultListLimit, nil
+	}
+	if limit < 1 || limit > maxListLimit {
+		return 0, status.Error(codes.InvalidArgument, "limit must be between 1 and "+strconv.Itoa(maxListLimit))
+	}
+	return int(limit), nil
+}
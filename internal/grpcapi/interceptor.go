@@ -0,0 +1,175 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"otp-basic/internal/auth"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Metadata keys read by the interceptors. gRPC metadata keys are lowercase
+// versions of the HTTP headers used by the REST API.
+const (
+	UserIDMetadata     = "x-user-id"
+	OTPMetadata        = "x-otp"
+	AdminTokenMetadata = "x-admin-token"
+)
+
+// UnaryOTPInterceptor requires the same credentials as auth.OTPMiddleware on
+// every unary call: a session token in "authorization: Bearer" metadata, or
+// an OTP in "x-user-id" and "x-otp" metadata. Handlers get the user ID with
+// auth.UserIDFromContext, as with auth.HTTPMiddleware.
+func UnaryOTPInterceptor(am *auth.AuthManager) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		userID, err := authenticate(ctx, am)
+		if err != nil {
+			return nil, err
+		}
+		return handler(auth.ContextWithUserID(ctx, userID), req)
+	}
+}
+
+// StreamOTPInterceptor is UnaryOTPInterceptor for streaming calls. The
+// credentials are checked once, when the stream is opened.
+func StreamOTPInterceptor(am *auth.AuthManager) grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		userID, err := authenticate(stream.Context(), am)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{
+			ServerStream: stream,
+			ctx:          auth.ContextWithUserID(stream.Context(), userID),
+		})
+	}
+}
+
+// authenticatedStream carries the user ID in the context of a stream.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// authenticate checks the credentials in the metadata of a call and returns
+// the user ID, or a status error.
+func authenticate(ctx context.Context, am *auth.AuthManager) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	client := CallClientInfo(ctx)
+
+	// A session token takes precedence over OTP credentials
+	if rawToken, ok := bearerToken(md); ok {
+		userID, err := am.ValidateSession(ctx, rawToken, client)
+		if err != nil {
+			return "", sessionStatus(err)
+		}
+		return userID, nil
+	}
+
+	userID, otpCode := firstValue(md, UserIDMetadata), firstValue(md, OTPMetadata)
+	if userID == "" || otpCode == "" {
+		return "", status.Error(codes.Unauthenticated, "Missing OTP credentials. Provide x-user-id and x-otp metadata")
+	}
+	if err := am.ValidateOTP(ctx, userID, otpCode, client); err != nil {
+		return "", otpStatus(err)
+	}
+	return userID, nil
+}
+
+// adminInterceptor guards the calls of AdminService with the admin token.
+// Other calls pass through.
+func adminInterceptor(adminToken string) grpc.UnaryServerInterceptor {
+	valid := auth.AdminTokenChecker(adminToken)
+
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if strings.HasPrefix(info.FullMethod, adminServicePrefix) {
+			md, _ := metadata.FromIncomingContext(ctx)
+			if !valid(firstValue(md, AdminTokenMetadata)) {
+				return nil, status.Error(codes.Unauthenticated, "Invalid admin credentials")
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// otpStatus converts an error from ValidateOTP or ConfirmMasterToken into a
+// status, the way auth.WriteOTPError does for HTTP. Lockouts carry the wait
+// as RetryInfo.
+func otpStatus(err error) error {
+	var locked *auth.LockedError
+	switch {
+	case errors.As(err, &locked):
+		st := status.New(codes.ResourceExhausted, "Too many failed attempts, try again later")
+		if detailed, detailErr := st.WithDetails(&errdetails.RetryInfo{
+			RetryDelay: durationpb.New(locked.RetryAfter),
+		}); detailErr == nil {
+			st = detailed
+		}
+		return st.Err()
+	case errors.Is(err, auth.ErrStorage):
+		return status.Error(codes.Unavailable, "OTP validation is temporarily unavailable")
+	default:
+		return status.Error(codes.Unauthenticated, "Invalid OTP")
+	}
+}
+
+// sessionStatus converts an error from ValidateSession into a status.
+func sessionStatus(err error) error {
+	switch {
+	case errors.Is(err, auth.ErrInvalidSession):
+		return status.Error(codes.Unauthenticated, "Invalid or expired session")
+	case errors.Is(err, auth.ErrStorage):
+		return status.Error(codes.Unavailable, "Session validation is temporarily unavailable")
+	default:
+		return status.Error(codes.Internal, "Failed to validate session")
+	}
+}
+
+// CallClientInfo describes the client of a call: its IP, user agent and, on
+// mTLS connections, the subject of its verified certificate.
+func CallClientInfo(ctx context.Context) auth.ClientInfo {
+	var client auth.ClientInfo
+	if p, ok := peer.FromContext(ctx); ok {
+		if addr, ok := p.Addr.(*net.TCPAddr); ok {
+			client.IP = addr.IP.String()
+		}
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.VerifiedChains) > 0 {
+			client.CertSubject = tlsInfo.State.VerifiedChains[0][0].Subject.String()
+		}
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		client.UserAgent = firstValue(md, "user-agent")
+	}
+	return client
+}
+
+// bearerToken extracts the token from "authorization: Bearer" metadata.
+func bearerToken(md metadata.MD) (string, bool) {
+	scheme, token, ok := strings.Cut(firstValue(md, "authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+func firstValue(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
@@ -0,0 +1,143 @@
+// Package grpcapi serves the REST API over gRPC for services that prefer it,
+// and provides interceptors that let other gRPC servers require OTP
+// credentials the way the /api routes do. The service definition is
+// proto/otp/v1/otp.proto.
+package grpcapi
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"strings"
+
+	"otp-basic/internal/auth"
+	"otp-basic/internal/grpcapi/otpv1"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+)
+
+// Config holds the settings of the gRPC listener.
+type Config struct {
+	// Addr is the TCP address to listen on, such as ":9090".
+	Addr string
+	// AdminToken enables AdminService when set.
+	AdminToken string
+}
+
+// LoadConfig reads the gRPC settings from environment variables. It returns
+// nil if GRPC_ADDR is unset. AdminService shares ADMIN_TOKEN with the admin
+// REST API.
+func LoadConfig() *Config {
+	addr := os.Getenv("GRPC_ADDR")
+	if addr == "" {
+		return nil
+	}
+	return &Config{
+		Addr:       addr,
+		AdminToken: os.Getenv("ADMIN_TOKEN"),
+	}
+}
+
+// publicMethods may be called without credentials, like the public REST
+// routes. Every other OTPService method requires OTP or session credentials
+// like the /api group, so a method added to the service is protected until
+// it is listed here. AdminService is guarded by the admin token instead.
+var publicMethods = map[string]bool{
+	otpv1.OTPService_Register_FullMethodName:            true,
+	otpv1.OTPService_ConfirmRegistration_FullMethodName: true,
+	otpv1.OTPService_Validate_FullMethodName:            true,
+
+	grpc_reflection_v1.ServerReflection_ServerReflectionInfo_FullMethodName:      true,
+	grpc_reflection_v1alpha.ServerReflection_ServerReflectionInfo_FullMethodName: true,
+}
+
+// requiresOTP reports whether calls of fullMethod need OTP credentials.
+func requiresOTP(fullMethod string) bool {
+	return !publicMethods[fullMethod] && !strings.HasPrefix(fullMethod, adminServicePrefix)
+}
+
+// Server serves OTPService, and AdminService if an admin token is set.
+type Server struct {
+	cfg        *Config
+	grpcServer *grpc.Server
+}
+
+// NewServer creates a gRPC server for cfg. With a TLS configuration it
+// requires TLS.
+func NewServer(cfg *Config, am *auth.AuthManager, tlsConfig *tls.Config) *Server {
+	requireOTP, requireOTPStream := UnaryOTPInterceptor(am), StreamOTPInterceptor(am)
+	interceptors := []grpc.UnaryServerInterceptor{
+		func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if requiresOTP(info.FullMethod) {
+				return requireOTP(ctx, req, info, handler)
+			}
+			return handler(ctx, req)
+		},
+	}
+	if cfg.AdminToken != "" {
+		interceptors = append(interceptors, adminInterceptor(cfg.AdminToken))
+	}
+	streamInterceptor := func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if requiresOTP(info.FullMethod) {
+			return requireOTPStream(srv, stream, info, handler)
+		}
+		return handler(srv, stream)
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(interceptors...),
+		grpc.StreamInterceptor(streamInterceptor),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	grpcServer := grpc.NewServer(opts...)
+	otpv1.RegisterOTPServiceServer(grpcServer, &otpService{auth: am})
+	if cfg.AdminToken != "" {
+		otpv1.RegisterAdminServiceServer(grpcServer, &adminService{auth: am})
+	}
+	// Lets tools such as grpcurl discover the services
+	reflection.Register(grpcServer)
+
+	return &Server{cfg: cfg, grpcServer: grpcServer}
+}
+
+// Addr returns the configured listen address.
+func (s *Server) Addr() string {
+	return s.cfg.Addr
+}
+
+// ListenAndServe listens on the configured TCP address and serves calls
+// until Shutdown is called.
+func (s *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	return s.grpcServer.Serve(listener)
+}
+
+// Shutdown stops accepting calls and waits for calls in progress. Calls
+// still running when ctx ends are cancelled.
+func (s *Server) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.grpcServer.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.grpcServer.Stop()
+		<-done
+		return ctx.Err()
+	}
+}
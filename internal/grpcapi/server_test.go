@@ -0,0 +1,362 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"otp-basic/internal/auth"
+	"otp-basic/internal/database"
+	"otp-basic/internal/grpcapi/otpv1"
+
+	"github.com/pquerna/otp/totp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const testAdminToken = "test-admin-token"
+
+// dial serves grpcServer on an in-memory listener and returns a client
+// connection to it.
+func dial(t *testing.T, grpcServer *grpc.Server) *grpc.ClientConn {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// startServer serves the API of am, with AdminService enabled if
+// adminToken is set.
+func startServer(t *testing.T, am *auth.AuthManager, adminToken string) *grpc.ClientConn {
+	t.Helper()
+	server := NewServer(&Config{Addr: "bufnet", AdminToken: adminToken}, am, nil)
+	return dial(t, server.grpcServer)
+}
+
+// registerActiveToken registers and confirms a token. The confirmation uses
+// the code of the previous time step so the current one is still unused.
+func registerActiveToken(t *testing.T, am *auth.AuthManager) *auth.MasterToken {
+	t.Helper()
+	token, err := am.RegisterMasterToken(context.Background(), "TestApp", "alice", auth.DefaultTokenOptions())
+	if err != nil {
+		t.Fatalf("Failed to register master token: %v", err)
+	}
+	code, err := totp.GenerateCode(token.Secret, time.Now().Add(-30*time.Second))
+	if err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+	if err := am.ConfirmMasterToken(context.Background(), token.ID, code, auth.ClientInfo{IP: "192.0.2.1"}); err != nil {
+		t.Fatalf("Failed to confirm master token: %v", err)
+	}
+	return token
+}
+
+func currentCode(t *testing.T, token *auth.MasterToken) string {
+	t.Helper()
+	code, err := totp.GenerateCode(token.Secret, time.Now())
+	if err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+	return code
+}
+
+// withMetadata returns a context sending the key-value pairs as metadata.
+func withMetadata(pairs ...string) context.Context {
+	return metadata.NewOutgoingContext(context.Background(), metadata.Pairs(pairs...))
+}
+
+func TestOTPService_PublicMethods(t *testing.T) {
+	am := auth.NewAuthManager(database.NewMemoryStore())
+	client := otpv1.NewOTPServiceClient(startServer(t, am, ""))
+	ctx := context.Background()
+
+	registered, err := client.Register(ctx, &otpv1.RegisterRequest{Issuer: "TestApp", AccountName: "bob"})
+	if err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	if registered.GetSecret() == "" || !registered.GetToken().GetPending() {
+		t.Errorf("Register() = %v, want a pending token with its secret", registered)
+	}
+
+	token := registerActiveToken(t, am)
+	response, err := client.Validate(ctx, &otpv1.ValidateRequest{UserId: token.ID, Otp: currentCode(t, token)})
+	if err != nil || !response.GetValid() {
+		t.Errorf("Validate() = %v, %v, want valid", response, err)
+	}
+	response, err = client.Validate(ctx, &otpv1.ValidateRequest{UserId: token.ID, Otp: "000000"})
+	if err != nil || response.GetValid() {
+		t.Errorf("Validate() with a wrong OTP = %v, %v, want invalid", response, err)
+	}
+}
+
+func TestOTPService_GetStatusRequiresCredentials(t *testing.T) {
+	t.Setenv("LOCKOUT_BACKOFF_BASE", "1ns")
+	am := auth.NewAuthManager(database.NewMemoryStore())
+	token := registerActiveToken(t, am)
+	client := otpv1.NewOTPServiceClient(startServer(t, am, ""))
+
+	tests := []struct {
+		name     string
+		ctx      func() context.Context
+		wantCode codes.Code
+	}{
+		{
+			name:     "no credentials",
+			ctx:      context.Background,
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:     "wrong OTP",
+			ctx:      func() context.Context { return withMetadata(UserIDMetadata, token.ID, OTPMetadata, "000000") },
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:     "invalid session",
+			ctx:      func() context.Context { return withMetadata("authorization", "Bearer not-a-session") },
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name: "OTP",
+			ctx: func() context.Context {
+				return withMetadata(UserIDMetadata, token.ID, OTPMetadata, currentCode(t, token))
+			},
+			wantCode: codes.OK,
+		},
+		{
+			name: "session",
+			ctx: func() context.Context {
+				rawToken, _, err := am.IssueSession(context.Background(), token.ID)
+				if err != nil {
+					t.Fatalf("IssueSession() error = %v", err)
+				}
+				return withMetadata("authorization", "Bearer "+rawToken)
+			},
+			wantCode: codes.OK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			time.Sleep(time.Millisecond)
+			response, err := client.GetStatus(tt.ctx(), &otpv1.GetStatusRequest{})
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("GetStatus() error = %v, want %s", err, tt.wantCode)
+			}
+			if tt.wantCode == codes.OK && response.GetUserId() != token.ID {
+				t.Errorf("GetStatus() user ID = %q, want %q", response.GetUserId(), token.ID)
+			}
+		})
+	}
+}
+
+func TestAdminService_RequiresAdminToken(t *testing.T) {
+	am := auth.NewAuthManager(database.NewMemoryStore())
+	token := registerActiveToken(t, am)
+	client := otpv1.NewAdminServiceClient(startServer(t, am, testAdminToken))
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		wantCode codes.Code
+	}{
+		{name: "no admin token", ctx: context.Background(), wantCode: codes.Unauthenticated},
+		{name: "wrong admin token", ctx: withMetadata(AdminTokenMetadata, "wrong"), wantCode: codes.Unauthenticated},
+		{
+			// User credentials don't grant admin access
+			name:     "user OTP",
+			ctx:      withMetadata(UserIDMetadata, token.ID, OTPMetadata, currentCode(t, token)),
+			wantCode: codes.Unauthenticated,
+		},
+		{name: "admin token", ctx: withMetadata(AdminTokenMetadata, testAdminToken), wantCode: codes.OK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := client.GetToken(tt.ctx, &otpv1.GetTokenRequest{Id: token.ID})
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("GetToken() error = %v, want %s", err, tt.wantCode)
+			}
+			if tt.wantCode == codes.OK && response.GetToken().GetId() != token.ID {
+				t.Errorf("GetToken() = %v, want token %s", response, token.ID)
+			}
+		})
+	}
+}
+
+// unavailableStore fails every token read, like a database that is down.
+type unavailableStore struct {
+	*database.MemoryStore
+}
+
+func (unavailableStore) GetMasterToken(context.Context, string) (*auth.MasterToken, error) {
+	return nil, errors.New("connection refused")
+}
+
+func (unavailableStore) ListMasterTokens(context.Context, auth.MasterTokenFilter) ([]*auth.MasterToken, error) {
+	return nil, errors.New("connection refused")
+}
+
+// recoveryCodesUnavailableStore only fails to count recovery codes.
+type recoveryCodesUnavailableStore struct {
+	*database.MemoryStore
+}
+
+func (recoveryCodesUnavailableStore) CountUnusedRecoveryCodes(context.Context, string) (int, error) {
+	return 0, errors.New("connection refused")
+}
+
+func TestAdminService_StorageErrors(t *testing.T) {
+	am := auth.NewAuthManager(unavailableStore{database.NewMemoryStore()})
+	client := otpv1.NewAdminServiceClient(startServer(t, am, testAdminToken))
+	adminCtx := withMetadata(AdminTokenMetadata, testAdminToken)
+
+	_, err := client.GetToken(adminCtx, &otpv1.GetTokenRequest{Id: "some-user"})
+	if code := status.Code(err); code != codes.Unavailable {
+		t.Errorf("GetToken() error = %v, want %s rather than %s", err, codes.Unavailable, codes.NotFound)
+	}
+	_, err = client.ListTokens(adminCtx, &otpv1.ListTokensRequest{})
+	if code := status.Code(err); code != codes.Unavailable {
+		t.Errorf("ListTokens() error = %v, want %s", err, codes.Unavailable)
+	}
+
+	am = auth.NewAuthManager(recoveryCodesUnavailableStore{database.NewMemoryStore()})
+	token := registerActiveToken(t, am)
+	client = otpv1.NewAdminServiceClient(startServer(t, am, testAdminToken))
+
+	_, err = client.GetToken(adminCtx, &otpv1.GetTokenRequest{Id: token.ID})
+	if code := status.Code(err); code != codes.Unavailable {
+		t.Errorf("GetToken() error = %v, want %s when recovery codes can't be counted", err, codes.Unavailable)
+	}
+}
+
+func TestAdminService_DisabledWithoutAdminToken(t *testing.T) {
+	am := auth.NewAuthManager(database.NewMemoryStore())
+	client := otpv1.NewAdminServiceClient(startServer(t, am, ""))
+
+	_, err := client.ListTokens(withMetadata(AdminTokenMetadata, ""), &otpv1.ListTokensRequest{})
+	if code := status.Code(err); code != codes.Unimplemented {
+		t.Errorf("ListTokens() error = %v, want %s", err, codes.Unimplemented)
+	}
+}
+
+func TestRequiresOTP(t *testing.T) {
+	// Every OTPService method is either public or protected on purpose
+	for _, method := range otpv1.OTPService_ServiceDesc.Methods {
+		fullMethod := "/" + otpv1.OTPService_ServiceDesc.ServiceName + "/" + method.MethodName
+		want := fullMethod == otpv1.OTPService_GetStatus_FullMethodName
+		if got := requiresOTP(fullMethod); got != want {
+			t.Errorf("requiresOTP(%s) = %v, want %v", fullMethod, got, want)
+		}
+	}
+	for _, method := range otpv1.AdminService_ServiceDesc.Methods {
+		fullMethod := adminServicePrefix + method.MethodName
+		if requiresOTP(fullMethod) {
+			t.Errorf("requiresOTP(%s) = true, want the admin token only", fullMethod)
+		}
+	}
+	// Methods not listed are protected
+	if !requiresOTP("/otp.v1.OTPService/Unlisted") {
+		t.Error("Expected unlisted methods to require OTP credentials")
+	}
+}
+
+func TestServer_ReflectionIsPublic(t *testing.T) {
+	am := auth.NewAuthManager(database.NewMemoryStore())
+	client := grpc_reflection_v1.NewServerReflectionClient(startServer(t, am, ""))
+
+	stream, err := client.ServerReflectionInfo(context.Background())
+	if err != nil {
+		t.Fatalf("ServerReflectionInfo() error = %v", err)
+	}
+	err = stream.Send(&grpc_reflection_v1.ServerReflectionRequest{
+		MessageRequest: &grpc_reflection_v1.ServerReflectionRequest_ListServices{},
+	})
+	if err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	response, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv() error = %v", err)
+	}
+	if len(response.GetListServicesResponse().GetService()) == 0 {
+		t.Errorf("Expected reflection to list the services, got %v", response)
+	}
+}
+
+// streamUserIDTrailer is the trailer the test stream handler returns the
+// authenticated user ID in.
+const streamUserIDTrailer = "authenticated-user-id"
+
+// startStreamServer serves a stream method behind StreamOTPInterceptor, as
+// another gRPC server using the interceptor would, and returns a function
+// that opens it and reports the user ID the handler saw.
+func startStreamServer(t *testing.T, am *auth.AuthManager) func(ctx context.Context) (string, error) {
+	t.Helper()
+	server := grpc.NewServer(grpc.StreamInterceptor(StreamOTPInterceptor(am)))
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "test.Watcher",
+		HandlerType: (*any)(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "Watch",
+			ServerStreams: true,
+			Handler: func(_ any, stream grpc.ServerStream) error {
+				userID, _ := auth.UserIDFromContext(stream.Context())
+				stream.SetTrailer(metadata.Pairs(streamUserIDTrailer, userID))
+				return nil
+			},
+		}},
+	}, nil)
+	conn := dial(t, server)
+
+	return func(ctx context.Context) (string, error) {
+		stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, "/test.Watcher/Watch")
+		if err != nil {
+			return "", err
+		}
+		if err := stream.CloseSend(); err != nil {
+			return "", err
+		}
+		if err := stream.RecvMsg(&emptypb.Empty{}); !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		return firstValue(stream.Trailer(), streamUserIDTrailer), nil
+	}
+}
+
+func TestStreamOTPInterceptor(t *testing.T) {
+	am := auth.NewAuthManager(database.NewMemoryStore())
+	token := registerActiveToken(t, am)
+	watch := startStreamServer(t, am)
+
+	if _, err := watch(context.Background()); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Stream without credentials error = %v, want %s", err, codes.Unauthenticated)
+	}
+
+	userID, err := watch(withMetadata(UserIDMetadata, token.ID, OTPMetadata, currentCode(t, token)))
+	if err != nil {
+		t.Fatalf("Stream with OTP error = %v", err)
+	}
+	if userID != token.ID {
+		t.Errorf("Stream handler saw user ID %q, want %q", userID, token.ID)
+	}
+}
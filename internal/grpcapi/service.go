@@ -0,0 +1,165 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"otp-basic/internal/auth"
+	"otp-basic/internal/grpcapi/otpv1"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// otpService implements OTPService with an AuthManager.
+type otpService struct {
+	otpv1.UnimplementedOTPServiceServer
+	auth *auth.AuthManager
+}
+
+// Register creates a pending master token and returns OTP setup info
+func (s *otpService) Register(ctx context.Context, req *otpv1.RegisterRequest) (*otpv1.RegisterResponse, error) {
+	if req.GetIssuer() == "" || req.GetAccountName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "issuer and account_name are required")
+	}
+
+	token, err := s.auth.RegisterMasterToken(ctx, req.GetIssuer(), req.GetAccountName(), registerOptions(req))
+	var tokenID string
+	if err == nil {
+		tokenID = token.ID
+	}
+	audit(ctx, s.auth, auth.EventRegistration, tokenID, err)
+	if errors.Is(err, auth.ErrInvalidTokenOptions) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to register master token")
+	}
+
+	qrURL, err := s.auth.GetQRCodeURL(ctx, token.ID, req.GetIssuer(), req.GetAccountName())
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to generate QR code")
+	}
+
+	recoveryCodes, err := s.auth.GenerateRecoveryCodes(ctx, token.ID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to generate recovery codes")
+	}
+
+	return &otpv1.RegisterResponse{
+		Token:         tokenMessage(token),
+		QrCodeUrl:     qrURL,
+		Secret:        token.Secret,
+		RecoveryCodes: recoveryCodes,
+	}, nil
+}
+
+// registerOptions applies the optional OTP parameters of the request on top
+// of the defaults.
+func registerOptions(req *otpv1.RegisterRequest) auth.TokenOptions {
+	opts := auth.DefaultTokenOptions()
+	if req.GetType() != "" {
+		opts.Type = strings.ToLower(req.GetType())
+	}
+	if req.GetAlgorithm() != "" {
+		opts.Algorithm = strings.ToUpper(req.GetAlgorithm())
+	}
+	if req.GetDigits() != 0 {
+		opts.Digits = int(req.GetDigits())
+	}
+	if req.GetPeriod() != 0 {
+		opts.Period = int(req.GetPeriod())
+	}
+	if req.Skew != nil {
+		opts.Skew = int(req.GetSkew())
+	}
+	return opts
+}
+
+// ConfirmRegistration activates a pending master token with its first code.
+// A rejected code is answered with confirmed set to false.
+func (s *otpService) ConfirmRegistration(ctx context.Context, req *otpv1.ConfirmRegistrationRequest) (*otpv1.ConfirmRegistrationResponse, error) {
+	if err := s.auth.ConfirmMasterToken(ctx, req.GetUserId(), req.GetOtp(), CallClientInfo(ctx)); err != nil {
+		if st := otpStatus(err); status.Code(st) != codes.Unauthenticated {
+			return nil, st
+		}
+		return &otpv1.ConfirmRegistrationResponse{Confirmed: false}, nil
+	}
+	return &otpv1.ConfirmRegistrationResponse{Confirmed: true}, nil
+}
+
+// Validate validates an OTP code for a user. A rejected code is answered
+// with valid set to false; lockouts and storage failures are errors.
+func (s *otpService) Validate(ctx context.Context, req *otpv1.ValidateRequest) (*otpv1.ValidateResponse, error) {
+	if err := s.auth.ValidateOTP(ctx, req.GetUserId(), req.GetOtp(), CallClientInfo(ctx)); err != nil {
+		if st := otpStatus(err); status.Code(st) != codes.Unauthenticated {
+			return nil, st
+		}
+		return &otpv1.ValidateResponse{Valid: false}, nil
+	}
+	return &otpv1.ValidateResponse{Valid: true}, nil
+}
+
+// GetStatus returns the status of the authenticated user
+func (s *otpService) GetStatus(ctx context.Context, _ *otpv1.GetStatusRequest) (*otpv1.GetStatusResponse, error) {
+	userID, exists := auth.UserIDFromContext(ctx)
+	if !exists {
+		return nil, status.Error(codes.Internal, "User ID not found in context")
+	}
+
+	token, exists := s.auth.GetMasterToken(ctx, userID)
+	if !exists {
+		return nil, status.Error(codes.NotFound, "Master token not found")
+	}
+
+	return &otpv1.GetStatusResponse{
+		Status:    "authenticated",
+		UserId:    userID,
+		CreatedAt: timestamppb.New(token.CreatedAt),
+		IsActive:  token.IsActive,
+		Timestamp: timestamppb.New(time.Now()),
+	}, nil
+}
+
+// audit records an enrollment or admin action on tokenID in the audit log,
+// as a failure if err is not nil.
+func audit(ctx context.Context, am *auth.AuthManager, eventType, tokenID string, err error) {
+	outcome := auth.EventOutcomeSuccess
+	if err != nil {
+		outcome = auth.EventOutcomeFailure
+	}
+	am.RecordEvent(ctx, eventType, tokenID, CallClientInfo(ctx), outcome)
+}
+
+// tokenMessage converts a master token to its protobuf form, without the
+// secret.
+func tokenMessage(token *auth.MasterToken) *otpv1.Token {
+	message := &otpv1.Token{
+		Id:        token.ID,
+		CreatedAt: timestamppb.New(token.CreatedAt),
+		IsActive:  token.IsActive,
+		Pending:   token.IsPending(),
+		Type:      token.Type,
+		Algorithm: token.Algorithm,
+		Digits:    int32(token.Digits),
+		Period:    int32(token.Period),
+		Skew:      int32(token.Skew),
+		Counter:   token.Counter,
+	}
+	if token.ConfirmedAt != nil {
+		message.ConfirmedAt = timestamppb.New(*token.ConfirmedAt)
+	}
+	if token.Issuer != nil {
+		message.Issuer = *token.Issuer
+	}
+	if token.AccountName != nil {
+		message.AccountName = *token.AccountName
+	}
+	if token.ClientCertSubject != nil {
+		message.ClientCertSubject = *token.ClientCertSubject
+	}
+	return message
+}
@@ -0,0 +1,357 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"otp-basic/internal/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+// TokenView is the admin representation of a master token. It deliberately
+// has no secret field.
+type TokenView struct {
+	ID                string     `json:"id"`
+	CreatedAt         time.Time  `json:"created_at"`
+	ConfirmedAt       *time.Time `json:"confirmed_at,omitempty"`
+	IsActive          bool       `json:"is_active"`
+	Pending           bool       `json:"pending"`
+	Issuer            *string    `json:"issuer,omitempty"`
+	AccountName       *string    `json:"account_name,omitempty"`
+	Type              string     `json:"type"`
+	Algorithm         string     `json:"algorithm"`
+	Digits            int        `json:"digits"`
+	Period            int        `json:"period"`
+	Skew              int        `json:"skew"`
+	Counter           int64      `json:"counter"`
+	ClientCertSubject *string    `json:"client_cert_subject,omitempty"`
+}
+
+type TokenDetailResponse struct {
+	Token                  TokenView `json:"token"`
+	RecoveryCodesRemaining int       `json:"recovery_codes_remaining"`
+}
+
+type ListTokensResponse struct {
+	Tokens []TokenView `json:"tokens"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+}
+
+type BindClientCertRequest struct {
+	Subject string `json:"subject" binding:"required"`
+}
+
+type RotateResponse struct {
+	Token     TokenView `json:"token"`
+	QRCodeURL string    `json:"qr_code_url"`
+	Secret    string    `json:"secret"`
+}
+
+// AuditEventView is the admin representation of an audit log entry.
+type AuditEventView struct {
+	ID         int64     `json:"id"`
+	OccurredAt time.Time `json:"occurred_at"`
+	Type       string    `json:"type"`
+	TokenID    string    `json:"token_id,omitempty"`
+	SourceIP   string    `json:"source_ip,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	Outcome    string    `json:"outcome"`
+	PrevHash   string    `json:"prev_hash"`
+	Hash       string    `json:"hash"`
+}
+
+type ListAuditEventsResponse struct {
+	Events []AuditEventView `json:"events"`
+	// NextAfterID continues the listing; it is omitted on the last page.
+	NextAfterID int64 `json:"next_after_id,omitempty"`
+}
+
+type AuditVerificationResponse struct {
+	Valid    bool   `json:"valid"`
+	Events   int64  `json:"events"`
+	HeadHash string `json:"head_hash"`
+	BrokenAt int64  `json:"broken_at,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+func newTokenView(token *auth.MasterToken) TokenView {
+	return TokenView{
+		ID:                token.ID,
+		CreatedAt:         token.CreatedAt,
+		ConfirmedAt:       token.ConfirmedAt,
+		IsActive:          token.IsActive,
+		Pending:           token.IsPending(),
+		Issuer:            token.Issuer,
+		AccountName:       token.AccountName,
+		Type:              token.Type,
+		Algorithm:         token.Algorithm,
+		Digits:            token.Digits,
+		Period:            token.Period,
+		Skew:              token.Skew,
+		Counter:           token.Counter,
+		ClientCertSubject: token.ClientCertSubject,
+	}
+}
+
+// ListTokens lists master tokens, optionally filtered by issuer and account name
+func (h *Handler) ListTokens(c *gin.Context) {
+	limit, err := queryInt(c, "limit", defaultListLimit)
+	if err != nil || limit < 1 || limit > maxListLimit {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "limit must be between 1 and " + strconv.Itoa(maxListLimit),
+		})
+		return
+	}
+	offset, err := queryInt(c, "offset", 0)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "offset must be a non-negative integer",
+		})
+		return
+	}
+
+	tokens, err := h.auth.ListMasterTokens(c.Request.Context(), auth.MasterTokenFilter{
+		Issuer:      c.Query("issuer"),
+		AccountName: c.Query("account_name"),
+		Limit:       limit,
+		Offset:      offset,
+	})
+	if err != nil {
+		respondAdminError(c, err, "Failed to list master tokens")
+		return
+	}
+
+	views := make([]TokenView, 0, len(tokens))
+	for _, token := range tokens {
+		views = append(views, newTokenView(token))
+	}
+
+	c.JSON(http.StatusOK, ListTokensResponse{
+		Tokens: views,
+		Limit:  limit,
+		Offset: offset,
+	})
+}
+
+// GetToken shows a single master token
+func (h *Handler) GetToken(c *gin.Context) {
+	token, err := h.auth.LookupMasterToken(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondAdminError(c, err, "Failed to load master token")
+		return
+	}
+
+	remaining, err := h.auth.RecoveryCodesRemaining(c.Request.Context(), token.ID)
+	if err != nil {
+		respondAdminError(c, err, "Failed to count recovery codes")
+		return
+	}
+
+	c.JSON(http.StatusOK, TokenDetailResponse{
+		Token:                  newTokenView(token),
+		RecoveryCodesRemaining: remaining,
+	})
+}
+
+// DeactivateToken disables a master token
+func (h *Handler) DeactivateToken(c *gin.Context) {
+	h.setTokenActive(c, false)
+}
+
+// ReactivateToken re-enables a previously deactivated master token
+func (h *Handler) ReactivateToken(c *gin.Context) {
+	h.setTokenActive(c, true)
+}
+
+func (h *Handler) setTokenActive(c *gin.Context, active bool) {
+	token, err := h.auth.SetMasterTokenActive(c.Request.Context(), c.Param("id"), active)
+	eventType := auth.EventDeactivation
+	if active {
+		eventType = auth.EventReactivation
+	}
+	h.audit(c, eventType, c.Param("id"), err)
+	if err != nil {
+		respondAdminError(c, err, "Failed to update master token")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token": newTokenView(token),
+	})
+}
+
+// DeleteToken removes a master token
+func (h *Handler) DeleteToken(c *gin.Context) {
+	err := h.auth.DeleteMasterToken(c.Request.Context(), c.Param("id"))
+	h.audit(c, auth.EventDeletion, c.Param("id"), err)
+	if err != nil {
+		respondAdminError(c, err, "Failed to delete master token")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// RotateToken replaces the secret of a master token. Unlike every other
+// admin response this one carries the new secret, since the token has to be
+// enrolled again with it.
+func (h *Handler) RotateToken(c *gin.Context) {
+	token, err := h.auth.RotateSecret(c.Request.Context(), c.Param("id"))
+	h.audit(c, auth.EventSecretRotation, c.Param("id"), err)
+	if err != nil {
+		respondAdminError(c, err, "Failed to rotate master token")
+		return
+	}
+
+	c.JSON(http.StatusOK, RotateResponse{
+		Token:     newTokenView(token),
+		QRCodeURL: auth.ProvisioningURI(token),
+		Secret:    token.Secret,
+	})
+}
+
+// BindClientCert binds a master token to a TLS client certificate subject
+func (h *Handler) BindClientCert(c *gin.Context) {
+	var req BindClientCertRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	h.bindClientCert(c, req.Subject)
+}
+
+// UnbindClientCert removes the client certificate binding of a master token
+func (h *Handler) UnbindClientCert(c *gin.Context) {
+	h.bindClientCert(c, "")
+}
+
+func (h *Handler) bindClientCert(c *gin.Context, subject string) {
+	token, err := h.auth.BindClientCert(c.Request.Context(), c.Param("id"), subject)
+	h.audit(c, auth.EventClientCertBinding, c.Param("id"), err)
+	if err != nil {
+		respondAdminError(c, err, "Failed to update client certificate binding")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token": newTokenView(token),
+	})
+}
+
+// ListAuditEvents pages through the audit log, oldest first
+func (h *Handler) ListAuditEvents(c *gin.Context) {
+	limit, err := queryInt(c, "limit", defaultListLimit)
+	if err != nil || limit < 1 || limit > maxListLimit {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "limit must be between 1 and " + strconv.Itoa(maxListLimit),
+		})
+		return
+	}
+	afterID, err := strconv.ParseInt(c.DefaultQuery("after_id", "0"), 10, 64)
+	if err != nil || afterID < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "after_id must be a non-negative integer",
+		})
+		return
+	}
+
+	events, err := h.auth.ListAuthEvents(c.Request.Context(), afterID, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to list audit events",
+		})
+		return
+	}
+
+	response := ListAuditEventsResponse{Events: make([]AuditEventView, 0, len(events))}
+	for _, event := range events {
+		response.Events = append(response.Events, AuditEventView{
+			ID:         event.ID,
+			OccurredAt: event.OccurredAt,
+			Type:       event.Type,
+			TokenID:    event.TokenID,
+			SourceIP:   event.SourceIP,
+			UserAgent:  event.UserAgent,
+			Outcome:    event.Outcome,
+			PrevHash:   event.PrevHash,
+			Hash:       event.Hash,
+		})
+	}
+	if len(events) == limit {
+		response.NextAfterID = events[len(events)-1].ID
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// VerifyAuditLog checks the hash chain of the whole audit log
+func (h *Handler) VerifyAuditLog(c *gin.Context) {
+	result, err := h.auth.VerifyAuditLog(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to verify audit log",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, AuditVerificationResponse{
+		Valid:    result.Valid,
+		Events:   result.Events,
+		HeadHash: result.HeadHash,
+		BrokenAt: result.BrokenAt,
+		Reason:   result.Reason,
+	})
+}
+
+// ClearTokenLockout resets the failed-attempt counter of a master token
+func (h *Handler) ClearTokenLockout(c *gin.Context) {
+	h.auth.ClearLockout(c.Param("id"), "")
+	c.Status(http.StatusNoContent)
+}
+
+// ClearIPLockout resets the failed-attempt counter of a client IP
+func (h *Handler) ClearIPLockout(c *gin.Context) {
+	h.auth.ClearLockout("", c.Param("ip"))
+	c.Status(http.StatusNoContent)
+}
+
+func respondAdminError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, auth.ErrTokenNotFound):
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Master token not found",
+		})
+	case errors.Is(err, auth.ErrTokenPending):
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Master token is pending confirmation",
+		})
+	case errors.Is(err, auth.ErrStorage):
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": "Master token storage is temporarily unavailable",
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": message,
+		})
+	}
+}
+
+func queryInt(c *gin.Context, key string, defaultValue int) (int, error) {
+	value := c.Query(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(value)
+}
@@ -1,7 +1,9 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
+	"strings"
 	"time"
 
 	"otp-basic/internal/auth"
@@ -22,12 +24,51 @@ func NewHandler(auth *auth.AuthManager) *Handler {
 type RegisterRequest struct {
 	Issuer      string `json:"issuer" binding:"required"`
 	AccountName string `json:"account_name" binding:"required"`
+	Type        string `json:"type"`
+	Algorithm   string `json:"algorithm"`
+	Digits      int    `json:"digits"`
+	Period      int    `json:"period"`
+	Skew        *int   `json:"skew"`
+}
+
+// tokenOptions applies the optional OTP parameters of the request on top of
+// the defaults.
+func (r RegisterRequest) tokenOptions() auth.TokenOptions {
+	opts := auth.DefaultTokenOptions()
+	if r.Type != "" {
+		opts.Type = strings.ToLower(r.Type)
+	}
+	if r.Algorithm != "" {
+		opts.Algorithm = strings.ToUpper(r.Algorithm)
+	}
+	if r.Digits != 0 {
+		opts.Digits = r.Digits
+	}
+	if r.Period != 0 {
+		opts.Period = r.Period
+	}
+	if r.Skew != nil {
+		opts.Skew = *r.Skew
+	}
+	return opts
 }
 
 type RegisterResponse struct {
-	MasterToken *auth.MasterToken `json:"master_token"`
-	QRCodeURL   string            `json:"qr_code_url"`
-	Secret      string            `json:"secret"`
+	MasterToken   *auth.MasterToken `json:"master_token"`
+	QRCodeURL     string            `json:"qr_code_url"`
+	Secret        string            `json:"secret"`
+	RecoveryCodes []string          `json:"recovery_codes"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+	Remaining     int      `json:"remaining"`
+}
+
+// RegenerateRecoveryCodesRequest carries the code that confirms a
+// regeneration requested with a session token.
+type RegenerateRecoveryCodesRequest struct {
+	OTP string `json:"otp"`
 }
 
 type ValidateOTPRequest struct {
@@ -39,6 +80,15 @@ type ValidateOTPResponse struct {
 	Valid bool `json:"valid"`
 }
 
+type ConfirmRequest struct {
+	UserID string `json:"user_id" binding:"required"`
+	OTP    string `json:"otp" binding:"required"`
+}
+
+type ConfirmResponse struct {
+	Confirmed bool `json:"confirmed"`
+}
+
 // RegisterMasterToken registers a new master token and returns OTP setup info
 func (h *Handler) RegisterMasterToken(c *gin.Context) {
 	var req RegisterRequest
@@ -50,7 +100,18 @@ func (h *Handler) RegisterMasterToken(c *gin.Context) {
 	}
 
 	// Register new master token
-	token, err := h.auth.RegisterMasterToken(req.Issuer, req.AccountName)
+	token, err := h.auth.RegisterMasterToken(c.Request.Context(), req.Issuer, req.AccountName, req.tokenOptions())
+	var tokenID string
+	if err == nil {
+		tokenID = token.ID
+	}
+	h.audit(c, auth.EventRegistration, tokenID, err)
+	if errors.Is(err, auth.ErrInvalidTokenOptions) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Failed to register master token",
@@ -59,7 +120,7 @@ func (h *Handler) RegisterMasterToken(c *gin.Context) {
 	}
 
 	// Generate QR code URL
-	qrURL, err := h.auth.GetQRCodeURL(token.ID, req.Issuer, req.AccountName)
+	qrURL, err := h.auth.GetQRCodeURL(c.Request.Context(), token.ID, req.Issuer, req.AccountName)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Failed to generate QR code",
@@ -67,15 +128,46 @@ func (h *Handler) RegisterMasterToken(c *gin.Context) {
 		return
 	}
 
+	recoveryCodes, err := h.auth.GenerateRecoveryCodes(c.Request.Context(), token.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to generate recovery codes",
+		})
+		return
+	}
+
 	response := RegisterResponse{
-		MasterToken: token,
-		QRCodeURL:   qrURL,
-		Secret:      token.Secret,
+		MasterToken:   token,
+		QRCodeURL:     qrURL,
+		Secret:        token.Secret,
+		RecoveryCodes: recoveryCodes,
 	}
 
 	c.JSON(http.StatusCreated, response)
 }
 
+// ConfirmMasterToken activates a pending master token with its first code
+func (h *Handler) ConfirmMasterToken(c *gin.Context) {
+	var req ConfirmRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	if err := h.auth.ConfirmMasterToken(c.Request.Context(), req.UserID, req.OTP, auth.RequestClientInfo(c)); err != nil {
+		auth.WriteOTPError(c, err, ConfirmResponse{
+			Confirmed: false,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ConfirmResponse{
+		Confirmed: true,
+	})
+}
+
 // ValidateOTP validates an OTP code for a user
 func (h *Handler) ValidateOTP(c *gin.Context) {
 	var req ValidateOTPRequest
@@ -86,17 +178,26 @@ func (h *Handler) ValidateOTP(c *gin.Context) {
 		return
 	}
 
-	valid := h.auth.ValidateOTP(req.UserID, req.OTP)
-	response := ValidateOTPResponse{
-		Valid: valid,
+	if err := h.auth.ValidateOTP(c.Request.Context(), req.UserID, req.OTP, auth.RequestClientInfo(c)); err != nil {
+		auth.WriteOTPError(c, err, ValidateOTPResponse{
+			Valid: false,
+		})
+		return
 	}
 
-	status := http.StatusOK
-	if !valid {
-		status = http.StatusUnauthorized
-	}
+	c.JSON(http.StatusOK, ValidateOTPResponse{
+		Valid: true,
+	})
+}
 
-	c.JSON(status, response)
+// audit records an enrollment or admin action on tokenID in the audit log,
+// as a failure if err is not nil.
+func (h *Handler) audit(c *gin.Context, eventType, tokenID string, err error) {
+	outcome := auth.EventOutcomeSuccess
+	if err != nil {
+		outcome = auth.EventOutcomeFailure
+	}
+	h.auth.RecordEvent(c.Request.Context(), eventType, tokenID, auth.RequestClientInfo(c), outcome)
 }
 
 // GetStatus returns the current server status (protected endpoint)
@@ -109,7 +210,7 @@ func (h *Handler) GetStatus(c *gin.Context) {
 		return
 	}
 
-	token, exists := h.auth.GetMasterToken(userID)
+	token, exists := h.auth.GetMasterToken(c.Request.Context(), userID)
 	if !exists {
 		c.JSON(http.StatusNotFound, gin.H{
 			"error": "Master token not found",
@@ -126,6 +227,71 @@ func (h *Handler) GetStatus(c *gin.Context) {
 	})
 }
 
+// GetRecoveryCodes reports how many recovery codes the user has left
+func (h *Handler) GetRecoveryCodes(c *gin.Context) {
+	userID, exists := auth.GetUserIDFromContext(c)
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "User ID not found in context",
+		})
+		return
+	}
+
+	remaining, err := h.auth.RecoveryCodesRemaining(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to count recovery codes",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, RecoveryCodesResponse{
+		Remaining: remaining,
+	})
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes with a new set.
+// A session token alone isn't enough: unless the request was authenticated
+// with an OTP, the body must carry a current OTP or unused recovery code.
+func (h *Handler) RegenerateRecoveryCodes(c *gin.Context) {
+	userID, exists := auth.GetUserIDFromContext(c)
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "User ID not found in context",
+		})
+		return
+	}
+
+	if !auth.OTPVerifiedFromContext(c.Request.Context()) {
+		var req RegenerateRecoveryCodesRequest
+		if err := c.ShouldBindJSON(&req); err != nil || req.OTP == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "A current OTP or recovery code is required in the otp field",
+			})
+			return
+		}
+		if err := h.auth.ValidateOTP(c.Request.Context(), userID, req.OTP, auth.RequestClientInfo(c)); err != nil {
+			auth.WriteOTPError(c, err, gin.H{
+				"error": "Invalid OTP",
+			})
+			return
+		}
+	}
+
+	codes, err := h.auth.GenerateRecoveryCodes(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to generate recovery codes",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, RecoveryCodesResponse{
+		RecoveryCodes: codes,
+		Remaining:     len(codes),
+	})
+}
+
 // GetProtectedData returns some protected data (example endpoint)
 func (h *Handler) GetProtectedData(c *gin.Context) {
 	userID, exists := auth.GetUserIDFromContext(c)
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"otp-basic/internal/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+type SessionResponse struct {
+	SessionToken string    `json:"session_token"`
+	TokenType    string    `json:"token_type"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+func newSessionResponse(rawToken string, session *auth.Session) SessionResponse {
+	return SessionResponse{
+		SessionToken: rawToken,
+		TokenType:    "Bearer",
+		ExpiresAt:    session.ExpiresAt,
+	}
+}
+
+// CreateSession exchanges a valid user ID and OTP for a session token, which
+// is also set as the forward-auth cookie
+func (h *Handler) CreateSession(c *gin.Context) {
+	var req ValidateOTPRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	if err := h.auth.ValidateOTP(c.Request.Context(), req.UserID, req.OTP, auth.RequestClientInfo(c)); err != nil {
+		auth.WriteOTPError(c, err, gin.H{
+			"error": "Invalid OTP",
+		})
+		return
+	}
+
+	rawToken, session, err := h.auth.IssueSession(c.Request.Context(), req.UserID)
+	if err != nil {
+		respondSessionError(c, err, "Failed to create session")
+		return
+	}
+
+	h.auth.SetSessionCookie(c, rawToken, session)
+	c.JSON(http.StatusCreated, newSessionResponse(rawToken, session))
+}
+
+// RefreshSession swaps the bearer session token for a new one
+func (h *Handler) RefreshSession(c *gin.Context) {
+	rawToken, ok := auth.BearerToken(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Missing bearer session token",
+		})
+		return
+	}
+
+	newToken, session, err := h.auth.RefreshSession(c.Request.Context(), rawToken, auth.RequestClientInfo(c))
+	if err != nil {
+		respondSessionError(c, err, "Failed to refresh session")
+		return
+	}
+
+	h.auth.SetSessionCookie(c, newToken, session)
+	c.JSON(http.StatusOK, newSessionResponse(newToken, session))
+}
+
+// RevokeSession logs out the bearer session token
+func (h *Handler) RevokeSession(c *gin.Context) {
+	rawToken, ok := auth.BearerToken(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Missing bearer session token",
+		})
+		return
+	}
+
+	if err := h.auth.RevokeSession(c.Request.Context(), rawToken); err != nil {
+		respondSessionError(c, err, "Failed to revoke session")
+		return
+	}
+
+	h.auth.ClearSessionCookie(c)
+	c.Status(http.StatusNoContent)
+}
+
+func respondSessionError(c *gin.Context, err error, message string) {
+	if errors.Is(err, auth.ErrInvalidSession) {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Invalid or expired session",
+		})
+		return
+	}
+	if errors.Is(err, auth.ErrStorage) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": "Session storage is temporarily unavailable",
+		})
+		return
+	}
+
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"error": message,
+	})
+}
@@ -0,0 +1,153 @@
+package ldap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Config holds the settings of the LDAP bind proxy.
+type Config struct {
+	// Addr is the TCP address to listen on, such as ":1389".
+	Addr string
+	// UpstreamURL is the directory binds are forwarded to, as ldap:// or
+	// ldaps:// URL.
+	UpstreamURL string
+	// UpstreamTLS is used for ldaps:// upstreams.
+	UpstreamTLS *tls.Config
+	// Users maps normalised bind DNs to master token IDs.
+	Users map[string]string
+	// PassthroughDNs holds the normalised DNs of service accounts whose
+	// binds are forwarded unchanged, without an OTP. Binds of any other DN
+	// without a master token are rejected.
+	PassthroughDNs map[string]bool
+}
+
+// LoadConfig reads the LDAP settings from environment variables. It returns
+// nil if LDAP_ADDR is unset.
+func LoadConfig() (*Config, error) {
+	addr := os.Getenv("LDAP_ADDR")
+	if addr == "" {
+		return nil, nil
+	}
+
+	cfg := &Config{
+		Addr:        addr,
+		UpstreamURL: os.Getenv("LDAP_UPSTREAM_URL"),
+	}
+	if cfg.UpstreamURL == "" {
+		return nil, fmt.Errorf("LDAP_ADDR requires LDAP_UPSTREAM_URL")
+	}
+
+	cfg.UpstreamTLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile := os.Getenv("LDAP_UPSTREAM_CA_FILE"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read LDAP upstream CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		cfg.UpstreamTLS.RootCAs = pool
+	}
+
+	spec := os.Getenv("LDAP_USER_MAP")
+	if path := os.Getenv("LDAP_USER_MAP_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read LDAP user map file: %w", err)
+		}
+		spec = string(data)
+	}
+	users, err := ParseUserMap(spec)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Users = users
+
+	passthrough, err := ParsePassthroughDNs(os.Getenv("LDAP_PASSTHROUGH_DNS"))
+	if err != nil {
+		return nil, err
+	}
+	for key := range passthrough {
+		if _, mapped := users[key]; mapped {
+			return nil, fmt.Errorf("DN %q is both mapped to a master token and in LDAP_PASSTHROUGH_DNS", key)
+		}
+	}
+	cfg.PassthroughDNs = passthrough
+
+	return cfg, nil
+}
+
+// ParseUserMap parses a DN to master token mapping. Entries are separated by
+// newlines or semicolons and written as "<token id>=<dn>", e.g.
+// "550e8400-e29b-41d4-a716-446655440000=uid=alice,ou=people,dc=example,dc=org".
+func ParseUserMap(spec string) (map[string]string, error) {
+	entries := strings.FieldsFunc(spec, func(r rune) bool {
+		return r == ';' || r == '\n' || r == '\r'
+	})
+
+	users := make(map[string]string)
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		tokenID, dn, ok := strings.Cut(entry, "=")
+		tokenID = strings.TrimSpace(tokenID)
+		if !ok || tokenID == "" {
+			return nil, fmt.Errorf("invalid LDAP user map entry: expected <token id>=<dn>")
+		}
+		key, err := normalizeDN(dn)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DN for token %s: %w", tokenID, err)
+		}
+		if _, exists := users[key]; exists {
+			return nil, fmt.Errorf("duplicate LDAP user map entry for %q", dn)
+		}
+		users[key] = tokenID
+	}
+
+	return users, nil
+}
+
+// ParsePassthroughDNs parses the DNs of service accounts that bind without an
+// OTP. DNs are separated by newlines or semicolons.
+func ParsePassthroughDNs(spec string) (map[string]bool, error) {
+	entries := strings.FieldsFunc(spec, func(r rune) bool {
+		return r == ';' || r == '\n' || r == '\r'
+	})
+
+	dns := make(map[string]bool)
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		key, err := normalizeDN(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid passthrough DN %q: %w", entry, err)
+		}
+		if key == "" {
+			return nil, fmt.Errorf("passthrough DNs must not be empty")
+		}
+		dns[key] = true
+	}
+
+	return dns, nil
+}
+
+// normalizeDN makes DNs that differ only in case or spacing compare equal.
+func normalizeDN(dn string) (string, error) {
+	parsed, err := ldap.ParseDN(strings.TrimSpace(dn))
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(parsed.String()), nil
+}
@@ -0,0 +1,389 @@
+// Package ldap is an LDAP bind proxy for applications that can only
+// authenticate with a simple bind. Users append their OTP to the password;
+// the proxy verifies it and forwards the bind with the remaining password to
+// the upstream directory.
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"otp-basic/internal/auth"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	// idleTimeout closes connections that send no request for this long.
+	idleTimeout = 2 * time.Minute
+
+	// requestTimeout bounds the handling of one bind, including the
+	// upstream exchange.
+	requestTimeout = 10 * time.Second
+
+	dialTimeout = 5 * time.Second
+
+	// maxMessageSize is far above any bind request, and keeps clients from
+	// making the server allocate large buffers.
+	maxMessageSize = 64 << 10
+
+	// defaultDigits is the OTP length assumed for tokens that can't be
+	// looked up.
+	defaultDigits = 6
+)
+
+// ErrServerClosed is returned by Serve after Shutdown.
+var ErrServerClosed = errors.New("ldap: server closed")
+
+// Server answers LDAP simple binds. Every other operation is refused.
+type Server struct {
+	cfg       *Config
+	auth      *auth.AuthManager
+	tlsConfig *tls.Config
+
+	mu           sync.Mutex
+	listener     net.Listener
+	conns        map[net.Conn]struct{}
+	shuttingDown bool
+	wg           sync.WaitGroup
+}
+
+// NewServer creates an LDAP bind proxy for cfg. With a TLS configuration it
+// serves LDAPS.
+func NewServer(cfg *Config, am *auth.AuthManager, tlsConfig *tls.Config) *Server {
+	return &Server{
+		cfg:       cfg,
+		auth:      am,
+		tlsConfig: tlsConfig,
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// Addr returns the configured listen address.
+func (s *Server) Addr() string {
+	return s.cfg.Addr
+}
+
+// ListenAndServe listens on the configured TCP address and serves
+// connections until Shutdown is called.
+func (s *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	if s.tlsConfig != nil {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on listener until Shutdown is called.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.shuttingDown {
+		s.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			shuttingDown := s.shuttingDown
+			s.mu.Unlock()
+			if shuttingDown {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+// Shutdown stops accepting connections, lets binds in progress finish and
+// closes the connections. Connections still busy when ctx ends are closed
+// forcibly.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shuttingDown = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	// Wake up connections waiting for their next request
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		// Checked under the lock so Shutdown can't be missed between the
+		// check and the new deadline
+		s.mu.Lock()
+		if s.shuttingDown {
+			s.mu.Unlock()
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		s.mu.Unlock()
+
+		packet, err := readMessage(reader)
+		if err != nil {
+			return
+		}
+		if !s.handle(conn, packet) {
+			return
+		}
+	}
+}
+
+// handle answers one LDAP message. It returns false if the connection should
+// be closed.
+func (s *Server) handle(conn net.Conn, packet *ber.Packet) bool {
+	if len(packet.Children) < 2 {
+		return false
+	}
+	messageID, ok := packet.Children[0].Value.(int64)
+	if !ok {
+		return false
+	}
+	op := packet.Children[1]
+	if op.ClassType != ber.ClassApplication {
+		return false
+	}
+
+	var responseTag ber.Tag
+	code, message := uint16(ldap.LDAPResultUnwillingToPerform), "only simple bind is supported"
+	switch op.Tag {
+	case ldap.ApplicationBindRequest:
+		responseTag = ldap.ApplicationBindResponse
+		code, message = s.bind(conn, op)
+	case ldap.ApplicationUnbindRequest:
+		return false
+	case ldap.ApplicationAbandonRequest:
+		return true
+	case ldap.ApplicationSearchRequest:
+		responseTag = ldap.ApplicationSearchResultDone
+	case ldap.ApplicationExtendedRequest:
+		responseTag = ldap.ApplicationExtendedResponse
+	case ldap.ApplicationModifyRequest, ldap.ApplicationAddRequest, ldap.ApplicationDelRequest,
+		ldap.ApplicationModifyDNRequest, ldap.ApplicationCompareRequest:
+		// Each of these is answered by the application code that follows it
+		responseTag = op.Tag + 1
+	default:
+		return false
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(requestTimeout))
+	_, err := conn.Write(response(messageID, responseTag, code, message).Bytes())
+	return err == nil
+}
+
+// bind handles a BindRequest and returns the result code and diagnostic
+// message of the response.
+func (s *Server) bind(conn net.Conn, op *ber.Packet) (uint16, string) {
+	if len(op.Children) != 3 {
+		return ldap.LDAPResultProtocolError, "malformed bind request"
+	}
+	if version, ok := op.Children[0].Value.(int64); !ok || version != 3 {
+		return ldap.LDAPResultProtocolError, "only LDAPv3 is supported"
+	}
+	dn := op.Children[1].Data.String()
+	authentication := op.Children[2]
+	if authentication.ClassType != ber.ClassContext || authentication.Tag != 0 {
+		return ldap.LDAPResultAuthMethodNotSupported, "only simple bind is supported"
+	}
+	password := authentication.Data.String()
+
+	switch {
+	case dn == "" && password == "":
+		// Anonymous binds grant nothing here, since every other operation
+		// is refused
+		return ldap.LDAPResultSuccess, ""
+	case password == "":
+		return ldap.LDAPResultUnwillingToPerform, "unauthenticated binds are not allowed"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	// Names the proxy can't parse are refused rather than treated as
+	// unmapped: the directory may still resolve them, e.g. as a UPN, to a
+	// user that needs an OTP
+	key, err := normalizeDN(dn)
+	if err != nil {
+		return ldap.LDAPResultInvalidDNSyntax, "bind name must be a DN"
+	}
+	tokenID, mapped := s.cfg.Users[key]
+	if !mapped {
+		// Any other spelling of a mapped DN, with an OID or hex value for
+		// example, would reach the directory as the same user, so only
+		// listed service accounts skip the OTP
+		if s.cfg.PassthroughDNs[key] {
+			return s.upstreamBind(dn, password)
+		}
+		return ldap.LDAPResultInvalidCredentials, ""
+	}
+
+	digits := defaultDigits
+	if token, exists := s.auth.GetMasterToken(ctx, tokenID); exists {
+		digits = token.Digits
+	}
+	if len(password) <= digits {
+		return ldap.LDAPResultInvalidCredentials, ""
+	}
+	password, otpCode := password[:len(password)-digits], password[len(password)-digits:]
+
+	err = s.auth.ValidateOTP(ctx, tokenID, otpCode, connClientInfo(conn))
+	var locked *auth.LockedError
+	switch {
+	case errors.As(err, &locked):
+		return ldap.LDAPResultUnwillingToPerform, "too many failed attempts, try again later"
+	case errors.Is(err, auth.ErrStorage):
+		log.Printf("Failed LDAP bind for %s: %v", dn, err)
+		return ldap.LDAPResultUnavailable, "OTP validation is temporarily unavailable"
+	case err != nil:
+		return ldap.LDAPResultInvalidCredentials, ""
+	}
+
+	return s.upstreamBind(dn, password)
+}
+
+// upstreamBind forwards a bind to the upstream directory and returns its
+// result code. Diagnostic messages of the directory are not passed on.
+func (s *Server) upstreamBind(dn, password string) (uint16, string) {
+	upstream, err := ldap.DialURL(s.cfg.UpstreamURL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: dialTimeout}),
+		ldap.DialWithTLSConfig(s.cfg.UpstreamTLS))
+	if err != nil {
+		log.Printf("Failed to connect to upstream directory: %v", err)
+		return ldap.LDAPResultUnavailable, "directory is temporarily unavailable"
+	}
+	defer upstream.Close()
+	upstream.SetTimeout(requestTimeout)
+
+	err = upstream.Bind(dn, password)
+	var ldapErr *ldap.Error
+	switch {
+	case err == nil:
+		return ldap.LDAPResultSuccess, ""
+	case errors.As(err, &ldapErr) && ldapErr.ResultCode < ldap.ErrorNetwork:
+		return ldapErr.ResultCode, ""
+	default:
+		log.Printf("Failed to bind to upstream directory: %v", err)
+		return ldap.LDAPResultUnavailable, "directory is temporarily unavailable"
+	}
+}
+
+// connClientInfo describes the client of a connection: its IP and, on LDAPS
+// connections with a verified client certificate, its subject.
+func connClientInfo(conn net.Conn) auth.ClientInfo {
+	client := auth.ClientInfo{UserAgent: "LDAP"}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		client.IP = addr.IP.String()
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if state := tlsConn.ConnectionState(); len(state.VerifiedChains) > 0 {
+			client.CertSubject = state.VerifiedChains[0][0].Subject.String()
+		}
+	}
+	return client
+}
+
+// readMessage reads one LDAPMessage. The length is checked before the body
+// is read, since ber.ReadPacket would allocate whatever the client claims.
+func readMessage(r *bufio.Reader) (*ber.Packet, error) {
+	header := make([]byte, 2, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != 0x30 {
+		return nil, fmt.Errorf("expected an LDAPMessage sequence, got tag %#x", header[0])
+	}
+
+	length := int(header[1])
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 {
+			return nil, fmt.Errorf("unsupported length encoding")
+		}
+		lengthBytes := make([]byte, n)
+		if _, err := io.ReadFull(r, lengthBytes); err != nil {
+			return nil, err
+		}
+		header = append(header, lengthBytes...)
+		length = 0
+		for _, b := range lengthBytes {
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes exceeds the limit of %d", length, maxMessageSize)
+	}
+
+	message := make([]byte, len(header)+length)
+	copy(message, header)
+	if _, err := io.ReadFull(r, message[len(header):]); err != nil {
+		return nil, err
+	}
+	return ber.DecodePacketErr(message)
+}
+
+// response builds an LDAPResult of the given application tag.
+func response(messageID int64, tag ber.Tag, code uint16, message string) *ber.Packet {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "Message ID"))
+
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, ldap.ApplicationMap[uint8(tag)])
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, message, "Diagnostic Message"))
+	envelope.AppendChild(result)
+	return envelope
+}
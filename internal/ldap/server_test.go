@@ -0,0 +1,320 @@
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"otp-basic/internal/auth"
+	"otp-basic/internal/database"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	aliceDN           = "uid=alice,ou=people,dc=example,dc=org"
+	serviceDN         = "cn=app,ou=services,dc=example,dc=org"
+	directoryPassword = "directory-pw"
+)
+
+// fakeDirectory is an upstream directory that accepts any DN with
+// directoryPassword and records the binds it receives.
+type fakeDirectory struct {
+	listener net.Listener
+
+	mu    sync.Mutex
+	binds []string
+}
+
+func startFakeDirectory(t *testing.T) *fakeDirectory {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	d := &fakeDirectory{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	return d
+}
+
+func (d *fakeDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		packet, err := readMessage(reader)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		op := packet.Children[1]
+		if op.Tag != ldap.ApplicationBindRequest {
+			return
+		}
+
+		dn, password := op.Children[1].Data.String(), op.Children[2].Data.String()
+		d.mu.Lock()
+		d.binds = append(d.binds, dn+":"+password)
+		d.mu.Unlock()
+
+		code := uint16(ldap.LDAPResultSuccess)
+		if password != directoryPassword {
+			code = ldap.LDAPResultInvalidCredentials
+		}
+		messageID := packet.Children[0].Value.(int64)
+		if _, err := conn.Write(response(messageID, ldap.ApplicationBindResponse, code, "").Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+func (d *fakeDirectory) receivedBinds() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.binds...)
+}
+
+// startProxy registers and confirms a master token mapped to aliceDN and
+// serves a bind proxy in front of directory. It returns the proxy address
+// and the token secret.
+func startProxy(t *testing.T, directory *fakeDirectory) (string, string) {
+	t.Helper()
+	am := auth.NewAuthManager(database.NewMemoryStore())
+	token, err := am.RegisterMasterToken(context.Background(), "TestApp", "alice", auth.DefaultTokenOptions())
+	if err != nil {
+		t.Fatalf("Failed to register master token: %v", err)
+	}
+	// Confirm with the previous code so the current one is still unused
+	code, err := totp.GenerateCode(token.Secret, time.Now().Add(-30*time.Second))
+	if err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+	if err := am.ConfirmMasterToken(context.Background(), token.ID, code, auth.ClientInfo{IP: "192.0.2.1"}); err != nil {
+		t.Fatalf("Failed to confirm master token: %v", err)
+	}
+
+	users, err := ParseUserMap(token.ID + "=" + aliceDN)
+	if err != nil {
+		t.Fatalf("ParseUserMap() error = %v", err)
+	}
+	passthrough, err := ParsePassthroughDNs(serviceDN)
+	if err != nil {
+		t.Fatalf("ParsePassthroughDNs() error = %v", err)
+	}
+	cfg := &Config{
+		UpstreamURL:    "ldap://" + directory.listener.Addr().String(),
+		Users:          users,
+		PassthroughDNs: passthrough,
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := NewServer(cfg, am, nil)
+	go server.Serve(listener)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	})
+
+	return listener.Addr().String(), token.Secret
+}
+
+// bindCode binds to the proxy and returns the result code.
+func bindCode(t *testing.T, addr, dn, password string) uint16 {
+	t.Helper()
+	conn, err := ldap.DialURL("ldap://" + addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+
+	err = conn.Bind(dn, password)
+	if err == nil {
+		return ldap.LDAPResultSuccess
+	}
+	var ldapErr *ldap.Error
+	if !errors.As(err, &ldapErr) {
+		t.Fatalf("Bind() error = %v, want an LDAP result", err)
+	}
+	return ldapErr.ResultCode
+}
+
+func TestBind(t *testing.T) {
+	currentCode := func(t *testing.T, secret string) string {
+		code, err := totp.GenerateCode(secret, time.Now())
+		if err != nil {
+			t.Fatalf("Failed to generate OTP: %v", err)
+		}
+		return code
+	}
+
+	tests := []struct {
+		name     string
+		dn       string
+		password func(t *testing.T, secret string) string
+		wantCode uint16
+		// wantUpstream is the bind the directory should see, if any
+		wantUpstream string
+	}{
+		{
+			name:         "mapped DN with password and OTP",
+			dn:           aliceDN,
+			password:     func(t *testing.T, secret string) string { return directoryPassword + currentCode(t, secret) },
+			wantCode:     ldap.LDAPResultSuccess,
+			wantUpstream: aliceDN + ":" + directoryPassword,
+		},
+		{
+			name:         "mapped DN in another case and spacing",
+			dn:           "UID=Alice, OU=People, DC=Example, DC=Org",
+			password:     func(t *testing.T, secret string) string { return directoryPassword + currentCode(t, secret) },
+			wantCode:     ldap.LDAPResultSuccess,
+			wantUpstream: "UID=Alice, OU=People, DC=Example, DC=Org:" + directoryPassword,
+		},
+		{
+			name:     "mapped DN with wrong OTP",
+			dn:       aliceDN,
+			password: func(*testing.T, string) string { return directoryPassword + "000000" },
+			wantCode: ldap.LDAPResultInvalidCredentials,
+		},
+		{
+			name:     "mapped DN without OTP suffix",
+			dn:       aliceDN,
+			password: func(*testing.T, string) string { return directoryPassword },
+			wantCode: ldap.LDAPResultInvalidCredentials,
+		},
+		{
+			name:     "mapped DN with only an OTP",
+			dn:       aliceDN,
+			password: currentCode,
+			wantCode: ldap.LDAPResultInvalidCredentials,
+		},
+		{
+			name:     "mapped DN with wrong directory password",
+			dn:       aliceDN,
+			password: func(t *testing.T, secret string) string { return "nope" + currentCode(t, secret) },
+			wantCode: ldap.LDAPResultInvalidCredentials,
+			// The OTP is valid, so the directory decides
+			wantUpstream: aliceDN + ":nope",
+		},
+		{
+			name:         "passthrough service DN",
+			dn:           serviceDN,
+			password:     func(*testing.T, string) string { return directoryPassword },
+			wantCode:     ldap.LDAPResultSuccess,
+			wantUpstream: serviceDN + ":" + directoryPassword,
+		},
+		{
+			name:     "unmapped DN not in passthrough list",
+			dn:       "uid=mallory,ou=people,dc=example,dc=org",
+			password: func(*testing.T, string) string { return directoryPassword },
+			wantCode: ldap.LDAPResultInvalidCredentials,
+		},
+		{
+			name:     "mapped DN with attribute OID",
+			dn:       "0.9.2342.19200300.100.1.1=alice,ou=people,dc=example,dc=org",
+			password: func(*testing.T, string) string { return directoryPassword },
+			wantCode: ldap.LDAPResultInvalidCredentials,
+		},
+		{
+			name:     "mapped DN with hex value",
+			dn:       "uid=#0405616c696365,ou=people,dc=example,dc=org",
+			password: func(*testing.T, string) string { return directoryPassword },
+			wantCode: ldap.LDAPResultInvalidCredentials,
+		},
+		{
+			name:     "mapped DN with RDNs in another order",
+			dn:       "uid=alice,ou=people,dc=org,dc=example",
+			password: func(*testing.T, string) string { return directoryPassword },
+			wantCode: ldap.LDAPResultInvalidCredentials,
+		},
+		{
+			name:     "user principal name",
+			dn:       "alice@example.org",
+			password: func(*testing.T, string) string { return directoryPassword },
+			wantCode: ldap.LDAPResultInvalidDNSyntax,
+		},
+		{
+			name:     "down-level logon name",
+			dn:       `EXAMPLE\alice`,
+			password: func(*testing.T, string) string { return directoryPassword },
+			wantCode: ldap.LDAPResultInvalidDNSyntax,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			directory := startFakeDirectory(t)
+			addr, secret := startProxy(t, directory)
+
+			if got := bindCode(t, addr, tt.dn, tt.password(t, secret)); got != tt.wantCode {
+				t.Errorf("Bind() result = %d (%s), want %d (%s)",
+					got, ldap.LDAPResultCodeMap[got], tt.wantCode, ldap.LDAPResultCodeMap[tt.wantCode])
+			}
+
+			binds := directory.receivedBinds()
+			switch {
+			case tt.wantUpstream == "" && len(binds) > 0:
+				t.Errorf("Directory received %q, want no bind", binds)
+			case tt.wantUpstream != "" && (len(binds) != 1 || binds[0] != tt.wantUpstream):
+				t.Errorf("Directory received %q, want [%q]", binds, tt.wantUpstream)
+			}
+		})
+	}
+}
+
+func TestBind_RejectsReplayedOTP(t *testing.T) {
+	directory := startFakeDirectory(t)
+	addr, secret := startProxy(t, directory)
+
+	code, err := totp.GenerateCode(secret, time.Now())
+	if err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+	if got := bindCode(t, addr, aliceDN, directoryPassword+code); got != ldap.LDAPResultSuccess {
+		t.Fatalf("First bind result = %d, want success", got)
+	}
+	if got := bindCode(t, addr, aliceDN, directoryPassword+code); got != ldap.LDAPResultInvalidCredentials {
+		t.Errorf("Replayed bind result = %d, want %d", got, ldap.LDAPResultInvalidCredentials)
+	}
+}
+
+func TestParsePassthroughDNs(t *testing.T) {
+	dns, err := ParsePassthroughDNs("CN=App, OU=Services, DC=example, DC=org;\n# comment\ncn=backup,dc=example,dc=org")
+	if err != nil {
+		t.Fatalf("ParsePassthroughDNs() error = %v", err)
+	}
+	if len(dns) != 2 || !dns[serviceDN] || !dns["cn=backup,dc=example,dc=org"] {
+		t.Errorf("ParsePassthroughDNs() = %v", dns)
+	}
+
+	if _, err := ParsePassthroughDNs("app@example.org"); err == nil {
+		t.Error("Expected an error for a name that isn't a DN")
+	}
+}
+
+func TestLoadConfig_RejectsMappedPassthroughDN(t *testing.T) {
+	t.Setenv("LDAP_ADDR", ":1389")
+	t.Setenv("LDAP_UPSTREAM_URL", "ldap://directory.example.org")
+	t.Setenv("LDAP_USER_MAP", "550e8400-e29b-41d4-a716-446655440000="+aliceDN)
+	t.Setenv("LDAP_PASSTHROUGH_DNS", "UID=alice,ou=people,dc=example,dc=org")
+
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected an error for a DN that is both mapped and passed through")
+	}
+}
@@ -0,0 +1,165 @@
+// Package metrics exposes Prometheus metrics for the OTP server.
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "otp"
+
+// Outcomes of an OTP check, used as the "outcome" label of
+// otp_validations_total.
+const (
+	OutcomeValid        = "valid"
+	OutcomeInvalidCode  = "invalid_code"
+	OutcomeUnknownUser  = "unknown_user"
+	OutcomeInactive     = "inactive"
+	OutcomeLockedOut    = "locked_out"
+	OutcomeReplay       = "replay"
+	OutcomeCertMismatch = "cert_mismatch"
+	OutcomeError        = "error"
+)
+
+// Operations checking an OTP, used as the "operation" label of
+// otp_validations_total.
+const (
+	OperationValidate = "validate"
+	OperationConfirm  = "confirm"
+)
+
+// Metrics holds the server's collectors in a dedicated registry. All methods
+// are safe to call on a nil *Metrics, which records nothing.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	registrations   prometheus.Counter
+	validations     *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	queryDuration   *prometheus.HistogramVec
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		registrations: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "registrations_total",
+			Help:      "Master tokens registered.",
+		}),
+		validations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "validations_total",
+			Help:      "OTP checks by operation and outcome.",
+		}, []string{"operation", "outcome"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP handler latency by route and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "db_query_duration_seconds",
+			Help:      "Database query latency by statement.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, []string{"statement"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.registrations,
+		m.validations,
+		m.requestDuration,
+		m.queryDuration,
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// RecordRegistration counts a registered master token.
+func (m *Metrics) RecordRegistration() {
+	if m == nil {
+		return
+	}
+	m.registrations.Inc()
+}
+
+// RecordValidation counts an OTP check.
+func (m *Metrics) RecordValidation(operation, outcome string) {
+	if m == nil {
+		return
+	}
+	m.validations.WithLabelValues(operation, outcome).Inc()
+}
+
+// ObserveQuery records the latency of a database statement.
+func (m *Metrics) ObserveQuery(statement string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.queryDuration.WithLabelValues(statement).Observe(d.Seconds())
+}
+
+// Middleware records the latency of every request. Requests that match no
+// route are grouped under an empty route label to bound cardinality.
+func (m *Metrics) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if m == nil {
+			c.Next()
+			return
+		}
+
+		start := time.Now()
+		c.Next()
+
+		m.requestDuration.
+			WithLabelValues(c.Request.Method, c.FullPath(), strconv.Itoa(c.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+// RegisterDBStats exports connection pool gauges read from stats on every
+// scrape.
+func (m *Metrics) RegisterDBStats(stats func() sql.DBStats) {
+	if m == nil {
+		return
+	}
+
+	opts := func(name, help string) prometheus.Opts {
+		return prometheus.Opts{Namespace: namespace, Subsystem: "db", Name: name, Help: help}
+	}
+	gauge := func(name, help string, value func(sql.DBStats) float64) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts(opts(name, help)), func() float64 { return value(stats()) })
+	}
+	counter := func(name, help string, value func(sql.DBStats) float64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts(opts(name, help)), func() float64 { return value(stats()) })
+	}
+
+	m.registry.MustRegister(
+		gauge("max_open_connections", "Maximum number of open connections.",
+			func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }),
+		gauge("open_connections", "Established connections, in use and idle.",
+			func(s sql.DBStats) float64 { return float64(s.OpenConnections) }),
+		gauge("in_use_connections", "Connections currently in use.",
+			func(s sql.DBStats) float64 { return float64(s.InUse) }),
+		gauge("idle_connections", "Idle connections.",
+			func(s sql.DBStats) float64 { return float64(s.Idle) }),
+		counter("wait_count_total", "Connections waited for.",
+			func(s sql.DBStats) float64 { return float64(s.WaitCount) }),
+		counter("wait_duration_seconds_total", "Time blocked waiting for a connection.",
+			func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }),
+	)
+}
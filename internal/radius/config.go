@@ -0,0 +1,153 @@
+package radius
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// Values of RADIUS_PASSWORD_MODE.
+const (
+	// PasswordModeOTP expects User-Password to be the OTP alone.
+	PasswordModeOTP = "otp"
+	// PasswordModePasswordOTP expects the user's password followed by the
+	// OTP. The password is checked by the upstream RADIUS server.
+	PasswordModePasswordOTP = "password+otp"
+)
+
+// Config holds the settings of the RADIUS listener.
+type Config struct {
+	// Addr is the UDP address to listen on, such as ":1812".
+	Addr string
+	// Clients are the NASes allowed to send requests.
+	Clients []Client
+	// PasswordMode is PasswordModeOTP or PasswordModePasswordOTP.
+	PasswordMode string
+	// Upstream verifies passwords in PasswordModePasswordOTP.
+	Upstream *Upstream
+	// RequireMessageAuthenticator drops Access-Requests without a valid
+	// Message-Authenticator attribute. Turning it off lets requests from
+	// NASes that don't send one through, at the risk of Blast-RADIUS
+	// forgeries.
+	RequireMessageAuthenticator bool
+}
+
+// Client is a NAS, or a network of them, sharing a secret.
+type Client struct {
+	Network *net.IPNet
+	Secret  []byte
+}
+
+// Upstream is a RADIUS server the password part of a request is forwarded
+// to.
+type Upstream struct {
+	Addr   string
+	Secret []byte
+}
+
+// LoadConfig reads the RADIUS settings from environment variables. It
+// returns nil if RADIUS_ADDR is unset.
+func LoadConfig() (*Config, error) {
+	addr := os.Getenv("RADIUS_ADDR")
+	if addr == "" {
+		return nil, nil
+	}
+
+	spec := os.Getenv("RADIUS_CLIENTS")
+	if path := os.Getenv("RADIUS_CLIENTS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read RADIUS clients file: %w", err)
+		}
+		spec = string(data)
+	}
+	clients, err := ParseClients(spec)
+	if err != nil {
+		return nil, err
+	}
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("RADIUS_ADDR requires RADIUS_CLIENTS or RADIUS_CLIENTS_FILE")
+	}
+
+	cfg := &Config{
+		Addr:                        addr,
+		Clients:                     clients,
+		PasswordMode:                strings.ToLower(os.Getenv("RADIUS_PASSWORD_MODE")),
+		RequireMessageAuthenticator: true,
+	}
+
+	switch value := strings.ToLower(os.Getenv("RADIUS_REQUIRE_MESSAGE_AUTHENTICATOR")); value {
+	case "", "true":
+	case "false":
+		log.Println("Warning: RADIUS_REQUIRE_MESSAGE_AUTHENTICATOR is false, requests without a Message-Authenticator are accepted")
+		cfg.RequireMessageAuthenticator = false
+	default:
+		return nil, fmt.Errorf("invalid RADIUS_REQUIRE_MESSAGE_AUTHENTICATOR %q, expected true or false", value)
+	}
+
+	switch cfg.PasswordMode {
+	case "":
+		cfg.PasswordMode = PasswordModeOTP
+	case PasswordModeOTP:
+	case PasswordModePasswordOTP:
+		upstreamAddr := os.Getenv("RADIUS_UPSTREAM_ADDR")
+		upstreamSecret := os.Getenv("RADIUS_UPSTREAM_SECRET")
+		if upstreamAddr == "" || upstreamSecret == "" {
+			return nil, fmt.Errorf("RADIUS_PASSWORD_MODE=%s requires RADIUS_UPSTREAM_ADDR and RADIUS_UPSTREAM_SECRET", PasswordModePasswordOTP)
+		}
+		cfg.Upstream = &Upstream{Addr: upstreamAddr, Secret: []byte(upstreamSecret)}
+	default:
+		return nil, fmt.Errorf("invalid RADIUS_PASSWORD_MODE %q, expected %s or %s", cfg.PasswordMode, PasswordModeOTP, PasswordModePasswordOTP)
+	}
+
+	return cfg, nil
+}
+
+// ParseClients parses a client list. Clients are listed one per line or
+// comma separated as "<ip or cidr>=<shared secret>".
+func ParseClients(spec string) ([]Client, error) {
+	entries := strings.FieldsFunc(spec, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r'
+	})
+
+	var clients []Client
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		address, secret, ok := strings.Cut(entry, "=")
+		if !ok || secret == "" {
+			return nil, fmt.Errorf("invalid RADIUS client entry: expected <ip or cidr>=<secret>")
+		}
+		address = strings.TrimSpace(address)
+		if !strings.Contains(address, "/") {
+			if ip := net.ParseIP(address); ip != nil && ip.To4() != nil {
+				address += "/32"
+			} else {
+				address += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RADIUS client address: %w", err)
+		}
+
+		clients = append(clients, Client{Network: network, Secret: []byte(secret)})
+	}
+
+	return clients, nil
+}
+
+// secretFor returns the secret of the first client containing ip.
+func (cfg *Config) secretFor(ip net.IP) []byte {
+	for _, client := range cfg.Clients {
+		if client.Network.Contains(ip) {
+			return client.Secret
+		}
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+// Package radius answers RADIUS Access-Requests (RFC 2865) by validating the
+// OTP in User-Password, so VPN concentrators and network equipment can use
+// OTP authentication.
+package radius
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"otp-basic/internal/auth"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+)
+
+const (
+	// requestTimeout bounds the handling of one Access-Request, including
+	// the upstream exchange. NASes usually retry after a few seconds.
+	requestTimeout = 10 * time.Second
+
+	// defaultDigits is the OTP length assumed for unknown users when
+	// splitting "password+OTP".
+	defaultDigits = 6
+)
+
+// Server validates Access-Requests with an AuthManager.
+type Server struct {
+	cfg          *Config
+	auth         *auth.AuthManager
+	packetServer *radius.PacketServer
+}
+
+// NewServer creates a RADIUS server for cfg. Call ListenAndServe or Serve to
+// start it.
+func NewServer(cfg *Config, am *auth.AuthManager) *Server {
+	s := &Server{cfg: cfg, auth: am}
+	s.packetServer = &radius.PacketServer{
+		Addr:         cfg.Addr,
+		Network:      "udp",
+		SecretSource: s,
+		Handler:      s,
+	}
+	return s
+}
+
+// Addr returns the configured listen address.
+func (s *Server) Addr() string {
+	return s.cfg.Addr
+}
+
+// ListenAndServe listens on the configured UDP address and serves requests
+// until Shutdown is called.
+func (s *Server) ListenAndServe() error {
+	return s.packetServer.ListenAndServe()
+}
+
+// Serve serves requests received on conn until Shutdown is called.
+func (s *Server) Serve(conn net.PacketConn) error {
+	return s.packetServer.Serve(conn)
+}
+
+// Shutdown stops listening and waits for requests in progress.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.packetServer.Shutdown(ctx)
+}
+
+// RADIUSSecret returns the shared secret of the client at remoteAddr.
+// Requests from unknown clients are dropped.
+func (s *Server) RADIUSSecret(_ context.Context, remoteAddr net.Addr) ([]byte, error) {
+	addr, ok := remoteAddr.(*net.UDPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unexpected RADIUS client address %s", remoteAddr)
+	}
+	secret := s.cfg.secretFor(addr.IP)
+	if secret == nil {
+		return nil, fmt.Errorf("unknown RADIUS client %s", addr.IP)
+	}
+	return secret, nil
+}
+
+// ServeRADIUS answers an Access-Request with Access-Accept or
+// Access-Reject. Other packets, and requests that can't be answered because
+// storage is unavailable, are dropped so the NAS can fail over.
+func (s *Server) ServeRADIUS(w radius.ResponseWriter, r *radius.Request) {
+	if r.Code != radius.CodeAccessRequest {
+		return
+	}
+	if !s.messageAuthenticatorValid(r.Packet) {
+		log.Printf("Dropping RADIUS request from %s: missing or invalid Message-Authenticator", r.RemoteAddr)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	code, message, ok := s.authenticate(ctx, r)
+	if !ok {
+		return
+	}
+
+	// Message-Authenticator goes first, as recommended against Blast-RADIUS
+	response := r.Response(code)
+	response.Add(rfc2869.MessageAuthenticator_Type, make(radius.Attribute, md5.Size))
+	if message != "" {
+		rfc2865.ReplyMessage_SetString(response, message)
+	}
+	signMessageAuthenticator(response)
+
+	if err := w.Write(response); err != nil {
+		log.Printf("Failed to answer RADIUS request from %s: %v", r.RemoteAddr, err)
+	}
+}
+
+// authenticate checks the credentials of an Access-Request. ok is false if
+// the request should go unanswered.
+func (s *Server) authenticate(ctx context.Context, r *radius.Request) (code radius.Code, message string, ok bool) {
+	userID := rfc2865.UserName_GetString(r.Packet)
+	// Only PAP carries the plaintext OTP; CHAP and EAP can't be validated
+	password, err := rfc2865.UserPassword_LookupString(r.Packet)
+	if userID == "" || err != nil {
+		return radius.CodeAccessReject, "", true
+	}
+
+	otpCode := password
+	var upstreamPassword string
+	if s.cfg.PasswordMode == PasswordModePasswordOTP {
+		digits := defaultDigits
+		if token, exists := s.auth.GetMasterToken(ctx, userID); exists {
+			digits = token.Digits
+		}
+		if len(password) <= digits {
+			return radius.CodeAccessReject, "", true
+		}
+		upstreamPassword, otpCode = password[:len(password)-digits], password[len(password)-digits:]
+	}
+
+	err = s.auth.ValidateOTP(ctx, userID, otpCode, requestClientInfo(r))
+	var locked *auth.LockedError
+	switch {
+	case errors.As(err, &locked):
+		return radius.CodeAccessReject, "Too many failed attempts, try again later", true
+	case errors.Is(err, auth.ErrStorage):
+		log.Printf("Not answering RADIUS request for %s: %v", userID, err)
+		return 0, "", false
+	case err != nil:
+		return radius.CodeAccessReject, "", true
+	}
+
+	if s.cfg.Upstream != nil {
+		accepted, err := s.checkUpstream(ctx, userID, upstreamPassword)
+		if err != nil {
+			log.Printf("Not answering RADIUS request for %s: upstream failed: %v", userID, err)
+			return 0, "", false
+		}
+		if !accepted {
+			return radius.CodeAccessReject, "", true
+		}
+	}
+
+	return radius.CodeAccessAccept, "", true
+}
+
+// checkUpstream asks the upstream RADIUS server to verify the password.
+func (s *Server) checkUpstream(ctx context.Context, userID, password string) (bool, error) {
+	request := radius.New(radius.CodeAccessRequest, s.cfg.Upstream.Secret)
+	request.Add(rfc2869.MessageAuthenticator_Type, make(radius.Attribute, md5.Size))
+	if err := rfc2865.UserName_SetString(request, userID); err != nil {
+		return false, err
+	}
+	if err := rfc2865.UserPassword_SetString(request, password); err != nil {
+		return false, err
+	}
+	signMessageAuthenticator(request)
+
+	response, err := radius.Exchange(ctx, request, s.cfg.Upstream.Addr)
+	if err != nil {
+		return false, err
+	}
+	return response.Code == radius.CodeAccessAccept, nil
+}
+
+// requestClientInfo describes the user behind a request. The
+// Calling-Station-Id is recorded as the client IP when the NAS reports one,
+// otherwise the address of the NAS itself. Either may stand for many users,
+// so failed attempts only count against the user.
+func requestClientInfo(r *radius.Request) auth.ClientInfo {
+	client := auth.ClientInfo{SharedIP: true}
+	if ip := net.ParseIP(rfc2865.CallingStationID_GetString(r.Packet)); ip != nil {
+		client.IP = ip.String()
+	} else if addr, ok := r.RemoteAddr.(*net.UDPAddr); ok {
+		client.IP = addr.IP.String()
+	}
+
+	nas := rfc2865.NASIdentifier_GetString(r.Packet)
+	if nas == "" {
+		nas = r.RemoteAddr.String()
+	}
+	client.UserAgent = "RADIUS NAS " + nas
+	return client
+}
+
+// messageAuthenticatorValid checks the Message-Authenticator attribute of
+// p (RFC 3579). Requests without one pass unless it is required.
+func (s *Server) messageAuthenticatorValid(p *radius.Packet) bool {
+	value, err := rfc2869.MessageAuthenticator_Lookup(p)
+	if err != nil {
+		return !s.cfg.RequireMessageAuthenticator
+	}
+	expected, err := messageAuthenticator(p)
+	return err == nil && hmac.Equal(value, expected)
+}
+
+// signMessageAuthenticator fills in the Message-Authenticator attribute of
+// p. Responses must still carry the request authenticator at this point.
+func signMessageAuthenticator(p *radius.Packet) {
+	sum, err := messageAuthenticator(p)
+	if err != nil {
+		return
+	}
+	for _, avp := range p.Attributes {
+		if avp.Type == rfc2869.MessageAuthenticator_Type {
+			avp.Attribute = sum
+		}
+	}
+}
+
+// messageAuthenticator computes the HMAC-MD5 of p with its
+// Message-Authenticator zeroed.
+func messageAuthenticator(p *radius.Packet) ([]byte, error) {
+	zeroed := *p
+	zeroed.Attributes = make(radius.Attributes, len(p.Attributes))
+	for i, avp := range p.Attributes {
+		if avp.Type == rfc2869.MessageAuthenticator_Type {
+			avp = &radius.AVP{Type: avp.Type, Attribute: make(radius.Attribute, md5.Size)}
+		}
+		zeroed.Attributes[i] = avp
+	}
+
+	b, err := zeroed.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(md5.New, p.Secret)
+	mac.Write(b)
+	return mac.Sum(nil), nil
+}
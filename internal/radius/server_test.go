@@ -0,0 +1,235 @@
+package radius
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"otp-basic/internal/auth"
+	"otp-basic/internal/database"
+
+	"github.com/pquerna/otp/totp"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+)
+
+const testSecret = "testing123"
+
+// startServer serves RADIUS for 127.0.0.1 with testSecret and returns its
+// address.
+func startServer(t *testing.T, am *auth.AuthManager, requireMessageAuthenticator bool) string {
+	t.Helper()
+	clients, err := ParseClients("127.0.0.1=" + testSecret)
+	if err != nil {
+		t.Fatalf("ParseClients() error = %v", err)
+	}
+	cfg := &Config{
+		Clients:                     clients,
+		PasswordMode:                PasswordModeOTP,
+		RequireMessageAuthenticator: requireMessageAuthenticator,
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := NewServer(cfg, am)
+	go server.Serve(conn)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	})
+	return conn.LocalAddr().String()
+}
+
+// registerActiveToken registers and confirms a token. The confirmation uses
+// the code of the previous time step so the current one is still unused.
+func registerActiveToken(t *testing.T, am *auth.AuthManager) *auth.MasterToken {
+	t.Helper()
+	token, err := am.RegisterMasterToken(context.Background(), "TestApp", "alice", auth.DefaultTokenOptions())
+	if err != nil {
+		t.Fatalf("Failed to register master token: %v", err)
+	}
+	code, err := totp.GenerateCode(token.Secret, time.Now().Add(-30*time.Second))
+	if err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+	if err := am.ConfirmMasterToken(context.Background(), token.ID, code, auth.ClientInfo{IP: "192.0.2.1"}); err != nil {
+		t.Fatalf("Failed to confirm master token: %v", err)
+	}
+	return token
+}
+
+func currentCode(t *testing.T, token *auth.MasterToken) string {
+	t.Helper()
+	code, err := totp.GenerateCode(token.Secret, time.Now())
+	if err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+	return code
+}
+
+// accessRequest builds an Access-Request signed with secret. withAuthenticator
+// adds a valid Message-Authenticator.
+func accessRequest(t *testing.T, secret, userID, password string, withAuthenticator bool) *radius.Packet {
+	t.Helper()
+	packet := radius.New(radius.CodeAccessRequest, []byte(secret))
+	if withAuthenticator {
+		packet.Add(rfc2869.MessageAuthenticator_Type, make(radius.Attribute, md5.Size))
+	}
+	if err := rfc2865.UserName_SetString(packet, userID); err != nil {
+		t.Fatalf("Failed to set User-Name: %v", err)
+	}
+	if err := rfc2865.UserPassword_SetString(packet, password); err != nil {
+		t.Fatalf("Failed to set User-Password: %v", err)
+	}
+	signMessageAuthenticator(packet)
+	return packet
+}
+
+// exchange sends packet to addr. It returns nil if the server doesn't
+// answer.
+func exchange(t *testing.T, packet *radius.Packet, addr string) *radius.Packet {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	response, err := radius.Exchange(ctx, packet, addr)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	return response
+}
+
+func TestServer_Exchange(t *testing.T) {
+	am := auth.NewAuthManager(database.NewMemoryStore())
+	token := registerActiveToken(t, am)
+	addr := startServer(t, am, true)
+
+	response := exchange(t, accessRequest(t, testSecret, token.ID, currentCode(t, token), true), addr)
+	if response == nil || response.Code != radius.CodeAccessAccept {
+		t.Fatalf("Expected Access-Accept for a valid OTP, got %v", response)
+	}
+	// Responses are signed so the NAS can check them
+	if value, err := rfc2869.MessageAuthenticator_Lookup(response); err != nil || len(value) != md5.Size {
+		t.Errorf("Expected a Message-Authenticator in the response: %v", err)
+	}
+
+	// The same code can't be used twice
+	response = exchange(t, accessRequest(t, testSecret, token.ID, currentCode(t, token), true), addr)
+	if response == nil || response.Code != radius.CodeAccessReject {
+		t.Errorf("Expected Access-Reject for a replayed OTP, got %v", response)
+	}
+
+	response = exchange(t, accessRequest(t, testSecret, token.ID, "000000", true), addr)
+	if response == nil || response.Code != radius.CodeAccessReject {
+		t.Errorf("Expected Access-Reject for a wrong OTP, got %v", response)
+	}
+}
+
+func TestServer_DropsUnauthenticRequests(t *testing.T) {
+	am := auth.NewAuthManager(database.NewMemoryStore())
+	token := registerActiveToken(t, am)
+	addr := startServer(t, am, true)
+
+	t.Run("wrong shared secret", func(t *testing.T) {
+		packet := accessRequest(t, "wrong-secret", token.ID, currentCode(t, token), true)
+		if response := exchange(t, packet, addr); response != nil {
+			t.Errorf("Expected no answer, got %v", response.Code)
+		}
+	})
+
+	t.Run("missing Message-Authenticator", func(t *testing.T) {
+		packet := accessRequest(t, testSecret, token.ID, currentCode(t, token), false)
+		if response := exchange(t, packet, addr); response != nil {
+			t.Errorf("Expected no answer, got %v", response.Code)
+		}
+	})
+
+	t.Run("invalid Message-Authenticator", func(t *testing.T) {
+		packet := accessRequest(t, testSecret, token.ID, currentCode(t, token), true)
+		// Changed after signing, as a Blast-RADIUS forgery would
+		rfc2865.UserName_SetString(packet, "someone-else")
+		if response := exchange(t, packet, addr); response != nil {
+			t.Errorf("Expected no answer, got %v", response.Code)
+		}
+	})
+
+	// None of the dropped requests used up the code
+	response := exchange(t, accessRequest(t, testSecret, token.ID, currentCode(t, token), true), addr)
+	if response == nil || response.Code != radius.CodeAccessAccept {
+		t.Errorf("Expected Access-Accept after the dropped requests, got %v", response)
+	}
+}
+
+func TestServer_OptionalMessageAuthenticator(t *testing.T) {
+	am := auth.NewAuthManager(database.NewMemoryStore())
+	token := registerActiveToken(t, am)
+	addr := startServer(t, am, false)
+
+	response := exchange(t, accessRequest(t, testSecret, token.ID, currentCode(t, token), false), addr)
+	if response == nil || response.Code != radius.CodeAccessAccept {
+		t.Errorf("Expected Access-Accept without a Message-Authenticator, got %v", response)
+	}
+
+	// One that is present is still checked
+	packet := accessRequest(t, testSecret, token.ID, "000000", true)
+	rfc2865.UserName_SetString(packet, "someone-else")
+	if response := exchange(t, packet, addr); response != nil {
+		t.Errorf("Expected no answer for an invalid Message-Authenticator, got %v", response.Code)
+	}
+}
+
+func TestServer_LockoutIsPerUser(t *testing.T) {
+	t.Setenv("LOCKOUT_THRESHOLD", "3")
+	t.Setenv("LOCKOUT_BACKOFF_BASE", "1ns")
+	am := auth.NewAuthManager(database.NewMemoryStore())
+	alice := registerActiveToken(t, am)
+	bob := registerActiveToken(t, am)
+	addr := startServer(t, am, true)
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(time.Millisecond)
+		exchange(t, accessRequest(t, testSecret, alice.ID, "000000", true), addr)
+	}
+
+	response := exchange(t, accessRequest(t, testSecret, alice.ID, currentCode(t, alice), true), addr)
+	if response == nil || response.Code != radius.CodeAccessReject {
+		t.Fatalf("Expected Access-Reject while locked out, got %v", response)
+	}
+	if message := rfc2865.ReplyMessage_GetString(response); message == "" {
+		t.Error("Expected a Reply-Message explaining the lockout")
+	}
+
+	// Bob uses the same NAS but isn't affected by Alice's failures
+	response = exchange(t, accessRequest(t, testSecret, bob.ID, currentCode(t, bob), true), addr)
+	if response == nil || response.Code != radius.CodeAccessAccept {
+		t.Errorf("Expected Access-Accept for another user of the NAS, got %v", response)
+	}
+}
+
+func TestLoadConfig_MessageAuthenticatorRequiredByDefault(t *testing.T) {
+	t.Setenv("RADIUS_ADDR", ":1812")
+	t.Setenv("RADIUS_CLIENTS", "127.0.0.1="+testSecret)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if !cfg.RequireMessageAuthenticator {
+		t.Error("Expected Message-Authenticator to be required by default")
+	}
+
+	t.Setenv("RADIUS_REQUIRE_MESSAGE_AUTHENTICATOR", "false")
+	if cfg, err := LoadConfig(); err != nil || cfg.RequireMessageAuthenticator {
+		t.Errorf("LoadConfig() = %+v, %v, want Message-Authenticator optional", cfg, err)
+	}
+}
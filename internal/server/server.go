@@ -1,37 +1,241 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
 	"otp-basic/internal/auth"
 	"otp-basic/internal/database"
+	"otp-basic/internal/grpcapi"
 	"otp-basic/internal/handlers"
+	"otp-basic/internal/ldap"
+	"otp-basic/internal/metrics"
+	"otp-basic/internal/radius"
+	"otp-basic/internal/siem"
+	"otp-basic/internal/tracing"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel"
 )
 
 type Server struct {
-	router *gin.Engine
-	auth   *auth.AuthManager
-	db     *database.DB
+	router    *gin.Engine
+	auth      *auth.AuthManager
+	db        *database.DB
+	cfg       Config
+	tlsConfig *tls.Config
+
+	// closers release what NewServer set up, such as the tracer provider
+	// and the database. Close calls them in reverse order.
+	closers []func() error
+	// listeners are the configured protocols served next to HTTP.
+	listeners []listener
+}
+
+// listener is a protocol server run next to the HTTP server, such as RADIUS.
+type listener struct {
+	name   string
+	server interface {
+		Addr() string
+		ListenAndServe() error
+		Shutdown(ctx context.Context) error
+	}
 }
 
-func NewServer() (*Server, error) {
+// Config holds the HTTP server timeouts and TLS settings.
+type Config struct {
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// RequestTimeout bounds the context of every request, so database
+	// queries of slow requests are cancelled.
+	RequestTimeout time.Duration
+	// ShutdownGracePeriod is how long in-flight requests may take to finish
+	// once shutdown has started.
+	ShutdownGracePeriod time.Duration
+	// TLS is nil when serving plain HTTP.
+	TLS *TLSConfig
+}
+
+func loadConfig() (Config, error) {
+	tlsCfg, err := loadTLSConfig()
+	if err != nil {
+		return Config{}, err
+	}
+
+	return Config{
+		ReadTimeout:         getEnvDuration("HTTP_READ_TIMEOUT", 10*time.Second),
+		WriteTimeout:        getEnvDuration("HTTP_WRITE_TIMEOUT", 30*time.Second),
+		IdleTimeout:         getEnvDuration("HTTP_IDLE_TIMEOUT", 120*time.Second),
+		RequestTimeout:      getEnvDuration("HTTP_REQUEST_TIMEOUT", 15*time.Second),
+		ShutdownGracePeriod: getEnvDuration("SHUTDOWN_GRACE_PERIOD", 30*time.Second),
+		TLS:                 tlsCfg,
+	}, nil
+}
+
+// NewServer sets up the server from environment variables. If a step fails,
+// whatever the earlier steps set up is released again.
+func NewServer() (_ *Server, err error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{cfg: cfg}
+	defer func() {
+		if err != nil {
+			s.Close()
+		}
+	}()
+
+	var tlsConfig *tls.Config
+	if cfg.TLS != nil {
+		if tlsConfig, err = cfg.TLS.build(); err != nil {
+			return nil, err
+		}
+		log.Printf("TLS enabled with certificate %s", cfg.TLS.CertFile)
+		if cfg.TLS.ClientCAFile != "" {
+			log.Printf("Verifying client certificates against %s", cfg.TLS.ClientCAFile)
+		}
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	s.onClose(func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			return fmt.Errorf("failed to flush traces: %w", err)
+		}
+		return nil
+	})
+	// Handed to every component explicitly, so none depends on the global
+	tracerProvider := otel.GetTracerProvider()
+
+	radiusConfig, err := radius.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	ldapConfig, err := ldap.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	siemConfig, err := siem.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	var emitter *siem.Emitter
+	if siemConfig != nil {
+		if emitter, err = siem.New(siemConfig); err != nil {
+			return nil, err
+		}
+		s.onClose(func() error {
+			if err := emitter.Close(5 * time.Second); err != nil {
+				return fmt.Errorf("failed to flush SIEM events: %w", err)
+			}
+			return nil
+		})
+		log.Printf("Streaming authentication events to %s", siemConfig)
+	}
+
+	m := metrics.New()
+
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.New()
+	router.Use(otelgin.Middleware(tracing.ServiceName, otelgin.WithTracerProvider(tracerProvider),
+		otelgin.WithFilter(func(r *http.Request) bool {
+			return r.URL.Path != "/metrics"
+		})))
 	router.Use(gin.Logger())
+	router.Use(m.Middleware())
 	router.Use(gin.Recovery())
+	router.Use(requestTimeout(cfg.RequestTimeout))
+
+	// Client IPs drive the per-IP lockout, so forwarding headers are only
+	// honoured from explicitly trusted proxies
+	if err := router.SetTrustedProxies(trustedProxies()); err != nil {
+		return nil, err
+	}
 
 	// Initialize database
 	db, err := database.NewDB()
 	if err != nil {
 		return nil, err
 	}
+	s.onClose(func() error {
+		if err := db.Close(); err != nil {
+			return fmt.Errorf("failed to close database: %w", err)
+		}
+		return nil
+	})
+	db.SetQueryObserver(m)
+	db.SetTracerProvider(tracerProvider)
+	m.RegisterDBStats(db.Stats)
+
+	// Move secrets onto the active master key while serving; Close stops it
+	backgroundCtx, cancelBackground := context.WithCancel(context.Background())
+	s.onClose(func() error {
+		cancelBackground()
+		return nil
+	})
+	go func() {
+		rewrapped, err := db.RewrapSecrets(backgroundCtx, 100)
+		if err != nil {
+			log.Printf("Failed to rewrap secrets: %v", err)
+		}
+		if rewrapped > 0 {
+			log.Printf("Rewrapped %d secrets under the active master key", rewrapped)
+		}
+	}()
 
 	authManager := auth.NewAuthManager(db)
+	s.onClose(func() error {
+		return authManager.Close(5 * time.Second)
+	})
+	authManager.SetMetrics(m)
+	authManager.SetTracerProvider(tracerProvider)
+	if emitter != nil {
+		authManager.SetEventSink(emitter)
+	}
+
 	handler := handlers.NewHandler(authManager)
 
+	var listeners []listener
+	if radiusConfig != nil {
+		listeners = append(listeners, listener{"RADIUS server", radius.NewServer(radiusConfig, authManager)})
+	}
+	if ldapConfig != nil {
+		// Served as LDAPS with the HTTP certificate when TLS is enabled
+		listeners = append(listeners, listener{"LDAP bind proxy", ldap.NewServer(ldapConfig, authManager, tlsConfig)})
+	}
+	if grpcConfig := grpcapi.LoadConfig(); grpcConfig != nil {
+		listeners = append(listeners, listener{"gRPC server", grpcapi.NewServer(grpcConfig, authManager, tlsConfig)})
+	}
+
+	router.GET("/metrics", gin.WrapH(m.Handler()))
+
 	// Public routes
 	router.POST("/register", handler.RegisterMasterToken)
+	router.POST("/register/confirm", handler.ConfirmMasterToken)
 	router.POST("/validate-otp", handler.ValidateOTP)
+	router.POST("/session", handler.CreateSession)
+	router.POST("/session/refresh", handler.RefreshSession)
+	router.DELETE("/session", handler.RevokeSession)
+
+	// Authentication subrequests of reverse proxies, which may use any method
+	router.Any("/forward-auth", authManager.ForwardAuth())
 
 	// Protected routes
 	protected := router.Group("/api")
@@ -39,22 +243,173 @@ func NewServer() (*Server, error) {
 	{
 		protected.GET("/status", handler.GetStatus)
 		protected.GET("/protected-data", handler.GetProtectedData)
+		protected.GET("/recovery-codes", handler.GetRecoveryCodes)
+		protected.POST("/recovery-codes", handler.RegenerateRecoveryCodes)
 	}
 
-	return &Server{
-		router: router,
-		auth:   authManager,
-		db:     db,
-	}, nil
+	// Admin routes, only enabled with a dedicated credential
+	if adminToken := os.Getenv("ADMIN_TOKEN"); adminToken != "" {
+		admin := router.Group("/admin")
+		admin.Use(auth.AdminMiddleware(adminToken))
+		{
+			admin.GET("/tokens", handler.ListTokens)
+			admin.GET("/tokens/:id", handler.GetToken)
+			admin.POST("/tokens/:id/deactivate", handler.DeactivateToken)
+			admin.POST("/tokens/:id/reactivate", handler.ReactivateToken)
+			admin.POST("/tokens/:id/rotate", handler.RotateToken)
+			admin.PUT("/tokens/:id/client-cert", handler.BindClientCert)
+			admin.DELETE("/tokens/:id/client-cert", handler.UnbindClientCert)
+			admin.DELETE("/tokens/:id", handler.DeleteToken)
+			admin.DELETE("/tokens/:id/lockout", handler.ClearTokenLockout)
+			admin.DELETE("/lockouts/:ip", handler.ClearIPLockout)
+			admin.GET("/audit-events", handler.ListAuditEvents)
+			admin.GET("/audit-events/verify", handler.VerifyAuditLog)
+		}
+	} else {
+		log.Println("ADMIN_TOKEN not set, admin API disabled")
+	}
+
+	s.router = router
+	s.auth = authManager
+	s.db = db
+	s.tlsConfig = tlsConfig
+	s.listeners = listeners
+	return s, nil
 }
 
-func (s *Server) Run(addr string) error {
-	return s.router.Run(addr)
+// Run serves HTTP on addr, and RADIUS, LDAP and gRPC if configured, until ctx is cancelled.
+// It then stops accepting connections, waits up to the grace period for
+// in-flight requests and closes the database. It returns nil after a clean shutdown.
+func (s *Server) Run(ctx context.Context, addr string) error {
+	httpServer := &http.Server{
+		Addr:              addr,
+		Handler:           s.router,
+		ReadHeaderTimeout: s.cfg.ReadTimeout,
+		ReadTimeout:       s.cfg.ReadTimeout,
+		WriteTimeout:      s.cfg.WriteTimeout,
+		IdleTimeout:       s.cfg.IdleTimeout,
+		TLSConfig:         s.tlsConfig,
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if s.tlsConfig != nil {
+			// Certificates come from TLSConfig.GetCertificate
+			serveErr <- httpServer.ListenAndServeTLS("", "")
+			return
+		}
+		serveErr <- httpServer.ListenAndServe()
+	}()
+
+	listenerErr := make(chan error, len(s.listeners))
+	for _, l := range s.listeners {
+		log.Printf("Starting %s on %s", l.name, l.server.Addr())
+		go func(l listener) {
+			if err := l.server.ListenAndServe(); err != nil {
+				listenerErr <- fmt.Errorf("%s failed: %w", l.name, err)
+			}
+		}(l)
+	}
+
+	select {
+	case err := <-serveErr:
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownGracePeriod)
+		defer cancel()
+		return errors.Join(err, s.shutdownListeners(shutdownCtx), s.Close())
+	case err := <-listenerErr:
+		httpServer.Close()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownGracePeriod)
+		defer cancel()
+		return errors.Join(err, s.shutdownListeners(shutdownCtx), s.Close())
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down, waiting up to %s for in-flight requests", s.cfg.ShutdownGracePeriod)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownGracePeriod)
+	defer cancel()
+
+	shutdownErr := httpServer.Shutdown(shutdownCtx)
+	if shutdownErr != nil {
+		// Grace period expired, drop the remaining connections
+		httpServer.Close()
+		shutdownErr = fmt.Errorf("failed to drain requests: %w", shutdownErr)
+	}
+	if err := <-serveErr; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		shutdownErr = errors.Join(shutdownErr, err)
+	}
+	if err := s.shutdownListeners(shutdownCtx); err != nil {
+		shutdownErr = errors.Join(shutdownErr, err)
+	}
+
+	if err := s.Close(); err != nil {
+		shutdownErr = errors.Join(shutdownErr, err)
+	}
+	return shutdownErr
+}
+
+// shutdownListeners stops the protocol servers and waits for requests in
+// progress.
+func (s *Server) shutdownListeners(ctx context.Context) error {
+	var err error
+	for _, l := range s.listeners {
+		if shutdownErr := l.server.Shutdown(ctx); shutdownErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to drain %s requests: %w", l.name, shutdownErr))
+		}
+	}
+	return err
 }
 
+// onClose adds a function for Close to call.
+func (s *Server) onClose(closer func() error) {
+	s.closers = append(s.closers, closer)
+}
+
+// Close releases what NewServer set up in reverse order: it stops background
+// work, closes the database and flushes pending SIEM events and spans.
 func (s *Server) Close() error {
-	if s.db != nil {
-		return s.db.Close()
+	var err error
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		err = errors.Join(err, s.closers[i]())
+	}
+	s.closers = nil
+	return err
+}
+
+// requestTimeout cancels the request context after d. Handlers pass the
+// context down to the database, so a stuck query fails the request instead of
+// holding a connection.
+func requestTimeout(d time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), d)
+		defer cancel()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// trustedProxies parses the comma-separated TRUSTED_PROXIES list. An empty
+// list makes gin ignore X-Forwarded-For and use the peer address.
+func trustedProxies() []string {
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		log.Printf("Ignoring invalid %s=%q, using %s", key, value, defaultValue)
+		return defaultValue
 	}
-	return nil
+	return parsed
 }
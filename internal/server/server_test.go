@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeListener is a protocol server whose ListenAndServe fails with
+// serveErr, or blocks until Shutdown if serveErr is nil. With hang set,
+// Shutdown doesn't return before its context ends.
+type fakeListener struct {
+	serveErr error
+	hang     bool
+	stopped  chan struct{}
+}
+
+func newFakeListener(serveErr error, hang bool) *fakeListener {
+	return &fakeListener{serveErr: serveErr, hang: hang, stopped: make(chan struct{})}
+}
+
+func (l *fakeListener) Addr() string { return "fake" }
+
+func (l *fakeListener) ListenAndServe() error {
+	if l.serveErr != nil {
+		return l.serveErr
+	}
+	<-l.stopped
+	return nil
+}
+
+func (l *fakeListener) Shutdown(ctx context.Context) error {
+	if l.hang {
+		<-ctx.Done()
+		close(l.stopped)
+		return ctx.Err()
+	}
+	close(l.stopped)
+	return nil
+}
+
+func newTestServer(listeners ...listener) *Server {
+	gin.SetMode(gin.TestMode)
+	return &Server{
+		router:    gin.New(),
+		cfg:       Config{ShutdownGracePeriod: 100 * time.Millisecond},
+		listeners: listeners,
+	}
+}
+
+// runWithin runs s on a free port and fails the test unless Run returns
+// within timeout.
+func runWithin(t *testing.T, s *Server, ctx context.Context, timeout time.Duration) error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx, "127.0.0.1:0") }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		t.Fatal("Run() didn't return within the shutdown grace period")
+		return nil
+	}
+}
+
+func TestRun_ListenerFailureShutdownIsBounded(t *testing.T) {
+	failed := errors.New("listen udp :1812: address already in use")
+	s := newTestServer(
+		listener{"failing server", newFakeListener(failed, false)},
+		listener{"stuck server", newFakeListener(nil, true)},
+	)
+	closed := false
+	s.onClose(func() error {
+		closed = true
+		return nil
+	})
+
+	err := runWithin(t, s, context.Background(), 5*time.Second)
+	if !errors.Is(err, failed) {
+		t.Errorf("Run() error = %v, want the listener failure", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Run() error = %v, want the stuck server to be reported", err)
+	}
+	if !closed {
+		t.Error("Expected Run() to close the server")
+	}
+}
+
+func TestRun_ShutdownIsBounded(t *testing.T) {
+	s := newTestServer(listener{"stuck server", newFakeListener(nil, true)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := runWithin(t, s, ctx, 5*time.Second); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Run() error = %v, want the stuck server to be reported", err)
+	}
+}
+
+func TestClose_UnwindsInReverseOrder(t *testing.T) {
+	s := newTestServer()
+	var order []string
+	failed := errors.New("flush failed")
+	for _, name := range []string{"tracing", "siem", "database"} {
+		name := name
+		s.onClose(func() error {
+			order = append(order, name)
+			if name == "siem" {
+				return failed
+			}
+			return nil
+		})
+	}
+
+	// A failing step doesn't stop the others
+	if err := s.Close(); !errors.Is(err, failed) {
+		t.Errorf("Close() error = %v, want %v", err, failed)
+	}
+	if want := []string{"database", "siem", "tracing"}; !slices.Equal(order, want) {
+		t.Errorf("Close() order = %v, want %v", order, want)
+	}
+
+	// Closing again does nothing
+	if err := s.Close(); err != nil || len(order) != 3 {
+		t.Errorf("Second Close() = %v after %v", err, order)
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often the certificate files are checked for
+// changes. Checks happen during handshakes, so an idle server never stats.
+const certCheckInterval = time.Second
+
+// TLSConfig enables HTTPS and, with a client CA, mutual TLS.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile holds the PEM CA certificates client certificates are
+	// verified against. Empty disables client certificates.
+	ClientCAFile string
+	// RequireClientCert rejects handshakes without a valid client
+	// certificate. Otherwise one is verified if presented.
+	RequireClientCert bool
+}
+
+// loadTLSConfig reads the TLS settings from environment variables. It
+// returns nil if TLS_CERT_FILE and TLS_KEY_FILE are unset.
+func loadTLSConfig() (*TLSConfig, error) {
+	cfg := &TLSConfig{
+		CertFile:     os.Getenv("TLS_CERT_FILE"),
+		KeyFile:      os.Getenv("TLS_KEY_FILE"),
+		ClientCAFile: os.Getenv("TLS_CLIENT_CA_FILE"),
+	}
+
+	if cfg.CertFile == "" && cfg.KeyFile == "" {
+		if cfg.ClientCAFile != "" {
+			return nil, fmt.Errorf("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		return nil, nil
+	}
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	switch mode := strings.ToLower(os.Getenv("TLS_CLIENT_AUTH")); mode {
+	case "", "optional":
+	case "require":
+		cfg.RequireClientCert = true
+	default:
+		return nil, fmt.Errorf("invalid TLS_CLIENT_AUTH %q, expected optional or require", mode)
+	}
+	if cfg.RequireClientCert && cfg.ClientCAFile == "" {
+		return nil, fmt.Errorf("TLS_CLIENT_AUTH=require needs TLS_CLIENT_CA_FILE")
+	}
+
+	return cfg, nil
+}
+
+// build returns the crypto/tls configuration for the server. The server
+// certificate is reloaded whenever its files change on disk.
+func (cfg *TLSConfig) build() (*tls.Config, error) {
+	reloader, err := newCertReloader(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", cfg.ClientCAFile)
+		}
+
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if cfg.RequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// certReloader serves a certificate and key pair and picks up new versions
+// of the files, e.g. after a renewal, without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	certMod   time.Time
+	keyMod    time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	r.lastCheck = time.Now()
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now := time.Now(); now.Sub(r.lastCheck) >= certCheckInterval {
+		r.lastCheck = now
+		if err := r.reload(); err != nil {
+			// Keep serving the previous certificate; the files may be
+			// halfway through being replaced
+			log.Printf("Failed to reload TLS certificate: %v", err)
+		}
+	}
+	return r.cert, nil
+}
+
+// reload loads the key pair if either file changed since the last load.
+func (r *certReloader) reload() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat TLS certificate: %w", err)
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat TLS key: %w", err)
+	}
+	if r.cert != nil && certInfo.ModTime().Equal(r.certMod) && keyInfo.ModTime().Equal(r.keyMod) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS key pair: %w", err)
+	}
+
+	if r.cert != nil {
+		log.Printf("Reloaded TLS certificate from %s", r.certFile)
+	}
+	r.cert = &cert
+	r.certMod = certInfo.ModTime()
+	r.keyMod = keyInfo.ModTime()
+	return nil
+}
@@ -0,0 +1,371 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"otp-basic/internal/auth"
+	"otp-basic/internal/database"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pquerna/otp/totp"
+)
+
+// testCA issues certificates for the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse CA certificate: %v", err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate and key for commonName. Server
+// certificates are valid for localhost.
+func (ca *testCA) issue(t *testing.T, commonName string, server bool) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("Failed to generate serial number: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.DNSNames = []string{"localhost"}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// clientCert returns a key pair for commonName to present as a client.
+func (ca *testCA) clientCert(t *testing.T, commonName string) tls.Certificate {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, commonName, false)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("Failed to load client key pair: %v", err)
+	}
+	return cert
+}
+
+// writeFile writes data to a file in dir, setting its modification time to
+// modTime so a reload can't miss the change within the file system's
+// timestamp resolution.
+func writeFile(t *testing.T, dir, name string, data []byte, modTime time.Time) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("Failed to set modification time of %s: %v", name, err)
+	}
+	return path
+}
+
+// writeServerCert issues a server certificate for commonName and writes it
+// and its key to dir.
+func writeServerCert(t *testing.T, ca *testCA, dir, commonName string, modTime time.Time) *TLSConfig {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, commonName, true)
+	return &TLSConfig{
+		CertFile: writeFile(t, dir, "server.crt", certPEM, modTime),
+		KeyFile:  writeFile(t, dir, "server.key", keyPEM, modTime),
+	}
+}
+
+// startTLSServer serves handler with the TLS configuration built from cfg.
+func startTLSServer(t *testing.T, cfg *TLSConfig, handler http.Handler) *httptest.Server {
+	t.Helper()
+	tlsConfig, err := cfg.build()
+	if err != nil {
+		t.Fatalf("build() error = %v", err)
+	}
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = tlsConfig
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// get requests path on a new connection, so each request makes a handshake.
+// Clients connect to localhost so the server certificate is chosen by
+// GetCertificate rather than the one httptest adds.
+func get(server *httptest.Server, ca *testCA, clientCerts []tls.Certificate, path string, header http.Header) (*http.Response, error) {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:      roots,
+				ServerName:   "localhost",
+				Certificates: clientCerts,
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// subjectHandler answers with the verified client certificate subject in
+// the X-Client-Subject header.
+var subjectHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Client-Subject", auth.HTTPClientInfo(r).CertSubject)
+})
+
+func TestCertReloader_PicksUpRotatedCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	start := time.Now().Add(-time.Hour)
+	cfg := writeServerCert(t, ca, dir, "server-1", start)
+	server := startTLSServer(t, cfg, subjectHandler)
+
+	servedCert := func() string {
+		t.Helper()
+		resp, err := get(server, ca, nil, "/", nil)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		return resp.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	if got := servedCert(); got != "server-1" {
+		t.Fatalf("Served certificate %q, want server-1", got)
+	}
+
+	// A renewal that is still being written keeps the old certificate
+	writeFile(t, dir, "server.crt", []byte("partial"), start.Add(time.Minute))
+	time.Sleep(certCheckInterval + 100*time.Millisecond)
+	if got := servedCert(); got != "server-1" {
+		t.Errorf("Served certificate %q while the files were invalid, want server-1", got)
+	}
+
+	writeServerCert(t, ca, dir, "server-2", start.Add(2*time.Minute))
+	time.Sleep(certCheckInterval + 100*time.Millisecond)
+	if got := servedCert(); got != "server-2" {
+		t.Errorf("Served certificate %q after the renewal, want server-2", got)
+	}
+}
+
+func TestTLSConfig_ClientCertificates(t *testing.T) {
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+	dir := t.TempDir()
+	clientCAFile := writeFile(t, dir, "client-ca.crt", ca.pem, time.Now())
+
+	trusted := []tls.Certificate{ca.clientCert(t, "alice")}
+	untrusted := []tls.Certificate{otherCA.clientCert(t, "alice")}
+
+	tests := []struct {
+		name    string
+		require bool
+		certs   []tls.Certificate
+		// wantSubject is the verified subject, or "" if none
+		wantSubject string
+		wantErr     bool
+	}{
+		{name: "optional without certificate"},
+		{name: "optional with trusted certificate", certs: trusted, wantSubject: "CN=alice"},
+		{name: "optional with untrusted certificate", certs: untrusted, wantErr: true},
+		{name: "required without certificate", require: true, wantErr: true},
+		{name: "required with trusted certificate", require: true, certs: trusted, wantSubject: "CN=alice"},
+		{name: "required with untrusted certificate", require: true, certs: untrusted, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := writeServerCert(t, ca, t.TempDir(), "server", time.Now())
+			cfg.ClientCAFile = clientCAFile
+			cfg.RequireClientCert = tt.require
+			server := startTLSServer(t, cfg, subjectHandler)
+
+			resp, err := get(server, ca, tt.certs, "/", nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected the handshake to fail, got %s", resp.Status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			if got := resp.Header.Get("X-Client-Subject"); got != tt.wantSubject {
+				t.Errorf("Client subject = %q, want %q", got, tt.wantSubject)
+			}
+		})
+	}
+}
+
+func TestTLSConfig_RejectsWrongClientCertSubject(t *testing.T) {
+	// A failed attempt backs off the next one, which isn't under test here
+	t.Setenv("LOCKOUT_BACKOFF_BASE", "1ns")
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+
+	am := auth.NewAuthManager(database.NewMemoryStore())
+	token, err := am.RegisterMasterToken(ctx, "TestApp", "alice", auth.DefaultTokenOptions())
+	if err != nil {
+		t.Fatalf("Failed to register master token: %v", err)
+	}
+	code, err := totp.GenerateCode(token.Secret, time.Now().Add(-30*time.Second))
+	if err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+	if err := am.ConfirmMasterToken(ctx, token.ID, code, auth.ClientInfo{IP: "192.0.2.1"}); err != nil {
+		t.Fatalf("Failed to confirm master token: %v", err)
+	}
+	if _, err := am.BindClientCert(ctx, token.ID, "CN=alice"); err != nil {
+		t.Fatalf("BindClientCert() error = %v", err)
+	}
+
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	cfg := writeServerCert(t, ca, dir, "server", time.Now())
+	cfg.ClientCAFile = writeFile(t, dir, "client-ca.crt", ca.pem, time.Now())
+	cfg.RequireClientCert = true
+
+	router := gin.New()
+	router.GET("/protected", am.OTPMiddleware(), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	server := startTLSServer(t, cfg, router)
+
+	code, err = totp.GenerateCode(token.Secret, time.Now())
+	if err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+	header := http.Header{"X-User-Id": {token.ID}, "X-Otp": {code}}
+
+	// A certificate from the trusted CA, but for someone else
+	resp, err := get(server, ca, []tls.Certificate{ca.clientCert(t, "mallory")}, "/protected", header)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Status with another subject = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+	time.Sleep(time.Millisecond)
+
+	resp, err = get(server, ca, []tls.Certificate{ca.clientCert(t, "alice")}, "/protected", header)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Status with the bound subject = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "disabled", wantNil: true},
+		{name: "certificate without key", env: map[string]string{"TLS_CERT_FILE": "server.crt"}, wantErr: true},
+		{name: "client CA without certificate", env: map[string]string{"TLS_CLIENT_CA_FILE": "ca.crt"}, wantErr: true},
+		{
+			name:    "required client certificate without CA",
+			env:     map[string]string{"TLS_CERT_FILE": "server.crt", "TLS_KEY_FILE": "server.key", "TLS_CLIENT_AUTH": "require"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid client auth mode",
+			env:     map[string]string{"TLS_CERT_FILE": "server.crt", "TLS_KEY_FILE": "server.key", "TLS_CLIENT_AUTH": "always"},
+			wantErr: true,
+		},
+		{
+			name: "required client certificate",
+			env: map[string]string{
+				"TLS_CERT_FILE": "server.crt", "TLS_KEY_FILE": "server.key",
+				"TLS_CLIENT_CA_FILE": "ca.crt", "TLS_CLIENT_AUTH": "require",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"TLS_CERT_FILE", "TLS_KEY_FILE", "TLS_CLIENT_CA_FILE", "TLS_CLIENT_AUTH"} {
+				t.Setenv(name, tt.env[name])
+			}
+			cfg, err := loadTLSConfig()
+			switch {
+			case tt.wantErr:
+				if err == nil {
+					t.Errorf("loadTLSConfig() = %+v, want an error", cfg)
+				}
+			case err != nil:
+				t.Errorf("loadTLSConfig() error = %v", err)
+			case (cfg == nil) != tt.wantNil:
+				t.Errorf("loadTLSConfig() = %+v, want nil: %v", cfg, tt.wantNil)
+			}
+		})
+	}
+}
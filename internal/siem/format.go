@@ -0,0 +1,170 @@
+package siem
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"otp-basic/internal/auth"
+	"otp-basic/internal/metrics"
+)
+
+// Supported values of SIEM_FORMAT.
+const (
+	FormatCEF  = "cef"
+	FormatLEEF = "leef"
+)
+
+const (
+	vendor  = "otp-basic"
+	product = "otp-server"
+	version = "1.0"
+
+	// facilityAuthPriv is the syslog facility for security messages.
+	facilityAuthPriv = 10
+)
+
+// Syslog severities used for events.
+const (
+	severityError   = 3
+	severityWarning = 4
+	severityNotice  = 5
+	severityInfo    = 6
+)
+
+var eventNames = map[string]string{
+	auth.EventRegistration:      "Master token registered",
+	auth.EventConfirmation:      "Master token confirmation",
+	auth.EventValidation:        "OTP validation",
+	auth.EventLockout:           "OTP lockout",
+	auth.EventDeactivation:      "Master token deactivated",
+	auth.EventReactivation:      "Master token reactivated",
+	auth.EventSecretRotation:    "Master token secret rotated",
+	auth.EventDeletion:          "Master token deleted",
+	auth.EventClientCertBinding: "Client certificate binding changed",
+}
+
+// severity rates an event on the syslog scale and the 0-10 CEF scale.
+func severity(event *auth.AuthEvent) (syslog, cef int) {
+	switch {
+	case event.Type == auth.EventLockout:
+		return severityWarning, 8
+	case event.Outcome == metrics.OutcomeError:
+		return severityError, 7
+	case event.Outcome == metrics.OutcomeValid || event.Outcome == auth.EventOutcomeSuccess:
+		return severityInfo, 3
+	default:
+		return severityNotice, 5
+	}
+}
+
+// syslogMessage wraps payload in an RFC 5424 header. The event type is the
+// MSGID so collectors can route on it without parsing the payload.
+func syslogMessage(event *auth.AuthEvent, hostname string, pid int, payload string) string {
+	sev, _ := severity(event)
+	return fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+		facilityAuthPriv*8+sev,
+		event.OccurredAt.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		headerValue(hostname), product, pid, headerValue(event.Type), payload)
+}
+
+// headerValue makes s a valid RFC 5424 header field: printable ASCII
+// without spaces, or "-" if empty.
+func headerValue(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func eventName(event *auth.AuthEvent) string {
+	if name, ok := eventNames[event.Type]; ok {
+		return name
+	}
+	return event.Type
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+)
+
+// formatCEF encodes an event in ArcSight Common Event Format.
+func formatCEF(event *auth.AuthEvent) string {
+	_, sev := severity(event)
+
+	var ext []string
+	add := func(key, value string) {
+		if value != "" {
+			ext = append(ext, key+"="+cefExtensionEscaper.Replace(value))
+		}
+	}
+	add("rt", strconv.FormatInt(event.OccurredAt.UnixMilli(), 10))
+	add("act", event.Type)
+	add("outcome", event.Outcome)
+	add("suser", event.TokenID)
+	add("src", event.SourceIP)
+	add("requestClientApplication", event.UserAgent)
+	add("externalId", strconv.FormatInt(event.ID, 10))
+
+	return fmt.Sprintf("CEF:0|%s|%s|%s|%s|%s|%d|%s",
+		cefHeaderEscaper.Replace(vendor),
+		cefHeaderEscaper.Replace(product),
+		cefHeaderEscaper.Replace(version),
+		cefHeaderEscaper.Replace(event.Type),
+		cefHeaderEscaper.Replace(eventName(event)),
+		sev,
+		strings.Join(ext, " "))
+}
+
+var (
+	leefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	leefValueEscaper  = strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+)
+
+// formatLEEF encodes an event in IBM QRadar Log Event Extended Format 1.0,
+// with tab-separated attributes.
+func formatLEEF(event *auth.AuthEvent) string {
+	_, sev := severity(event)
+
+	var attrs []string
+	add := func(key, value string) {
+		if value != "" {
+			attrs = append(attrs, key+"="+leefValueEscaper.Replace(value))
+		}
+	}
+	add("devTime", event.OccurredAt.UTC().Format("Jan 02 2006 15:04:05.000 UTC"))
+	add("devTimeFormat", "MMM dd yyyy HH:mm:ss.SSS z")
+	add("cat", event.Type)
+	add("sev", strconv.Itoa(sev))
+	add("outcome", event.Outcome)
+	add("usrName", event.TokenID)
+	add("src", event.SourceIP)
+	add("userAgent", event.UserAgent)
+	add("eventId", strconv.FormatInt(event.ID, 10))
+
+	return fmt.Sprintf("LEEF:1.0|%s|%s|%s|%s|%s",
+		leefHeaderEscaper.Replace(vendor),
+		leefHeaderEscaper.Replace(product),
+		leefHeaderEscaper.Replace(version),
+		leefHeaderEscaper.Replace(event.Type),
+		strings.Join(attrs, "\t"))
+}
+
+// formatter returns the payload encoder for a SIEM_FORMAT value.
+func formatter(format string) (func(*auth.AuthEvent) string, error) {
+	switch format {
+	case FormatCEF:
+		return formatCEF, nil
+	case FormatLEEF:
+		return formatLEEF, nil
+	default:
+		return nil, fmt.Errorf("unsupported SIEM_FORMAT %q, expected %s or %s", format, FormatCEF, FormatLEEF)
+	}
+}
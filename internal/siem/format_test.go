@@ -0,0 +1,161 @@
+package siem
+
+import (
+	"testing"
+	"time"
+
+	"otp-basic/internal/auth"
+	"otp-basic/internal/metrics"
+)
+
+// testEvent returns a validation event whose fields need escaping in both
+// encodings.
+func testEvent() *auth.AuthEvent {
+	return &auth.AuthEvent{
+		ID:         42,
+		OccurredAt: time.Date(2024, 1, 2, 3, 4, 5, 123456000, time.UTC),
+		Type:       auth.EventValidation,
+		TokenID:    `id=1|2\3`,
+		SourceIP:   "192.0.2.1",
+		UserAgent:  "curl/8.0\r\nX-Injected:\t1",
+		Outcome:    metrics.OutcomeInvalidCode,
+	}
+}
+
+func TestFormatCEF(t *testing.T) {
+	tests := []struct {
+		name  string
+		event func() *auth.AuthEvent
+		want  string
+	}{
+		{
+			name:  "extension values",
+			event: testEvent,
+			want: `CEF:0|otp-basic|otp-server|1.0|validation|OTP validation|5|` +
+				`rt=1704164645123 act=validation outcome=invalid_code suser=id\=1|2\\3 src=192.0.2.1 ` +
+				"requestClientApplication=curl/8.0\\r\\nX-Injected:\t1 externalId=42",
+		},
+		{
+			name: "header values",
+			event: func() *auth.AuthEvent {
+				event := testEvent()
+				event.Type = `custom|type\x`
+				event.TokenID = ""
+				event.UserAgent = ""
+				return event
+			},
+			want: `CEF:0|otp-basic|otp-server|1.0|custom\|type\\x|custom\|type\\x|5|` +
+				`rt=1704164645123 act=custom|type\\x outcome=invalid_code src=192.0.2.1 externalId=42`,
+		},
+		{
+			name: "lockout severity",
+			event: func() *auth.AuthEvent {
+				return &auth.AuthEvent{OccurredAt: time.UnixMilli(0), Type: auth.EventLockout, Outcome: auth.EventOutcomeFailure}
+			},
+			want: `CEF:0|otp-basic|otp-server|1.0|lockout|OTP lockout|8|rt=0 act=lockout outcome=failure externalId=0`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatCEF(tt.event()); got != tt.want {
+				t.Errorf("formatCEF() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatLEEF(t *testing.T) {
+	tests := []struct {
+		name  string
+		event func() *auth.AuthEvent
+		want  string
+	}{
+		{
+			name:  "attribute values",
+			event: testEvent,
+			want: "LEEF:1.0|otp-basic|otp-server|1.0|validation|" +
+				"devTime=Jan 02 2024 03:04:05.123 UTC\tdevTimeFormat=MMM dd yyyy HH:mm:ss.SSS z\t" +
+				"cat=validation\tsev=5\toutcome=invalid_code\tusrName=id=1|2\\3\tsrc=192.0.2.1\t" +
+				"userAgent=curl/8.0  X-Injected: 1\teventId=42",
+		},
+		{
+			name: "header values",
+			event: func() *auth.AuthEvent {
+				event := testEvent()
+				event.Type = `custom|type\x`
+				event.TokenID = ""
+				event.UserAgent = ""
+				event.Outcome = metrics.OutcomeValid
+				return event
+			},
+			want: `LEEF:1.0|otp-basic|otp-server|1.0|custom\|type\\x|` +
+				"devTime=Jan 02 2024 03:04:05.123 UTC\tdevTimeFormat=MMM dd yyyy HH:mm:ss.SSS z\t" +
+				"cat=custom|type\\x\tsev=3\toutcome=valid\tsrc=192.0.2.1\teventId=42",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatLEEF(tt.event()); got != tt.want {
+				t.Errorf("formatLEEF() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyslogMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		event    func() *auth.AuthEvent
+		hostname string
+		want     string
+	}{
+		{
+			name:     "notice",
+			event:    testEvent,
+			hostname: "otp-1.example.org",
+			want:     "<85>1 2024-01-02T03:04:05.123456Z otp-1.example.org otp-server 1234 validation - payload",
+		},
+		{
+			name: "error",
+			event: func() *auth.AuthEvent {
+				event := testEvent()
+				event.Outcome = metrics.OutcomeError
+				return event
+			},
+			hostname: "otp 1\n",
+			want:     "<83>1 2024-01-02T03:04:05.123456Z otp_1_ otp-server 1234 validation - payload",
+		},
+		{
+			name: "header values",
+			event: func() *auth.AuthEvent {
+				event := testEvent()
+				event.Type = "custom typeé"
+				event.OccurredAt = time.Date(2024, 1, 2, 4, 4, 5, 0, time.FixedZone("CET", 3600))
+				return event
+			},
+			hostname: "",
+			want:     "<85>1 2024-01-02T03:04:05.000000Z - otp-server 1234 custom_type_ - payload",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := syslogMessage(tt.event(), tt.hostname, 1234, "payload"); got != tt.want {
+				t.Errorf("syslogMessage() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatter(t *testing.T) {
+	for _, format := range []string{FormatCEF, FormatLEEF} {
+		if _, err := formatter(format); err != nil {
+			t.Errorf("formatter(%q) error = %v", format, err)
+		}
+	}
+	if _, err := formatter("json"); err == nil {
+		t.Error("Expected an error for an unsupported format")
+	}
+}
@@ -0,0 +1,321 @@
+// Package siem streams authentication events to a syslog collector in CEF or
+// LEEF encoding.
+package siem
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"otp-basic/internal/auth"
+)
+
+const (
+	defaultBufferSize = 1024
+
+	dialTimeout  = 5 * time.Second
+	writeTimeout = 5 * time.Second
+
+	// maxRedialDelay caps the backoff between attempts to reach an
+	// unavailable collector.
+	maxRedialDelay = 30 * time.Second
+
+	// dropReportInterval is how often dropped events are logged.
+	dropReportInterval = time.Minute
+)
+
+// Supported schemes of SIEM_SYSLOG_URL.
+const (
+	NetworkUDP  = "udp"
+	NetworkTCP  = "tcp"
+	NetworkTLS  = "tls"
+	NetworkUnix = "unix"
+)
+
+// Config selects the syslog target and encoding.
+type Config struct {
+	// Network is one of NetworkUDP, NetworkTCP, NetworkTLS or NetworkUnix.
+	Network string
+	// Address is host:port, or the socket path for NetworkUnix.
+	Address string
+	// Format is FormatCEF or FormatLEEF.
+	Format string
+	// BufferSize is how many events may wait to be sent before new ones
+	// are dropped.
+	BufferSize int
+	// TLS is used to dial NetworkTLS targets.
+	TLS *tls.Config
+}
+
+// LoadConfig reads the SIEM settings from environment variables. It returns
+// nil if SIEM_SYSLOG_URL is unset.
+func LoadConfig() (*Config, error) {
+	rawURL := os.Getenv("SIEM_SYSLOG_URL")
+	if rawURL == "" {
+		return nil, nil
+	}
+
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SIEM_SYSLOG_URL: %w", err)
+	}
+
+	cfg := &Config{
+		Network:    strings.ToLower(target.Scheme),
+		Address:    target.Host,
+		Format:     strings.ToLower(os.Getenv("SIEM_FORMAT")),
+		BufferSize: defaultBufferSize,
+	}
+	if cfg.Format == "" {
+		cfg.Format = FormatCEF
+	}
+	if _, err := formatter(cfg.Format); err != nil {
+		return nil, err
+	}
+
+	switch cfg.Network {
+	case NetworkUDP, NetworkTCP, NetworkTLS:
+		if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+			return nil, fmt.Errorf("SIEM_SYSLOG_URL needs a host and port: %w", err)
+		}
+	case NetworkUnix:
+		cfg.Address = target.Path
+		if cfg.Address == "" {
+			return nil, fmt.Errorf("SIEM_SYSLOG_URL needs a socket path, such as unix:///dev/log")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported SIEM_SYSLOG_URL scheme %q, expected udp, tcp, tls or unix", target.Scheme)
+	}
+
+	if value := os.Getenv("SIEM_BUFFER_SIZE"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 1 {
+			return nil, fmt.Errorf("SIEM_BUFFER_SIZE must be a positive integer")
+		}
+		cfg.BufferSize = size
+	}
+
+	if cfg.Network == NetworkTLS {
+		cfg.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+		if caFile := os.Getenv("SIEM_TLS_CA_FILE"); caFile != "" {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read SIEM CA file: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", caFile)
+			}
+			cfg.TLS.RootCAs = pool
+		}
+	}
+
+	return cfg, nil
+}
+
+// String describes the target for logs.
+func (cfg *Config) String() string {
+	return fmt.Sprintf("%s://%s (%s)", cfg.Network, cfg.Address, cfg.Format)
+}
+
+// Emitter sends events to a syslog collector from a background goroutine.
+// Emit only queues the event; when the queue is full, or the collector is
+// unreachable, events are dropped and counted rather than slowing down
+// authentication.
+type Emitter struct {
+	cfg      Config
+	format   func(*auth.AuthEvent) string
+	hostname string
+	pid      int
+
+	events  chan *auth.AuthEvent
+	dropped atomic.Uint64
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// The fields below are only used by the sending goroutine.
+	conn        net.Conn
+	datagram    bool
+	redialAt    time.Time
+	redialDelay time.Duration
+	reported    uint64
+}
+
+// New starts an emitter for cfg. The collector is dialled when the first
+// event is sent, so an unreachable collector doesn't prevent startup.
+func New(cfg *Config) (*Emitter, error) {
+	format, err := formatter(cfg.Format)
+	if err != nil {
+		return nil, err
+	}
+	bufferSize := cfg.BufferSize
+	if bufferSize < 1 {
+		bufferSize = defaultBufferSize
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = ""
+	}
+
+	e := &Emitter{
+		cfg:      *cfg,
+		format:   format,
+		hostname: hostname,
+		pid:      os.Getpid(),
+		events:   make(chan *auth.AuthEvent, bufferSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go e.run()
+	return e, nil
+}
+
+// Emit queues a copy of event for sending. It never blocks.
+func (e *Emitter) Emit(event *auth.AuthEvent) {
+	queued := *event
+	// Checked on its own, since select picks at random among ready cases
+	select {
+	case <-e.stop:
+		e.dropped.Add(1)
+		return
+	default:
+	}
+	select {
+	case e.events <- &queued:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+// Dropped returns how many events were never delivered.
+func (e *Emitter) Dropped() uint64 {
+	return e.dropped.Load()
+}
+
+// Close sends the events still queued, waiting at most timeout, and closes
+// the connection to the collector.
+func (e *Emitter) Close(timeout time.Duration) error {
+	e.closeOnce.Do(func() { close(e.stop) })
+
+	select {
+	case <-e.done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out sending %d queued SIEM events", len(e.events))
+	}
+}
+
+func (e *Emitter) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(dropReportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event := <-e.events:
+			e.send(event)
+		case <-ticker.C:
+			e.reportDrops()
+		case <-e.stop:
+			for {
+				select {
+				case event := <-e.events:
+					e.send(event)
+				default:
+					e.reportDrops()
+					if e.conn != nil {
+						e.conn.Close()
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// send writes one event, redialling once if the connection has gone away.
+func (e *Emitter) send(event *auth.AuthEvent) {
+	message := syslogMessage(event, e.hostname, e.pid, e.format(event))
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if e.conn == nil && !e.dial() {
+			break
+		}
+		e.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		_, err := e.conn.Write(e.frame(message))
+		if err == nil {
+			return
+		}
+		log.Printf("Failed to send SIEM event to %s: %v", e.cfg.String(), err)
+		e.conn.Close()
+		e.conn = nil
+	}
+	e.dropped.Add(1)
+}
+
+// frame encodes a message for the connection. Stream transports use the
+// octet-counting framing of RFC 6587; datagrams carry one message each.
+func (e *Emitter) frame(message string) []byte {
+	if e.datagram {
+		return []byte(message)
+	}
+	return []byte(strconv.Itoa(len(message)) + " " + message)
+}
+
+// dial connects to the collector unless a previous attempt failed recently.
+func (e *Emitter) dial() bool {
+	if time.Now().Before(e.redialAt) {
+		return false
+	}
+
+	var conn net.Conn
+	var err error
+	datagram := e.cfg.Network == NetworkUDP
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	switch e.cfg.Network {
+	case NetworkTLS:
+		conn, err = tls.DialWithDialer(dialer, "tcp", e.cfg.Address, e.cfg.TLS)
+	case NetworkUnix:
+		// Local syslog daemons listen on datagram sockets, some on streams
+		datagram = true
+		if conn, err = dialer.Dial("unixgram", e.cfg.Address); err != nil {
+			datagram = false
+			conn, err = dialer.Dial("unix", e.cfg.Address)
+		}
+	default:
+		conn, err = dialer.Dial(e.cfg.Network, e.cfg.Address)
+	}
+
+	if err != nil {
+		e.redialDelay = min(max(2*e.redialDelay, time.Second), maxRedialDelay)
+		e.redialAt = time.Now().Add(e.redialDelay)
+		log.Printf("Failed to connect to SIEM collector %s, retrying in %s: %v", e.cfg.String(), e.redialDelay, err)
+		return false
+	}
+
+	e.conn = conn
+	e.datagram = datagram
+	e.redialDelay = 0
+	return true
+}
+
+func (e *Emitter) reportDrops() {
+	dropped := e.dropped.Load()
+	if dropped > e.reported {
+		log.Printf("Dropped %d SIEM events (%d in total)", dropped-e.reported, dropped)
+		e.reported = dropped
+	}
+}
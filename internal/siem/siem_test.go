@@ -0,0 +1,262 @@
+package siem
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"otp-basic/internal/auth"
+)
+
+// readFrame reads one RFC 6587 octet-counted message.
+func readFrame(r *bufio.Reader) (string, error) {
+	length, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+	if err != nil {
+		return "", fmt.Errorf("invalid frame length %q", length)
+	}
+	message := make([]byte, n)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return "", err
+	}
+	return string(message), nil
+}
+
+// tcpCollector accepts connections and passes on the messages received on
+// each, tagged with the number of the connection.
+type tcpCollector struct {
+	listener net.Listener
+	messages chan string
+	conns    chan net.Conn
+}
+
+func startTCPCollector(t *testing.T) *tcpCollector {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	c := &tcpCollector{listener: listener, messages: make(chan string, 100), conns: make(chan net.Conn, 10)}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for n := 1; ; n++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			c.conns <- conn
+			go func(n int) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					message, err := readFrame(reader)
+					if err != nil {
+						return
+					}
+					c.messages <- strconv.Itoa(n) + ":" + message
+				}
+			}(n)
+		}
+	}()
+	return c
+}
+
+func receive(t *testing.T, messages <-chan string) string {
+	t.Helper()
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a SIEM message")
+		return ""
+	}
+}
+
+func newEmitter(t *testing.T, cfg *Config) *Emitter {
+	t.Helper()
+	e, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	t.Cleanup(func() { e.Close(time.Second) })
+	return e
+}
+
+func TestEmitter_TCP(t *testing.T) {
+	collector := startTCPCollector(t)
+	e := newEmitter(t, &Config{Network: NetworkTCP, Address: collector.listener.Addr().String(), Format: FormatCEF})
+
+	event := testEvent()
+	e.Emit(event)
+	e.Emit(event)
+
+	want := syslogMessage(event, e.hostname, e.pid, formatCEF(event))
+	for i := 0; i < 2; i++ {
+		// Both messages arrive whole on one connection, so the framing
+		// kept them apart
+		if got := receive(t, collector.messages); got != "1:"+want {
+			t.Errorf("Received %q, want %q", got, "1:"+want)
+		}
+	}
+	if e.Dropped() != 0 {
+		t.Errorf("Dropped() = %d, want 0", e.Dropped())
+	}
+}
+
+func TestEmitter_UDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer conn.Close()
+	e := newEmitter(t, &Config{Network: NetworkUDP, Address: conn.LocalAddr().String(), Format: FormatLEEF})
+
+	event := testEvent()
+	e.Emit(event)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom() error = %v", err)
+	}
+	// Datagrams carry the message without a length prefix
+	if got, want := string(buf[:n]), syslogMessage(event, e.hostname, e.pid, formatLEEF(event)); got != want {
+		t.Errorf("Received %q, want %q", got, want)
+	}
+}
+
+func TestEmitter_RedialsAfterDisconnect(t *testing.T) {
+	collector := startTCPCollector(t)
+	e := newEmitter(t, &Config{Network: NetworkTCP, Address: collector.listener.Addr().String(), Format: FormatCEF})
+
+	e.Emit(testEvent())
+	if got := receive(t, collector.messages); !strings.HasPrefix(got, "1:") {
+		t.Fatalf("Received %q on the wrong connection", got)
+	}
+
+	// The collector restarts. The first write after that may still
+	// succeed locally, so keep sending until one arrives on a new
+	// connection.
+	(<-collector.conns).Close()
+	deadline := time.After(5 * time.Second)
+	for {
+		e.Emit(testEvent())
+		select {
+		case message := <-collector.messages:
+			if strings.HasPrefix(message, "2:") {
+				return
+			}
+		case <-time.After(20 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("Timed out waiting for the emitter to reconnect")
+		}
+	}
+}
+
+func TestEmitter_DropsWhenCollectorUnreachable(t *testing.T) {
+	// Reserve a port and close it so nothing listens there
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	e := newEmitter(t, &Config{Network: NetworkTCP, Address: addr, Format: FormatCEF})
+	e.Emit(testEvent())
+	e.Emit(testEvent())
+	if err := e.Close(5 * time.Second); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// The first failed dial backs off, so the second event isn't held up
+	// by another attempt
+	if e.Dropped() != 2 {
+		t.Errorf("Dropped() = %d, want 2", e.Dropped())
+	}
+	if e.redialDelay != time.Second {
+		t.Errorf("redialDelay = %s, want 1s after one failure", e.redialDelay)
+	}
+}
+
+func TestEmitter_DropsWhenBufferFull(t *testing.T) {
+	// An emitter whose sender isn't running, so nothing leaves the queue
+	e := &Emitter{events: make(chan *auth.AuthEvent, 2), stop: make(chan struct{})}
+
+	for i := 0; i < 5; i++ {
+		e.Emit(testEvent())
+	}
+	if len(e.events) != 2 || e.Dropped() != 3 {
+		t.Errorf("Queued %d and dropped %d events, want 2 and 3", len(e.events), e.Dropped())
+	}
+
+	// Events emitted after Close are dropped too
+	<-e.events
+	close(e.stop)
+	e.Emit(testEvent())
+	if e.Dropped() != 4 {
+		t.Errorf("Dropped() after stop = %d, want 4", e.Dropped())
+	}
+}
+
+func TestEmitter_CloseSendsQueuedEvents(t *testing.T) {
+	collector := startTCPCollector(t)
+	e, err := New(&Config{Network: NetworkTCP, Address: collector.listener.Addr().String(), Format: FormatCEF})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		e.Emit(testEvent())
+	}
+	if err := e.Close(5 * time.Second); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		receive(t, collector.messages)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		want    string
+		wantErr bool
+	}{
+		{name: "udp", url: "udp://siem.example.org:514", want: "udp://siem.example.org:514 (cef)"},
+		{name: "unix socket", url: "unix:///dev/log", want: "unix:///dev/log (cef)"},
+		{name: "missing port", url: "tcp://siem.example.org", wantErr: true},
+		{name: "missing socket path", url: "unix://", wantErr: true},
+		{name: "unsupported scheme", url: "http://siem.example.org:514", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SIEM_SYSLOG_URL", tt.url)
+			cfg, err := LoadConfig()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("LoadConfig() = %v, want an error", cfg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig() error = %v", err)
+			}
+			if cfg.String() != tt.want {
+				t.Errorf("LoadConfig() = %s, want %s", cfg, tt.want)
+			}
+		})
+	}
+}
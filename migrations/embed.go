@@ -0,0 +1,11 @@
+// Package migrations embeds the SQL migrations so the server binary can
+// apply them from any working directory.
+package migrations
+
+import "embed"
+
+// FS holds one directory of migrations per database driver, named after the
+// driver ("postgres", "sqlite").
+//
+//go:embed postgres/*.sql sqlite/*.sql
+var FS embed.FS
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS used_otps (
+    token_id VARCHAR(36) NOT NULL REFERENCES master_tokens(id) ON DELETE CASCADE,
+    time_step BIGINT NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (token_id, time_step)
+);
+
+CREATE INDEX IF NOT EXISTS idx_used_otps_used_at ON used_otps(used_at);
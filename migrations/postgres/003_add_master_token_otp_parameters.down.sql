@@ -0,0 +1,5 @@
+ALTER TABLE master_tokens
+    DROP COLUMN IF EXISTS skew,
+    DROP COLUMN IF EXISTS period,
+    DROP COLUMN IF EXISTS digits,
+    DROP COLUMN IF EXISTS algorithm;
@@ -0,0 +1,9 @@
+ALTER TABLE master_tokens
+    ADD COLUMN IF NOT EXISTS algorithm VARCHAR(10) NOT NULL DEFAULT 'SHA1'
+        CHECK (algorithm IN ('SHA1', 'SHA256', 'SHA512')),
+    ADD COLUMN IF NOT EXISTS digits INTEGER NOT NULL DEFAULT 6
+        CHECK (digits IN (6, 8)),
+    ADD COLUMN IF NOT EXISTS period INTEGER NOT NULL DEFAULT 30
+        CHECK (period BETWEEN 15 AND 300),
+    ADD COLUMN IF NOT EXISTS skew INTEGER NOT NULL DEFAULT 1
+        CHECK (skew BETWEEN 0 AND 2);
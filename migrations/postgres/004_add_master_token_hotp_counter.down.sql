@@ -0,0 +1,3 @@
+ALTER TABLE master_tokens
+    DROP COLUMN IF EXISTS counter,
+    DROP COLUMN IF EXISTS type;
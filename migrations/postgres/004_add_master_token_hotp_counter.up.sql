@@ -0,0 +1,5 @@
+ALTER TABLE master_tokens
+    ADD COLUMN IF NOT EXISTS type VARCHAR(4) NOT NULL DEFAULT 'totp'
+        CHECK (type IN ('totp', 'hotp')),
+    ADD COLUMN IF NOT EXISTS counter BIGINT NOT NULL DEFAULT 0
+        CHECK (counter >= 0);
@@ -0,0 +1,7 @@
+-- Rows written with master keys configured are unreadable after this rollback.
+DROP INDEX IF EXISTS idx_master_tokens_key_id;
+
+ALTER TABLE master_tokens
+    DROP COLUMN IF EXISTS key_id,
+    DROP COLUMN IF EXISTS data_key,
+    ALTER COLUMN secret TYPE VARCHAR(255);
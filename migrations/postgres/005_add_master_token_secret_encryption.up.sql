@@ -0,0 +1,6 @@
+ALTER TABLE master_tokens
+    ALTER COLUMN secret TYPE TEXT,
+    ADD COLUMN IF NOT EXISTS data_key TEXT,
+    ADD COLUMN IF NOT EXISTS key_id VARCHAR(64);
+
+CREATE INDEX IF NOT EXISTS idx_master_tokens_key_id ON master_tokens(key_id);
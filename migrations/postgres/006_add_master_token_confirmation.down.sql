@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_master_tokens_pending;
+
+DELETE FROM master_tokens WHERE confirmed_at IS NULL;
+
+ALTER TABLE master_tokens
+    DROP COLUMN IF EXISTS confirmed_at;
@@ -0,0 +1,7 @@
+ALTER TABLE master_tokens
+    ADD COLUMN IF NOT EXISTS confirmed_at TIMESTAMP WITH TIME ZONE;
+
+-- Tokens created before two-step enrollment count as confirmed
+UPDATE master_tokens SET confirmed_at = created_at WHERE confirmed_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_master_tokens_pending ON master_tokens(created_at) WHERE confirmed_at IS NULL;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id BIGSERIAL PRIMARY KEY,
+    token_id VARCHAR(36) NOT NULL REFERENCES master_tokens(id) ON DELETE CASCADE,
+    code_hash VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    used_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_unused ON recovery_codes(token_id) WHERE used_at IS NULL;
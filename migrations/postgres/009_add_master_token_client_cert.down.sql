@@ -0,0 +1,2 @@
+ALTER TABLE master_tokens
+    DROP COLUMN IF EXISTS client_cert_subject;
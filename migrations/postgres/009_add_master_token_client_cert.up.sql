@@ -0,0 +1,2 @@
+ALTER TABLE master_tokens
+    ADD COLUMN IF NOT EXISTS client_cert_subject TEXT;
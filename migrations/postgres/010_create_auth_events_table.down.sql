@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS auth_events;
+DROP FUNCTION IF EXISTS reject_auth_event_change();
@@ -0,0 +1,30 @@
+CREATE TABLE IF NOT EXISTS auth_events (
+    id BIGSERIAL PRIMARY KEY,
+    occurred_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    event_type VARCHAR(32) NOT NULL,
+    token_id TEXT NOT NULL DEFAULT '',
+    source_ip TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    outcome VARCHAR(32) NOT NULL,
+    prev_hash VARCHAR(64) NOT NULL,
+    hash VARCHAR(64) NOT NULL UNIQUE
+);
+
+CREATE INDEX IF NOT EXISTS idx_auth_events_token_id ON auth_events(token_id);
+CREATE INDEX IF NOT EXISTS idx_auth_events_occurred_at ON auth_events(occurred_at);
+
+-- The log is append-only. Rows deliberately don't reference master_tokens so
+-- they outlive deleted tokens.
+CREATE OR REPLACE FUNCTION reject_auth_event_change() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'auth_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER auth_events_append_only
+    BEFORE UPDATE OR DELETE ON auth_events
+    FOR EACH ROW EXECUTE FUNCTION reject_auth_event_change();
+
+CREATE TRIGGER auth_events_no_truncate
+    BEFORE TRUNCATE ON auth_events
+    FOR EACH STATEMENT EXECUTE FUNCTION reject_auth_event_change();
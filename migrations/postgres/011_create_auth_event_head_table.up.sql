@@ -0,0 +1,12 @@
+-- A single row holding the hash of the last audit event. Appends lock it to
+-- chain events one after another without locking auth_events itself.
+CREATE TABLE IF NOT EXISTS auth_event_head (
+    id SMALLINT PRIMARY KEY CHECK (id = 1),
+    hash VARCHAR(64) NOT NULL
+);
+
+INSERT INTO auth_event_head (id, hash)
+SELECT 1, COALESCE(
+    (SELECT hash FROM auth_events ORDER BY id DESC LIMIT 1),
+    '0000000000000000000000000000000000000000000000000000000000000000')
+ON CONFLICT (id) DO NOTHING;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS master_tokens (
+    id TEXT PRIMARY KEY,
+    secret TEXT NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    issuer TEXT,
+    account_name TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_master_tokens_active ON master_tokens(is_active);
+CREATE INDEX IF NOT EXISTS idx_master_tokens_created_at ON master_tokens(created_at);
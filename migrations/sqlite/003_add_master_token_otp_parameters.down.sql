@@ -0,0 +1,4 @@
+ALTER TABLE master_tokens DROP COLUMN skew;
+ALTER TABLE master_tokens DROP COLUMN period;
+ALTER TABLE master_tokens DROP COLUMN digits;
+ALTER TABLE master_tokens DROP COLUMN algorithm;
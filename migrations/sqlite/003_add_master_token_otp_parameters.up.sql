@@ -0,0 +1,8 @@
+ALTER TABLE master_tokens ADD COLUMN algorithm TEXT NOT NULL DEFAULT 'SHA1'
+    CHECK (algorithm IN ('SHA1', 'SHA256', 'SHA512'));
+ALTER TABLE master_tokens ADD COLUMN digits INTEGER NOT NULL DEFAULT 6
+    CHECK (digits IN (6, 8));
+ALTER TABLE master_tokens ADD COLUMN period INTEGER NOT NULL DEFAULT 30
+    CHECK (period BETWEEN 15 AND 300);
+ALTER TABLE master_tokens ADD COLUMN skew INTEGER NOT NULL DEFAULT 1
+    CHECK (skew BETWEEN 0 AND 2);
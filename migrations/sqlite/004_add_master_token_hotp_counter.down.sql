@@ -0,0 +1,2 @@
+ALTER TABLE master_tokens DROP COLUMN counter;
+ALTER TABLE master_tokens DROP COLUMN type;
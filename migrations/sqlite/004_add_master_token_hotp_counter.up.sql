@@ -0,0 +1,4 @@
+ALTER TABLE master_tokens ADD COLUMN type TEXT NOT NULL DEFAULT 'totp'
+    CHECK (type IN ('totp', 'hotp'));
+ALTER TABLE master_tokens ADD COLUMN counter INTEGER NOT NULL DEFAULT 0
+    CHECK (counter >= 0);
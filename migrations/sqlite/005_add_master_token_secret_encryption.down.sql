@@ -0,0 +1,5 @@
+-- Rows written with master keys configured are unreadable after this rollback.
+DROP INDEX IF EXISTS idx_master_tokens_key_id;
+
+ALTER TABLE master_tokens DROP COLUMN key_id;
+ALTER TABLE master_tokens DROP COLUMN data_key;
@@ -0,0 +1,4 @@
+ALTER TABLE master_tokens ADD COLUMN data_key TEXT;
+ALTER TABLE master_tokens ADD COLUMN key_id TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_master_tokens_key_id ON master_tokens(key_id);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_master_tokens_pending;
+
+DELETE FROM master_tokens WHERE confirmed_at IS NULL;
+
+ALTER TABLE master_tokens DROP COLUMN confirmed_at;
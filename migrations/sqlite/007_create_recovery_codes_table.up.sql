@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    token_id TEXT NOT NULL REFERENCES master_tokens(id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    used_at DATETIME
+);
+
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_unused ON recovery_codes(token_id) WHERE used_at IS NULL;
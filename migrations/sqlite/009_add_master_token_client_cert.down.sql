@@ -0,0 +1 @@
+ALTER TABLE master_tokens DROP COLUMN client_cert_subject;
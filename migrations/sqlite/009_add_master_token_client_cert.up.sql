@@ -0,0 +1 @@
+ALTER TABLE master_tokens ADD COLUMN client_cert_subject TEXT;
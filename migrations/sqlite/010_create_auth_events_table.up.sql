@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS auth_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    occurred_at DATETIME NOT NULL,
+    event_type TEXT NOT NULL,
+    token_id TEXT NOT NULL DEFAULT '',
+    source_ip TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    outcome TEXT NOT NULL,
+    prev_hash TEXT NOT NULL,
+    hash TEXT NOT NULL UNIQUE
+);
+
+CREATE INDEX IF NOT EXISTS idx_auth_events_token_id ON auth_events(token_id);
+CREATE INDEX IF NOT EXISTS idx_auth_events_occurred_at ON auth_events(occurred_at);
+
+-- The log is append-only. Rows deliberately don't reference master_tokens so
+-- they outlive deleted tokens.
+CREATE TRIGGER IF NOT EXISTS auth_events_no_update
+    BEFORE UPDATE ON auth_events
+BEGIN
+    SELECT RAISE(ABORT, 'auth_events is append-only');
+END;
+
+CREATE TRIGGER IF NOT EXISTS auth_events_no_delete
+    BEFORE DELETE ON auth_events
+BEGIN
+    SELECT RAISE(ABORT, 'auth_events is append-only');
+END;
@@ -0,0 +1,11 @@
+-- A single row holding the hash of the last audit event, which appends
+-- chain to.
+CREATE TABLE IF NOT EXISTS auth_event_head (
+    id INTEGER PRIMARY KEY CHECK (id = 1),
+    hash TEXT NOT NULL
+);
+
+INSERT OR IGNORE INTO auth_event_head (id, hash)
+SELECT 1, COALESCE(
+    (SELECT hash FROM auth_events ORDER BY id DESC LIMIT 1),
+    '0000000000000000000000000000000000000000000000000000000000000000');
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"otp-basic/internal/server"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
@@ -18,6 +28,13 @@ func main() {
 		log.Fatalf("Failed to create server: %v", err)
 	}
 
+	// Stop on Ctrl+C or when the orchestrator asks us to
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	log.Printf("Starting OTP server on port %s", port)
-	log.Fatal(srv.Run(":" + port))
+	if err := srv.Run(ctx, ":"+port); err != nil {
+		log.Fatalf("Server error: %v", err)
+	}
+	log.Println("Server stopped")
 }
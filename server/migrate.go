@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"otp-basic/internal/database"
+)
+
+const migrateUsage = `usage: otp-server migrate <command>
+
+Commands:
+  up            Apply all pending migrations
+  down [N]      Roll back the last N migrations (default: 1)
+  version       Print the current schema version
+  force VERSION Set the schema version without running migrations`
+
+// runMigrate implements the "migrate" subcommand, so schema changes can be
+// applied as a deploy step separate from starting the server.
+func runMigrate(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing command\n%s", migrateUsage)
+	}
+
+	db, err := database.Connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "up":
+		return db.MigrateUp()
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		if err := db.MigrateDown(steps); err != nil {
+			return err
+		}
+		log.Printf("Rolled back %d migration(s)", steps)
+		return nil
+	case "version":
+		version, dirty, err := db.MigrationVersion()
+		if err != nil {
+			return err
+		}
+		if dirty {
+			fmt.Printf("%d (dirty)\n", version)
+		} else {
+			fmt.Println(version)
+		}
+		return nil
+	case "force":
+		if len(args) < 2 {
+			return fmt.Errorf("missing version\n%s", migrateUsage)
+		}
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		return db.ForceMigrationVersion(version)
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], migrateUsage)
+	}
+}